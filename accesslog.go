@@ -0,0 +1,276 @@
+// Copyright 2026 Tamás Gulácsi.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/UNO-SOFT/zlog/v2"
+)
+
+var accessLogger *slog.Logger
+
+// openAccessLog opens the access log: stderr if fn is empty, else a file
+// rotated at maxSize bytes, keeping maxBackups old files.
+func openAccessLog(fn string, maxSize int64, maxBackups int) (io.Closer, error) {
+	if fn == "" {
+		accessLogger = slog.New(zlog.MaybeConsoleHandler(slog.LevelInfo, os.Stderr))
+		return io.NopCloser(nil), nil
+	}
+	rf, err := newRotatingFile(fn, maxSize, maxBackups)
+	if err != nil {
+		return nil, err
+	}
+	accessLogger = slog.New(slog.NewJSONHandler(rf, nil))
+	return rf, nil
+}
+
+type ctxKeyAccess struct{}
+
+// accessInfo collects the request data logged at the end of the request.
+type accessInfo struct {
+	id        string
+	mu        sync.Mutex
+	ref, user string
+}
+
+// setAccessRef records the ref handled by the request, for the access log.
+func setAccessRef(ctx context.Context, ref string) {
+	if ai, ok := ctx.Value(ctxKeyAccess{}).(*accessInfo); ok {
+		ai.mu.Lock()
+		ai.ref = ref
+		ai.mu.Unlock()
+	}
+}
+
+// setAccessUser records the user accepted by authenticate, for the access log.
+func setAccessUser(ctx context.Context, user string) {
+	if ai, ok := ctx.Value(ctxKeyAccess{}).(*accessInfo); ok {
+		ai.mu.Lock()
+		ai.user = user
+		ai.mu.Unlock()
+	}
+}
+
+// requestIDFromContext returns the request ID assigned by withAccessLog.
+func requestIDFromContext(ctx context.Context) string {
+	if ai, ok := ctx.Value(ctxKeyAccess{}).(*accessInfo); ok {
+		return ai.id
+	}
+	return ""
+}
+
+// requestID returns the sanitized X-Request-ID header, or a new random ID.
+func requestID(r *http.Request) string {
+	if id := r.Header.Get("X-Request-ID"); id != "" && len(id) <= 128 {
+		ok := true
+		for _, c := range id {
+			if c <= ' ' || c >= 0x7f {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			return id
+		}
+	}
+	var b [12]byte
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// withAccessLog assigns a request ID to each request, stores a logger
+// carrying it in the context, and writes one access log record at the end.
+func withAccessLog(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		id := requestID(r)
+		w.Header().Set("X-Request-ID", id)
+		ai := &accessInfo{id: id}
+		ctx := context.WithValue(r.Context(), ctxKeyAccess{}, ai)
+		ctx = zlog.NewSContext(ctx, logger.With("reqID", id))
+		cw := &countingResponseWriter{ResponseWriter: w}
+		var cr *countingReader
+		if r.Body != nil {
+			cr = &countingReader{ReadCloser: r.Body}
+			r.Body = cr
+		}
+		h.ServeHTTP(cw, r.WithContext(ctx))
+
+		if accessLogger == nil {
+			return
+		}
+		status := cw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		outcome := "ok"
+		if err := ctx.Err(); err != nil {
+			outcome = "canceled"
+			if errors.Is(err, context.DeadlineExceeded) {
+				outcome = "timeout"
+			}
+		} else if status >= 400 {
+			outcome = "error"
+		}
+		var bytesIn int64
+		if cr != nil {
+			bytesIn = cr.n
+		}
+		ai.mu.Lock()
+		ref, user := ai.ref, ai.user
+		ai.mu.Unlock()
+		accessLogger.LogAttrs(ctx, slog.LevelInfo, "access",
+			slog.String("reqID", id),
+			slog.String("remote", r.RemoteAddr),
+			slog.String("user", user),
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.String("ref", ref),
+			slog.Int("status", status),
+			slog.Int64("bytesIn", bytesIn),
+			slog.Int64("bytesOut", cw.n),
+			slog.Duration("dur", time.Since(start)),
+			slog.String("outcome", outcome),
+		)
+	})
+}
+
+type countingResponseWriter struct {
+	http.ResponseWriter
+	n      int64
+	status int
+}
+
+func (w *countingResponseWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+func (w *countingResponseWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+func (w *countingResponseWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
+
+// Flush flushes the wrapped writer, for the streamed responses.
+func (w *countingResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// ReadFrom uses the ReadFrom of the wrapped writer (sendfile), if it has one.
+func (w *countingResponseWriter) ReadFrom(r io.Reader) (int64, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	var n int64
+	var err error
+	if rf, ok := w.ResponseWriter.(io.ReaderFrom); ok {
+		n, err = rf.ReadFrom(r)
+	} else {
+		n, err = io.Copy(w.ResponseWriter, r)
+	}
+	w.n += n
+	return n, err
+}
+
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// rotatingFile is an io.WriteCloser which renames the file to fn.1 (fn.2, ...)
+// when it would grow over maxSize.
+type rotatingFile struct {
+	mu         sync.Mutex
+	fh         *os.File
+	fn         string
+	size       int64
+	maxSize    int64
+	maxBackups int
+}
+
+func newRotatingFile(fn string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	rf := &rotatingFile{fn: fn, maxSize: maxSize, maxBackups: maxBackups}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *rotatingFile) open() error {
+	fh, err := os.OpenFile(rf.fn, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	fi, err := fh.Stat()
+	if err != nil {
+		fh.Close()
+		return err
+	}
+	rf.fh, rf.size = fh, fi.Size()
+	return nil
+}
+
+func (rf *rotatingFile) Write(p []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.maxSize > 0 && rf.size > 0 && rf.size+int64(len(p)) > rf.maxSize {
+		if err := rf.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := rf.fh.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+func (rf *rotatingFile) rotate() error {
+	if err := rf.fh.Close(); err != nil {
+		return err
+	}
+	if rf.maxBackups <= 0 {
+		_ = os.Remove(rf.fn)
+	} else {
+		_ = os.Remove(rf.fn + "." + strconv.Itoa(rf.maxBackups))
+		for i := rf.maxBackups - 1; i > 0; i-- {
+			_ = os.Rename(rf.fn+"."+strconv.Itoa(i), rf.fn+"."+strconv.Itoa(i+1))
+		}
+		if err := os.Rename(rf.fn, rf.fn+".1"); err != nil {
+			return fmt.Errorf("rotate %q: %w", rf.fn, err)
+		}
+	}
+	return rf.open()
+}
+
+func (rf *rotatingFile) Close() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	return rf.fh.Close()
+}
@@ -0,0 +1,159 @@
+// Copyright 2026 Tamás Gulácsi.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRotatingFile(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "access.log")
+	rf, err := newRotatingFile(fn, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"aaaaaa\n", "bbbbbb\n", "cccccc\n", "dddddd\n"} {
+		if _, err := io.WriteString(rf, s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := rf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for suffix, want := range map[string]string{
+		"": "dddddd\n", ".1": "cccccc\n", ".2": "bbbbbb\n",
+	} {
+		b, err := os.ReadFile(fn + suffix)
+		if err != nil {
+			t.Errorf("%q: %v", suffix, err)
+		} else if string(b) != want {
+			t.Errorf("%q: got %q, wanted %q", suffix, b, want)
+		}
+	}
+	if _, err := os.Stat(fn + ".3"); err == nil {
+		t.Error("more backups are kept than maxBackups")
+	}
+
+	// reopen appends
+	if rf, err = newRotatingFile(fn, 10, 2); err != nil {
+		t.Fatal(err)
+	}
+	if rf.size != 7 {
+		t.Errorf("reopened size: got %d, wanted 7", rf.size)
+	}
+	rf.Close()
+}
+
+func TestRequestID(t *testing.T) {
+	for i, elt := range []struct {
+		in   string
+		keep bool
+	}{
+		{"abc-123", true},
+		{"", false},
+		{"has space", false},
+		{"ütf", false},
+		{strings.Repeat("x", 129), false},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		if elt.in != "" {
+			r.Header.Set("X-Request-ID", elt.in)
+		}
+		got := requestID(r)
+		if (got == elt.in) != elt.keep || got == "" {
+			t.Errorf("%d. %q: got %q", i, elt.in, got)
+		}
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	var buf bytes.Buffer
+	defer func(old *slog.Logger) { accessLogger = old }(accessLogger)
+	accessLogger = slog.New(slog.NewJSONHandler(&buf, nil))
+
+	var seen string
+	h := withAccessLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = requestIDFromContext(r.Context())
+		setAccessRef(r.Context(), "sha224-abc")
+		if _, _, ok := r.BasicAuth(); ok {
+			setAccessUser(r.Context(), "alice") // as authenticate does
+		}
+		_, _ = io.Copy(io.Discard, r.Body)
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte("hello"))
+	}))
+	r := httptest.NewRequest("POST", "/x", strings.NewReader("body"))
+	r.Header.Set("X-Request-ID", "req-1")
+	r.SetBasicAuth("alice", "secret")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+
+	if got := w.Header().Get("X-Request-ID"); got != "req-1" {
+		t.Errorf("echoed X-Request-ID: got %q", got)
+	}
+	if seen != "req-1" {
+		t.Errorf("request ID in the context: got %q", seen)
+	}
+	var rec struct {
+		ReqID, User, Method, Path, Ref, Outcome string
+		Status                                  int
+		BytesIn, BytesOut                       int64
+	}
+	if err := json.Unmarshal(buf.Bytes(), &rec); err != nil {
+		t.Fatalf("%q: %+v", buf.String(), err)
+	}
+	if rec.ReqID != "req-1" || rec.User != "alice" || rec.Method != "POST" || rec.Path != "/x" ||
+		rec.Ref != "sha224-abc" || rec.Status != http.StatusCreated || rec.Outcome != "ok" ||
+		rec.BytesIn != 4 || rec.BytesOut != 5 {
+		t.Errorf("got %+v", rec)
+	}
+}
+
+func TestAccessLogUnverifiedUser(t *testing.T) {
+	var buf bytes.Buffer
+	defer func(old *slog.Logger) { accessLogger = old }(accessLogger)
+	accessLogger = slog.New(slog.NewJSONHandler(&buf, nil))
+	// without authenticate (-noauth), the user sent is not logged
+	h := withAccessLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	r := httptest.NewRequest("GET", "/x", nil)
+	r.SetBasicAuth("mallory", "")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	if strings.Contains(buf.String(), "mallory") {
+		t.Errorf("unverified user is logged: %s", buf.String())
+	}
+}
+
+func TestCountingResponseWriter(t *testing.T) {
+	rec := httptest.NewRecorder()
+	cw := &countingResponseWriter{ResponseWriter: rec}
+	var w http.ResponseWriter = cw
+	f, ok := w.(http.Flusher)
+	if !ok {
+		t.Fatal("not a Flusher")
+	}
+	f.Flush()
+	if !rec.Flushed {
+		t.Error("Flush is not passed through")
+	}
+	rf, ok := w.(io.ReaderFrom)
+	if !ok {
+		t.Fatal("not a ReaderFrom")
+	}
+	if n, err := rf.ReadFrom(strings.NewReader("hello")); err != nil || n != 5 {
+		t.Errorf("ReadFrom: got %d, %v", n, err)
+	}
+	if cw.n != 5 || cw.status != http.StatusOK || rec.Body.String() != "hello" {
+		t.Errorf("got n=%d status=%d body=%q", cw.n, cw.status, rec.Body)
+	}
+}
@@ -222,6 +222,36 @@ func (sto Storage) Close() error {
 	return sto.db.Close()
 }
 
+// RunValueLogGC runs the value log garbage collection in every interval,
+// till ctx is canceled.
+func (sto Storage) RunValueLogGC(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		for sto.db.RunValueLogGC(0.5) == nil {
+			if ctx.Err() != nil {
+				return
+			}
+		}
+	}
+}
+
+// DropAll deletes all the blobs (all the keys with the prefix).
+func (sto Storage) DropAll() error {
+	if sto.prefix == "" {
+		return sto.db.DropAll()
+	}
+	return sto.db.DropPrefix([]byte(sto.prefix))
+}
+
+// Size returns the size of the LSM tree and the value log files.
+func (sto Storage) Size() (lsm, vlog int64) { return sto.db.Size() }
+
 type nilLogger struct{}
 
 func (nilLogger) Errorf(string, ...interface{})   {}
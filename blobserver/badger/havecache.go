@@ -0,0 +1,77 @@
+// Copyright 2026 Tamás Gulácsi.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package badger
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"perkeep.org/pkg/blob"
+
+	badgerdb "github.com/dgraph-io/badger/v4"
+)
+
+// HaveCache remembers the blobs known to exist on a server, in its current
+// storage generation. It implements perkeep.org/pkg/client.HaveCache.
+type HaveCache struct {
+	db     *badgerdb.DB
+	prefix string
+}
+
+// HaveCache returns the HaveCache of server in sto.
+// If the server's storage generation differs from the one seen last time,
+// all the remembered blobs of the server are forgotten.
+func (sto Storage) HaveCache(server, generation string) (HaveCache, error) {
+	hc := HaveCache{db: sto.db, prefix: sto.prefix + "have\x00" + server + "\x00"}
+	genKey := []byte(sto.prefix + "havegen\x00" + server)
+	var old string
+	err := sto.db.View(func(txn *badgerdb.Txn) error {
+		item, err := txn.Get(genKey)
+		if err != nil {
+			return err
+		}
+		b, err := item.ValueCopy(nil)
+		old = string(b)
+		return err
+	})
+	if err != nil && !errors.Is(err, badgerdb.ErrKeyNotFound) {
+		return hc, err
+	}
+	if old == generation && err == nil {
+		return hc, nil
+	}
+	if err = sto.db.DropPrefix([]byte(hc.prefix)); err != nil {
+		return hc, err
+	}
+	return hc, sto.db.Update(func(txn *badgerdb.Txn) error {
+		return txn.Set(genKey, []byte(generation))
+	})
+}
+
+// StatBlobCache returns the size of br, if it is known to exist on the server.
+func (hc HaveCache) StatBlobCache(br blob.Ref) (size uint32, ok bool) {
+	_ = hc.db.View(func(txn *badgerdb.Txn) error {
+		item, err := txn.Get(BlobRefBytes(hc.prefix, br))
+		if err != nil {
+			return err
+		}
+		return item.Value(func(value []byte) error {
+			if len(value) == 4 {
+				size, ok = binary.BigEndian.Uint32(value), true
+			}
+			return nil
+		})
+	})
+	return size, ok
+}
+
+// NoteBlobExists remembers that br exists on the server.
+func (hc HaveCache) NoteBlobExists(br blob.Ref, size uint32) {
+	var value [4]byte
+	binary.BigEndian.PutUint32(value[:], size)
+	_ = hc.db.Update(func(txn *badgerdb.Txn) error {
+		return txn.Set(BlobRefBytes(hc.prefix, br), value[:])
+	})
+}
@@ -0,0 +1,52 @@
+// Copyright 2026 Tamás Gulácsi.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package badger
+
+import (
+	"testing"
+
+	"perkeep.org/pkg/blob"
+)
+
+func TestHaveCache(t *testing.T) {
+	sto, err := New(t.TempDir(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sto.Close()
+	br := blob.RefFromString("some blob")
+
+	hc, err := sto.HaveCache("server", "gen1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := hc.StatBlobCache(br); ok {
+		t.Error("empty cache has the blob")
+	}
+	hc.NoteBlobExists(br, 9)
+	if size, ok := hc.StatBlobCache(br); !ok || size != 9 {
+		t.Errorf("got %d, %t; wanted 9, true", size, ok)
+	}
+
+	if other, err := sto.HaveCache("other", "gen1"); err != nil {
+		t.Fatal(err)
+	} else if _, ok := other.StatBlobCache(br); ok {
+		t.Error("other server has the blob")
+	}
+
+	if hc, err = sto.HaveCache("server", "gen1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := hc.StatBlobCache(br); !ok {
+		t.Error("blob is forgotten in the same generation")
+	}
+
+	if hc, err = sto.HaveCache("server", "gen2"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := hc.StatBlobCache(br); ok {
+		t.Error("blob is remembered after the generation changed")
+	}
+}
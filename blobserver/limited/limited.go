@@ -24,6 +24,8 @@ package limited
 import (
 	"context"
 	"io"
+	"math"
+	"sync"
 	"time"
 
 	"perkeep.org/pkg/blob"
@@ -88,6 +90,118 @@ func (lp lruPolicy) Put(key string) (evicted string) {
 func (lp lruPolicy) Get(key string)    { lp.lru.Get(key) }
 func (lp lruPolicy) Remove(key string) { lp.lru.Remove(key) }
 
+// SizedEvictPolicy is an EvictPolicy which limits the total size of the blobs.
+type SizedEvictPolicy interface {
+	EvictPolicy
+	// PutSized returns what has been evicted.
+	PutSized(key string, size int64) (evicted []string)
+}
+
+// LRUSizeEvictPolicy returns an LRU based eviction policy which limits the
+// total size of the blobs to maxSize bytes.
+func LRUSizeEvictPolicy(maxSize int64) *lruSizePolicy {
+	lru, err := simplelru.NewLRU(math.MaxInt32, nil)
+	if err != nil {
+		panic(err)
+	}
+	return &lruSizePolicy{lru: lru, maxSize: maxSize}
+}
+
+var _ = SizedEvictPolicy((*lruSizePolicy)(nil))
+
+type lruSizePolicy struct {
+	mu      sync.Mutex
+	lru     *simplelru.LRU
+	size    int64
+	maxSize int64
+}
+
+func (lp *lruSizePolicy) PutSized(key string, size int64) (evicted []string) {
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+	if old, ok := lp.lru.Peek(key); ok {
+		lp.size -= old.(int64)
+	}
+	lp.lru.Add(key, size)
+	lp.size += size
+	for lp.size > lp.maxSize {
+		k, v, ok := lp.lru.RemoveOldest()
+		if !ok {
+			break
+		}
+		lp.size -= v.(int64)
+		evicted = append(evicted, k.(string))
+	}
+	return evicted
+}
+func (lp *lruSizePolicy) Put(key string) (evicted string) {
+	if ks := lp.PutSized(key, 0); len(ks) != 0 {
+		return ks[0]
+	}
+	return ""
+}
+func (lp *lruSizePolicy) Get(key string) {
+	lp.mu.Lock()
+	lp.lru.Get(key)
+	lp.mu.Unlock()
+}
+func (lp *lruSizePolicy) Remove(key string) {
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+	if v, ok := lp.lru.Peek(key); ok {
+		lp.size -= v.(int64)
+		lp.lru.Remove(key)
+	}
+}
+
+// Purge forgets all the blobs.
+func (lp *lruSizePolicy) Purge() {
+	lp.mu.Lock()
+	lp.lru.Purge()
+	lp.size = 0
+	lp.mu.Unlock()
+}
+
+// Stats returns the number and the total size of the blobs.
+func (lp *lruSizePolicy) Stats() (count int, size int64) {
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+	return lp.lru.Len(), lp.size
+}
+
+// LoadEvictState puts the blobs of the underlying storage into the eviction
+// policy, evicting the excess - as the policy's state is not persisted,
+// this should be called at startup.
+func (sto Storage) LoadEvictState(ctx context.Context) error {
+	var evicted []blob.Ref
+	err := blobserver.EnumerateAll(ctx, sto.storage, func(sr blob.SizedRef) error {
+		for _, k := range sto.put(sr) {
+			if ebr, ok := blob.Parse(k); ok && ebr.Valid() {
+				evicted = append(evicted, ebr)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(evicted) == 0 {
+		return nil
+	}
+	return sto.storage.RemoveBlobs(ctx, evicted)
+}
+
+// put puts the blob into the eviction policy, and returns what has been evicted.
+func (sto Storage) put(sr blob.SizedRef) []string {
+	if sp, ok := sto.evictPolicy.(SizedEvictPolicy); ok {
+		return sp.PutSized(sr.Ref.String(), int64(sr.Size))
+	}
+	if evict := sto.evictPolicy.Put(sr.Ref.String()); evict != "" {
+		return []string{evict}
+	}
+	return nil
+}
+
 func (sto Storage) Fetch(ctx context.Context, br blob.Ref) (io.ReadCloser, uint32, error) {
 	sto.evictPolicy.Get(br.String())
 	return sto.storage.Fetch(ctx, br)
@@ -128,11 +242,15 @@ func (sto Storage) ReceiveBlob(ctx context.Context, br blob.Ref, source io.Reade
 	if err != nil {
 		return sr, err
 	}
-	if evict := sto.evictPolicy.Put(br.String()); evict != "" {
-		if ebr, ok := blob.Parse(evict); ok && ebr.Valid() {
-			_ = sto.storage.RemoveBlobs(ctx, []blob.Ref{ebr})
+	var evicted []blob.Ref
+	for _, k := range sto.put(sr) {
+		if ebr, ok := blob.Parse(k); ok && ebr.Valid() {
+			evicted = append(evicted, ebr)
 		}
 	}
+	if len(evicted) != 0 {
+		_ = sto.storage.RemoveBlobs(ctx, evicted)
+	}
 	return sr, nil
 }
 
@@ -21,6 +21,7 @@ limitations under the License.
 package limited
 
 import (
+	"slices"
 	"testing"
 
 	"perkeep.org/pkg/blobserver"
@@ -34,3 +35,29 @@ func TestStorage(t *testing.T) {
 		return NewStorage(sto, 100)
 	})
 }
+
+func TestLRUSizeEvictPolicy(t *testing.T) {
+	lp := LRUSizeEvictPolicy(10)
+	for _, tC := range []struct {
+		key     string
+		size    int64
+		evicted []string
+	}{
+		{"a", 4, nil},
+		{"b", 4, nil},
+		{"a", 4, nil},
+		{"c", 4, []string{"b"}},
+		{"d", 8, []string{"a", "c"}},
+		{"e", 11, []string{"d", "e"}},
+	} {
+		got := lp.PutSized(tC.key, tC.size)
+		if !slices.Equal(got, tC.evicted) {
+			t.Errorf("put %q: got %q, wanted %q", tC.key, got, tC.evicted)
+		}
+	}
+	lp.PutSized("f", 3)
+	lp.Remove("f")
+	if count, size := lp.Stats(); count != 0 || size != 0 {
+		t.Errorf("got %d blobs of %d bytes, wanted none", count, size)
+	}
+}
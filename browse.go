@@ -0,0 +1,91 @@
+// Copyright 2026 Tamás Gulácsi.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/tgulacsi/camproxy/camutil"
+)
+
+var dirListTemplate = template.Must(template.New("dir").Funcs(template.FuncMap{"pathEscape": url.PathEscape}).Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>{{.Path}}</title></head>
+<body><h1>{{.Path}}</h1>
+<table>
+<tr><th>Name</th><th>Type</th><th>Size</th><th>Modified</th><th>Ref</th></tr>
+{{if .Parent}}<tr><td><a href="../">../</a></td></tr>
+{{end}}{{range .Entries}}<tr><td><a href="{{pathEscape .Name}}{{if .IsDir}}/{{end}}">{{.Name}}{{if .IsDir}}/{{end}}</a>{{if .Target}} -&gt; {{.Target}}{{end}}</td><td>{{.Type}}</td><td>{{if not .IsDir}}{{.Size}}{{end}}</td><td>{{if not .ModTime.IsZero}}{{.ModTime.Format "2006-01-02 15:04:05"}}{{end}}</td><td>{{.Ref}}</td></tr>
+{{end}}</table>
+</body></html>
+`))
+
+// serveBrowse serves GET /<dirref>/sub/path: the listing of a directory
+// (HTML, or JSON if asked by format=json or the Accept header),
+// or the contents of a file inside the stored tree.
+func serveBrowse(w http.ResponseWriter, r *http.Request, root, sub string) {
+	items, err := camutil.ParseBlobNames(nil, []string{root})
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	br := items[0]
+	setAccessRef(r.Context(), br.String())
+	d, err := getDownloader()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error getting downloader to %q: %s", server, err), 500)
+		return
+	}
+	e, err := d.Lookup(r.Context(), br, sub)
+	if err != nil {
+		// the root may be a file with a paranoid copy, as for the plain GET
+		if strings.Trim(sub, "/") == "" && serveParanoid(w, r, br, err) {
+			return
+		}
+		browseError(w, err)
+		return
+	}
+	switch e.Type {
+	case "file":
+		serveRange(w, r, d, e.Ref, camutil.RefToBase64(e.Ref), mime.TypeByExtension(path.Ext(e.Name)))
+		return
+	case "directory":
+	default:
+		http.Error(w, fmt.Sprintf("%q is a %s", sub, e.Type), http.StatusUnprocessableEntity)
+		return
+	}
+	if !strings.HasSuffix(r.URL.Path, "/") {
+		u := *r.URL
+		u.Path += "/"
+		http.Redirect(w, r, u.String(), http.StatusMovedPermanently)
+		return
+	}
+	list, err := d.ReadDir(r.Context(), e.Ref)
+	if err != nil {
+		browseError(w, err)
+		return
+	}
+	if r.URL.Query().Get("format") == "json" || strings.Contains(r.Header.Get("Accept"), "application/json") {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(list)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err = dirListTemplate.Execute(w, struct {
+		Path    string
+		Parent  bool
+		Entries []camutil.DirEntry
+	}{Path: r.URL.Path, Parent: strings.Trim(sub, "/") != "", Entries: list}); err != nil {
+		http.Error(w, err.Error(), 500)
+	}
+}
+
+func browseError(w http.ResponseWriter, err error) { httpError(w, err.Error(), err) }
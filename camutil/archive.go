@@ -0,0 +1,230 @@
+// Copyright 2026 Tamás Gulácsi.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package camutil
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"time"
+
+	"perkeep.org/pkg/blob"
+	"perkeep.org/pkg/schema"
+)
+
+// archiveWriter is the format specific part of WriteArchive.
+type archiveWriter interface {
+	dir(name string, b *schema.Blob) error
+	file(name string, b *schema.Blob, r io.Reader) error
+	symlink(name, target string, b *schema.Blob) error
+	Close() error
+}
+
+// WriteArchive writes the trees (or files) items as a "tar" or "zip" archive to w,
+// the entries selected by opts (Mode and Workers are not used).
+// Exceeding opts.MaxSize is reported (as ErrTooLarge) before writing anything.
+//
+// The trees are walked in order, so the archive can be streamed.
+// On error, the archive is left unfinished (no trailer is written), so it
+// cannot be mistaken for a complete one.
+func (down *Downloader) WriteArchive(ctx context.Context, w io.Writer, format string, opts SaveOptions, items ...blob.Ref) error {
+	var aw archiveWriter
+	switch format {
+	case "tar":
+		aw = tarWriter{tar.NewWriter(w)}
+	case "zip":
+		aw = zipWriter{zip.NewWriter(w)}
+	default:
+		return fmt.Errorf("unknown archive format %q (wanted tar or zip)", format)
+	}
+	src := down.verified(down.Fetcher)
+	if opts.MaxSize > 0 {
+		// the size of the selected files is summed first, so ErrTooLarge
+		// is returned before anything is written to w
+		sizer := archiveTree{src: src, pf: down.prefetch, filter: newTreeFilter(opts), w: archiveSizer{}}
+		for _, br := range items {
+			if err := sizer.walk(ctx, "", "", 0, br); err != nil {
+				return err
+			}
+		}
+	}
+	at := archiveTree{
+		src: src, pf: down.prefetch,
+		filter: newTreeFilter(opts), w: aw,
+	}
+	for _, br := range items {
+		if err := at.walk(ctx, "", "", 0, br); err != nil {
+			return err
+		}
+	}
+	return aw.Close()
+}
+
+type archiveTree struct {
+	src    blob.Fetcher
+	pf     prefetch
+	filter treeFilter
+	w      archiveWriter
+}
+
+// walk adds br to the archive under parent - see restorer.smartFetch.
+func (at archiveTree) walk(ctx context.Context, parent, parentRel string, depth int, br blob.Ref) error {
+	logger := loggerFromContext(ctx)
+	b, err := fetchSchemaBlob(ctx, at.src, br)
+	if err != nil {
+		return err
+	}
+	name, rel := parent, parentRel
+	if t := b.Type(); t != "static-set" {
+		name = path.Join(parent, b.FileName())
+		if depth != 0 {
+			rel = path.Join(parentRel, b.FileName())
+			if t != "directory" && !at.filter.match(rel, depth) {
+				return nil
+			}
+		}
+	}
+
+	switch b.Type() {
+	case "directory":
+		descend := depth == 0 || at.filter.descend(rel, depth)
+		if !descend && !at.filter.match(rel, depth) {
+			return nil
+		}
+		if err = at.w.dir(name, b); err != nil {
+			return err
+		}
+		if !descend {
+			return nil
+		}
+		entries, ok := b.DirectoryEntries()
+		if !ok {
+			return fmt.Errorf("bad entries blobref in dir %v", b.BlobRef())
+		}
+		return at.walk(ctx, name, rel, depth, entries)
+	case "static-set":
+		for _, mref := range b.StaticSetMembers() {
+			if err = at.walk(ctx, parent, rel, depth+1, mref); err != nil {
+				return err
+			}
+		}
+		for _, mref := range b.StaticSetMergeSets() {
+			if err = at.walk(ctx, parent, rel, depth, mref); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "file":
+		if err = at.filter.reserve(b.PartsSize()); err != nil {
+			return fmt.Errorf("%s: %w", rel, err)
+		}
+		if _, ok := at.w.(archiveSizer); ok {
+			return nil
+		}
+		sr, err := newStreamReader(ctx, at.src, b, at.pf)
+		if err != nil {
+			return err
+		}
+		defer sr.Close()
+		return at.w.file(name, b, sr)
+	case "symlink":
+		sf, ok := b.AsStaticFile()
+		if !ok {
+			return fmt.Errorf("%s: not a static file", br)
+		}
+		sl, ok := sf.AsStaticSymlink()
+		if !ok {
+			return fmt.Errorf("%s: not a symlink", br)
+		}
+		return at.w.symlink(name, sl.SymlinkTargetString(), b)
+	default:
+		logger.Debug("Skipping (not archivable).", "path", name, "type", b.Type())
+		return nil
+	}
+}
+
+// archiveSizer is the archiveWriter of the walk summing the sizes of the files:
+// it writes nothing.
+type archiveSizer struct{}
+
+func (archiveSizer) dir(string, *schema.Blob) error             { return nil }
+func (archiveSizer) file(string, *schema.Blob, io.Reader) error { return nil }
+func (archiveSizer) symlink(string, string, *schema.Blob) error { return nil }
+func (archiveSizer) Close() error                               { return nil }
+
+type tarWriter struct{ *tar.Writer }
+
+func (tw tarWriter) header(name string, typ byte, b *schema.Blob) *tar.Header {
+	return &tar.Header{
+		Typeflag: typ, Name: name,
+		Mode:    int64(b.FileMode().Perm()),
+		ModTime: b.ModTime(),
+		Uid:     b.MapUid(), Gid: b.MapGid(),
+		Format: tar.FormatPAX,
+	}
+}
+func (tw tarWriter) dir(name string, b *schema.Blob) error {
+	return tw.WriteHeader(tw.header(name+"/", tar.TypeDir, b))
+}
+func (tw tarWriter) file(name string, b *schema.Blob, r io.Reader) error {
+	hdr := tw.header(name, tar.TypeReg, b)
+	hdr.Size = b.PartsSize()
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if _, err := io.Copy(tw.Writer, r); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	return nil
+}
+func (tw tarWriter) symlink(name, target string, b *schema.Blob) error {
+	hdr := tw.header(name, tar.TypeSymlink, b)
+	hdr.Linkname = target
+	return tw.WriteHeader(hdr)
+}
+
+type zipWriter struct{ *zip.Writer }
+
+func (zw zipWriter) header(name string, b *schema.Blob) *zip.FileHeader {
+	hdr := &zip.FileHeader{Name: name, Method: zip.Deflate, Modified: b.ModTime()}
+	if hdr.Modified.IsZero() {
+		hdr.Modified = time.Now()
+	}
+	return hdr
+}
+func (zw zipWriter) dir(name string, b *schema.Blob) error {
+	hdr := zw.header(name+"/", b)
+	hdr.Method = zip.Store
+	hdr.SetMode(b.FileMode().Perm() | os.ModeDir)
+	_, err := zw.CreateHeader(hdr)
+	return err
+}
+func (zw zipWriter) file(name string, b *schema.Blob, r io.Reader) error {
+	hdr := zw.header(name, b)
+	hdr.SetMode(b.FileMode().Perm())
+	w, err := zw.CreateHeader(hdr)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(w, r); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	return nil
+}
+func (zw zipWriter) symlink(name, target string, b *schema.Blob) error {
+	hdr := zw.header(name, b)
+	hdr.Method = zip.Store
+	hdr.SetMode(b.FileMode().Perm() | os.ModeSymlink)
+	w, err := zw.CreateHeader(hdr)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, target)
+	return err
+}
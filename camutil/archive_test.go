@@ -0,0 +1,57 @@
+// Copyright 2026 Tamás Gulácsi.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package camutil
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"perkeep.org/pkg/blobserver/memory"
+	"perkeep.org/pkg/schema"
+)
+
+func TestWriteArchiveMaxSize(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	const text = "some text to archive"
+	var sto memory.Storage
+	br, err := schema.WriteFileFromReader(ctx, &sto, "a.txt", strings.NewReader(text))
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := &Downloader{Fetcher: &sto}
+	for i, elt := range []struct {
+		maxSize int64
+		err     error
+	}{
+		{0, nil},
+		{int64(len(text)), nil},
+		{int64(len(text)) - 1, ErrTooLarge},
+	} {
+		var buf bytes.Buffer
+		err := down.WriteArchive(ctx, &buf, "tar", SaveOptions{MaxSize: elt.maxSize}, br)
+		if !errors.Is(err, elt.err) {
+			t.Errorf("%d. got %v, wanted %v", i, err, elt.err)
+		}
+		if elt.err != nil {
+			if buf.Len() != 0 {
+				t.Errorf("%d. %d bytes are written before the error", i, buf.Len())
+			}
+			continue
+		}
+		tr := tar.NewReader(&buf)
+		if hdr, err := tr.Next(); err != nil || hdr.Name != "a.txt" {
+			t.Fatalf("%d. got %v, %v", i, hdr, err)
+		}
+		if b, err := io.ReadAll(tr); err != nil || string(b) != text {
+			t.Errorf("%d. got %q, %v", i, b, err)
+		}
+	}
+}
@@ -6,6 +6,7 @@ package camutil
 
 import (
 	"crypto/sha1"
+	"crypto/subtle"
 	"encoding/base64"
 	"fmt"
 	"io"
@@ -22,15 +23,14 @@ func SetupBasicAuthChecker(handler http.HandlerFunc, camliAuth string) http.Hand
 	if camliAuth == "" {
 		return handler
 	}
-	parts := strings.Split(camliAuth, ":")
-	if len(parts) < 3 || parts[0] != "userpass" {
+	username, password, ok := parseCamliAuth(camliAuth)
+	if !ok {
 		logger.Error("SetupBasicAuthHandler", "error", fmt.Errorf("unrecognizable camliAuth %q", camliAuth))
 		return handler
 	}
-	username := parts[1]
 	// nosemgrep: go.lang.security.audit.crypto.bad_imports.insecure-module-used go.lang.security.audit.crypto.use_of_weak_crypto.use-of-sha1
 	hsh := sha1.New()
-	if _, err := io.WriteString(hsh, parts[2]); err != nil {
+	if _, err := io.WriteString(hsh, password); err != nil {
 		logger.Error("hashing user:passw", "error", err)
 		return nil
 	}
@@ -44,3 +44,27 @@ func SetupBasicAuthChecker(handler http.HandlerFunc, camliAuth string) http.Hand
 		})
 	return auth.JustCheck(authenticator, handler)
 }
+
+// BasicAuthCheck returns the checker of the user and password against the
+// given camliAuth userpass:username:password (see CAMLI_AUTH) string,
+// for the protocols other than HTTP.
+// It returns nil if camliAuth is empty or unrecognizable - as SetupBasicAuthChecker does not check then.
+func BasicAuthCheck(camliAuth string) func(user, password string) bool {
+	username, passwd, ok := parseCamliAuth(camliAuth)
+	if !ok {
+		return nil
+	}
+	return func(user, password string) bool {
+		return subtle.ConstantTimeCompare([]byte(user), []byte(username))&
+			subtle.ConstantTimeCompare([]byte(password), []byte(passwd)) == 1
+	}
+}
+
+// parseCamliAuth parses the userpass:username:password[:+localhost,vivify=true] string.
+func parseCamliAuth(camliAuth string) (username, password string, ok bool) {
+	parts := strings.Split(camliAuth, ":")
+	if len(parts) < 3 || parts[0] != "userpass" {
+		return "", "", false
+	}
+	return parts[1], parts[2], true
+}
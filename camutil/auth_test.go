@@ -19,3 +19,23 @@ func TestSetupBasicAuthChecker(t *testing.T) {
 		}
 	}
 }
+
+func TestBasicAuthCheck(t *testing.T) {
+	if BasicAuthCheck("") != nil {
+		t.Error("checker from empty camliAuth")
+	}
+	check := BasicAuthCheck("userpass:a:b:+localhost")
+	for i, elt := range []struct {
+		user, password string
+		ok             bool
+	}{
+		{"a", "b", true},
+		{"a", "c", false},
+		{"b", "b", false},
+		{"", "", false},
+	} {
+		if got := check(elt.user, elt.password); got != elt.ok {
+			t.Errorf("%d. %q:%q: got %t, wanted %t", i, elt.user, elt.password, got, elt.ok)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+// Copyright 2026 Tamás Gulácsi.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package camutil
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"perkeep.org/pkg/blob"
+	"perkeep.org/pkg/schema"
+)
+
+// DirEntry is an entry of a stored directory tree.
+type DirEntry struct {
+	Name string `json:"name"`
+	// Type is the schema type: file, directory, symlink, fifo or socket.
+	Type    string    `json:"type"`
+	Size    int64     `json:"size,omitempty"`
+	ModTime time.Time `json:"mtime,omitempty"`
+	Ref     blob.Ref  `json:"ref"`
+	// Target is the target of a symlink.
+	Target string `json:"target,omitempty"`
+}
+
+// IsDir reports whether the entry is a directory.
+func (e DirEntry) IsDir() bool { return e.Type == "directory" }
+
+func newDirEntry(b *schema.Blob) DirEntry {
+	e := DirEntry{Name: b.FileName(), Type: string(b.Type()), ModTime: b.ModTime(), Ref: b.BlobRef()}
+	switch e.Type {
+	case "file":
+		e.Size = b.PartsSize()
+	case "symlink":
+		if sf, ok := b.AsStaticFile(); ok {
+			if sl, ok := sf.AsStaticSymlink(); ok {
+				e.Target = sl.SymlinkTargetString()
+			}
+		}
+	}
+	return e
+}
+
+// Stat returns the entry of the file or directory br.
+func (down *Downloader) Stat(ctx context.Context, br blob.Ref) (DirEntry, error) {
+	b, err := down.schemaBlob(ctx, br)
+	if err != nil {
+		return DirEntry{}, err
+	}
+	return newDirEntry(b), nil
+}
+
+// ReadDir returns the entries of the directory br, sorted by name.
+func (down *Downloader) ReadDir(ctx context.Context, br blob.Ref) ([]DirEntry, error) {
+	b, err := down.schemaBlob(ctx, br)
+	if err != nil {
+		return nil, err
+	}
+	if b.Type() != "directory" {
+		return nil, fmt.Errorf("%s: not a directory, but %q", br, b.Type())
+	}
+	var list []DirEntry
+	if _, err = down.walkDir(ctx, b, func(e DirEntry) bool {
+		list = append(list, e)
+		return false
+	}); err != nil {
+		return nil, err
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list, nil
+}
+
+// walkDir calls fn with the entries of the directory b, till fn returns true.
+// Returns whether fn has stopped the walk.
+func (down *Downloader) walkDir(ctx context.Context, b *schema.Blob, fn func(DirEntry) bool) (bool, error) {
+	entries, ok := b.DirectoryEntries()
+	if !ok {
+		return false, fmt.Errorf("bad entries blobref in dir %v", b.BlobRef())
+	}
+	return down.walkStaticSet(ctx, entries, fn)
+}
+
+// walkStaticSet calls fn with the entries of the static-set br (and its
+// subsets), till fn returns true.
+func (down *Downloader) walkStaticSet(ctx context.Context, br blob.Ref, fn func(DirEntry) bool) (bool, error) {
+	b, err := down.schemaBlob(ctx, br)
+	if err != nil {
+		return false, err
+	}
+	if b.Type() != "static-set" {
+		return false, fmt.Errorf("%s: not a static-set, but %q", br, b.Type())
+	}
+	for _, mref := range b.StaticSetMembers() {
+		mb, err := down.schemaBlob(ctx, mref)
+		if err != nil {
+			return false, err
+		}
+		if fn(newDirEntry(mb)) {
+			return true, nil
+		}
+	}
+	for _, mref := range b.StaticSetMergeSets() {
+		if stop, err := down.walkStaticSet(ctx, mref, fn); stop || err != nil {
+			return stop, err
+		}
+	}
+	return false, nil
+}
+
+// Lookup returns the entry of the slash-separated path name in the
+// directory tree root ("" is the root itself).
+// The returned error matches ErrNotFound if there is no such entry.
+func (down *Downloader) Lookup(ctx context.Context, root blob.Ref, name string) (DirEntry, error) {
+	e, err := down.Stat(ctx, root)
+	if err != nil {
+		return e, err
+	}
+	for _, elt := range strings.Split(strings.Trim(name, "/"), "/") {
+		if elt == "" || elt == "." {
+			continue
+		}
+		if !e.IsDir() {
+			return e, &DownloadError{Ref: root, Kind: ErrNotFound, Err: fmt.Errorf("%q: %s is not a directory", name, e.Name)}
+		}
+		b, err := down.schemaBlob(ctx, e.Ref)
+		if err != nil {
+			return e, err
+		}
+		// stop at the match, instead of listing (and sorting) the whole directory
+		found, err := down.walkDir(ctx, b, func(de DirEntry) bool {
+			if de.Name != elt {
+				return false
+			}
+			e = de
+			return true
+		})
+		if err != nil {
+			return e, err
+		}
+		if !found {
+			return e, &DownloadError{Ref: root, Kind: ErrNotFound, Err: fmt.Errorf("%q: %w", name, os.ErrNotExist)}
+		}
+	}
+	return e, nil
+}
+
+// schemaBlob fetches and parses the schema blob br,
+// with the same strategies as Start.
+func (down *Downloader) schemaBlob(ctx context.Context, br blob.Ref) (*schema.Blob, error) {
+	return withStrategies(ctx, down, br, func(f blob.Fetcher) (*schema.Blob, error) {
+		return fetchSchemaBlob(ctx, f, br)
+	})
+}
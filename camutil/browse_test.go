@@ -0,0 +1,152 @@
+// Copyright 2026 Tamás Gulácsi.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package camutil
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"perkeep.org/pkg/blob"
+	"perkeep.org/pkg/blobserver"
+	"perkeep.org/pkg/blobserver/memory"
+	"perkeep.org/pkg/schema"
+)
+
+func TestLookup(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var sto memory.Storage
+	put := func(b *schema.Blob) blob.Ref {
+		if _, err := blobserver.Receive(ctx, &sto, b.BlobRef(), strings.NewReader(b.JSON())); err != nil {
+			t.Fatal(err)
+		}
+		return b.BlobRef()
+	}
+	mkdir := func(name string, members ...blob.Ref) blob.Ref {
+		ss := schema.NewStaticSet()
+		for _, sub := range ss.SetStaticSetMembers(members) {
+			put(sub)
+		}
+		return put(schema.NewDirMap(name).PopulateDirectoryMap(put(ss.Blob())).Blob())
+	}
+	file, err := schema.WriteFileFromReader(ctx, &sto, "file.txt", strings.NewReader("some text"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := mkdir("root", mkdir("sub", file))
+
+	down := &Downloader{Fetcher: &sto}
+	for _, tC := range []struct {
+		path, name, typ string
+		err             error
+	}{
+		{"", "root", "directory", nil},
+		{"sub/", "sub", "directory", nil},
+		{"sub/file.txt", "file.txt", "file", nil},
+		{"sub/missing.txt", "", "", ErrNotFound},
+		{"sub/file.txt/x", "", "", ErrNotFound},
+	} {
+		e, err := down.Lookup(ctx, root, tC.path)
+		if tC.err != nil {
+			if !errors.Is(err, tC.err) {
+				t.Errorf("%q: got %v, wanted %v", tC.path, err, tC.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%q: %+v", tC.path, err)
+		}
+		if e.Name != tC.name || e.Type != tC.typ {
+			t.Errorf("%q: got %+v", tC.path, e)
+		}
+	}
+
+	list, err := down.ReadDir(ctx, mkdir("sub", file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].Ref != file || list[0].Size != int64(len("some text")) {
+		t.Errorf("ReadDir: got %+v", list)
+	}
+}
+
+// countingFetcher counts the fetches.
+type countingFetcher struct {
+	blob.Fetcher
+	n atomic.Int32
+}
+
+func (f *countingFetcher) Fetch(ctx context.Context, br blob.Ref) (io.ReadCloser, uint32, error) {
+	f.n.Add(1)
+	return f.Fetcher.Fetch(ctx, br)
+}
+
+func TestLookupStopsAtMatch(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var sto memory.Storage
+	var files []blob.Ref
+	for _, nm := range []string{"a", "b", "c", "d", "e"} {
+		br, err := schema.WriteFileFromReader(ctx, &sto, nm+".txt", strings.NewReader(nm))
+		if err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, br)
+	}
+	slices.SortFunc(files, func(a, b blob.Ref) int { return strings.Compare(a.String(), b.String()) })
+	ss := schema.NewStaticSet()
+	ss.SetStaticSetMembers(files)
+	ssb := ss.Blob()
+	dir := schema.NewDirMap("dir").PopulateDirectoryMap(ssb.BlobRef()).Blob()
+	for _, b := range []*schema.Blob{ssb, dir} {
+		if _, err := blobserver.Receive(ctx, &sto, b.BlobRef(), strings.NewReader(b.JSON())); err != nil {
+			t.Fatal(err)
+		}
+	}
+	first, err := (&Downloader{Fetcher: &sto}).Stat(ctx, files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cf := &countingFetcher{Fetcher: &sto}
+	down := &Downloader{Fetcher: cf}
+	if e, err := down.Lookup(ctx, dir.BlobRef(), first.Name); err != nil || e.Ref != files[0] {
+		t.Fatalf("got %+v, %+v", e, err)
+	}
+	// the directory, its static-set and the first member
+	if n := cf.n.Load(); n != 3 {
+		t.Errorf("got %d fetches, wanted 3", n)
+	}
+}
+
+func TestLookupSecondary(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	secondary := "file://" + t.TempDir()
+	u := NewUploader(secondary, WithSkipHaveCache(true))
+	if u == nil {
+		t.Fatal("no uploader")
+	}
+	src := t.TempDir()
+	if err := os.WriteFile(filepath.Join(src, "a.txt"), []byte("aaa"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	root, err := u.UploadPath(ctx, src, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// nothing on the primary
+	down := &Downloader{Fetcher: &memory.Storage{}, server: "file:///nonexistent", secondary: secondary}
+	if e, err := down.Lookup(ctx, root, "a.txt"); err != nil || e.Size != 3 {
+		t.Errorf("got %+v, %+v", e, err)
+	}
+}
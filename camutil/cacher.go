@@ -5,26 +5,68 @@
 package camutil
 
 import (
+	"bytes"
+	"context"
+	"fmt"
 	"log"
+	"math"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/tgulacsi/camproxy/blobserver/badger"
+	"github.com/tgulacsi/camproxy/blobserver/limited"
 	"perkeep.org/pkg/blob"
 	"perkeep.org/pkg/cacher"
 )
 
+// DefaultCacheSize is the default byte budget of the download cache.
+const DefaultCacheSize = 512 << 20
+
+// cacheGCInterval is the interval of the cache's value log garbage collection.
+const cacheGCInterval = 10 * time.Minute
+
+// WithCache sets the dir and the byte budget of the Downloader's disk cache.
+func WithCache(dir string, maxSize int64) Option {
+	return func(o *clientOptions) { o.CacheDir, o.CacheSize = dir, maxSize }
+}
+
+// DefaultCacheDir returns the default dir of the download cache.
+func DefaultCacheDir() string {
+	dn, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dn, "perkeep", "blobs")
+}
+
+// NewBadgerCache returns a caching fetcher in front of fetcher, storing at most
+// maxSize bytes (unlimited if not positive) in DefaultCacheDir.
 func NewBadgerCache(fetcher blob.Fetcher, maxSize int64) (*BadgerCache, error) {
-	var cacheDir string
-	if dn, err := os.UserCacheDir(); err == nil {
-		cacheDir = filepath.Join(dn, "perkeep", "blobs")
-		if fi, err := os.Stat(cacheDir); err != nil || !fi.Mode().IsDir() {
-			// nosemgrep: go.lang.correctness.permissions.file_permission.incorrect-default-permission
-			if err := os.Mkdir(cacheDir, 0700); err != nil {
-				log.Printf("Warning: failed to make %s: %v; using tempdir instead", cacheDir, err)
-				cacheDir = ""
+	return NewBadgerCacheDir(fetcher, "", maxSize)
+}
+
+// NewBadgerCacheDir is like NewBadgerCache, but stores the blobs in dir (if not empty).
+//
+// The least recently used blobs are evicted when the budget is exceeded;
+// the eviction state is rebuilt from the stored blobs.
+func NewBadgerCacheDir(fetcher blob.Fetcher, dir string, maxSize int64) (*BadgerCache, error) {
+	cacheDir := dir
+	if cacheDir == "" {
+		if cacheDir = DefaultCacheDir(); cacheDir != "" {
+			if fi, err := os.Stat(cacheDir); err != nil || !fi.Mode().IsDir() {
+				// nosemgrep: go.lang.correctness.permissions.file_permission.incorrect-default-permission
+				if err := os.Mkdir(cacheDir, 0700); err != nil {
+					log.Printf("Warning: failed to make %s: %v; using tempdir instead", cacheDir, err)
+					cacheDir = ""
+				}
 			}
 		}
+	} else {
+		// nosemgrep: go.lang.correctness.permissions.file_permission.incorrect-default-permission
+		if err := os.MkdirAll(cacheDir, 0700); err != nil {
+			return nil, err
+		}
 	}
 	if cacheDir == "" {
 		var err error
@@ -32,14 +74,31 @@ func NewBadgerCache(fetcher blob.Fetcher, maxSize int64) (*BadgerCache, error) {
 			return nil, err
 		}
 	}
+	if maxSize <= 0 {
+		maxSize = math.MaxInt64
+	}
 
 	diskcache, err := badger.New(cacheDir, "")
 	if err != nil {
 		return nil, err
 	}
+	policy := limited.LRUSizeEvictPolicy(maxSize)
+	sto := limited.NewStorageEvict(diskcache, policy)
+	if err = sto.LoadEvictState(context.Background()); err != nil {
+		_ = diskcache.Close()
+		return nil, fmt.Errorf("load the cache state of %q: %w", cacheDir, err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	go diskcache.RunValueLogGC(ctx, cacheGCInterval)
 	dc := &BadgerCache{
-		CachingFetcher: cacher.NewCachingFetcher(diskcache, fetcher),
+		CachingFetcher: cacher.NewCachingFetcher(sto, fetcher),
 		Root:           cacheDir,
+		MaxSize:        maxSize,
+		origin:         fetcher,
+		sto:            sto,
+		diskcache:      diskcache,
+		policy:         policy,
+		cancel:         cancel,
 	}
 	return dc, nil
 }
@@ -50,4 +109,77 @@ type BadgerCache struct {
 	// Root is the temp directory being used to store files.
 	// It is available mostly for debug printing.
 	Root string
+	// MaxSize is the byte budget of the cache.
+	MaxSize int64
+
+	origin    blob.Fetcher
+	sto       limited.Storage
+	diskcache badger.Storage
+	policy    interface {
+		Stats() (int, int64)
+		Purge()
+	}
+	cancel context.CancelFunc
+}
+
+// CacheStats is the state of the cache.
+type CacheStats struct {
+	Root     string `json:"root"`
+	Blobs    int    `json:"blobs"`
+	Bytes    int64  `json:"bytes"`
+	MaxBytes int64  `json:"maxBytes"`
+	// LSMSize and VLogSize are the sizes of badger's files.
+	LSMSize  int64 `json:"lsmSize"`
+	VLogSize int64 `json:"vlogSize"`
+}
+
+// Stats returns the state of the cache.
+func (dc *BadgerCache) Stats() CacheStats {
+	st := CacheStats{Root: dc.Root, MaxBytes: dc.MaxSize}
+	st.Blobs, st.Bytes = dc.policy.Stats()
+	st.LSMSize, st.VLogSize = dc.diskcache.Size()
+	return st
+}
+
+// Purge deletes all the cached blobs.
+func (dc *BadgerCache) Purge() error {
+	if err := dc.diskcache.DropAll(); err != nil {
+		return err
+	}
+	dc.policy.Purge()
+	return nil
+}
+
+// Warm fetches br, and all the blobs it references, into the cache.
+// Returns the number and the size of the blobs.
+func (dc *BadgerCache) Warm(ctx context.Context, br blob.Ref) (count int, size int64, err error) {
+	err = WalkBlobs(ctx, dc, br, func(sb blob.SizedRef, err error) error {
+		if err != nil {
+			return err
+		}
+		count++
+		size += int64(sb.Size)
+		return nil
+	})
+	return count, size, err
+}
+
+// refetch removes br from the cache, and fetches it from the origin.
+func (dc *BadgerCache) refetch(ctx context.Context, br blob.Ref) ([]byte, error) {
+	if err := dc.sto.RemoveBlobs(ctx, []blob.Ref{br}); err != nil {
+		return nil, fmt.Errorf("evict %s: %w", br, err)
+	}
+	return fetchAll(ctx, dc.origin, br)
+}
+
+// store stores the blob in the cache.
+func (dc *BadgerCache) store(ctx context.Context, br blob.Ref, data []byte) error {
+	_, err := dc.sto.ReceiveBlob(ctx, br, bytes.NewReader(data))
+	return err
+}
+
+// Close stops the garbage collection, and closes the cache DB.
+func (dc *BadgerCache) Close() error {
+	dc.cancel()
+	return dc.diskcache.Close()
 }
@@ -0,0 +1,65 @@
+// Copyright 2026 Tamás Gulácsi.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package camutil
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"testing"
+
+	"perkeep.org/pkg/blobserver/memory"
+	"perkeep.org/pkg/schema"
+)
+
+func TestBadgerCache(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	data := make([]byte, 2<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+	var origin memory.Storage
+	br, err := schema.WriteFileFromReader(ctx, &origin, "data.bin", bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+
+	dc, err := NewBadgerCacheDir(&origin, dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, size, err := dc.Warm(ctx, br)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size < int64(len(data)) {
+		t.Errorf("warmed %d blobs of %d bytes, wanted at least %d", n, size, len(data))
+	}
+	st := dc.Stats()
+	t.Logf("stats: %+v", st)
+	if st.Bytes > st.MaxBytes || st.Blobs == 0 {
+		t.Errorf("got %d blobs of %d bytes, wanted at most %d bytes", st.Blobs, st.Bytes, st.MaxBytes)
+	}
+	if err = dc.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the eviction state is rebuilt from the stored blobs
+	if dc, err = NewBadgerCacheDir(&origin, dir, 1<<20); err != nil {
+		t.Fatal(err)
+	}
+	if got := dc.Stats(); got.Blobs != st.Blobs || got.Bytes != st.Bytes {
+		t.Errorf("reopened: got %+v, wanted %+v", got, st)
+	}
+	if err = dc.Purge(); err != nil {
+		t.Fatal(err)
+	}
+	if got := dc.Stats(); got.Blobs != 0 || got.Bytes != 0 {
+		t.Errorf("purged: got %+v", got)
+	}
+	if err = dc.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
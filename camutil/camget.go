@@ -8,14 +8,13 @@
 package camutil
 
 import (
-	"bytes"
 	"context"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"os"
-	"os/exec"
+	"path"
 	"path/filepath"
 	"sync"
 	"syscall"
@@ -29,7 +28,11 @@ import (
 const sniffSize = 900 * 1024
 
 // smartFetch the things that blobs point to, not just blobs.
-func smartFetch(ctx context.Context, src blob.Fetcher, targ string, br blob.Ref) error {
+// parentRel is the path of the parent directory relative to the root,
+// depth is the number of elements of the path of br (0 for the root).
+func (rs *restorer) smartFetch(ctx context.Context, targ, parentRel string, depth int, br blob.Ref) error {
+	logger := loggerFromContext(ctx)
+	src := rs.src
 	rc, err := fetch(ctx, src, br)
 	if err != nil {
 		return fmt.Errorf("smartFetch: %w", err)
@@ -48,54 +51,74 @@ func smartFetch(ctx context.Context, src blob.Fetcher, targ string, br blob.Ref)
 	b, ok := sniffer.SchemaBlob()
 
 	if !ok {
-		logger.Debug("Fetching opaque data", "blob", br, "destination", targ)
+		name := filepath.Join(targ, br.String())
+		logger.Debug("Fetching opaque data", "blob", br, "destination", name)
 
 		// opaque data - put it in a file
-		f, err := os.Create(targ)
-		if err != nil {
-			return fmt.Errorf("opaque: %w", err)
-		}
-		defer f.Close()
 		body, _ := sniffer.Body()
-		r := io.MultiReader(bytes.NewReader(body), rc)
-		if _, err = io.Copy(f, r); err != nil {
+		rest, err := io.ReadAll(rc)
+		if err != nil {
 			return fmt.Errorf("read: %w", err)
 		}
-		return nil
+		return rs.writeBlob(ctx, name, br, append(body, rest...))
 	}
 	closeRc()
 
+	rel := parentRel
+	if t := b.Type(); depth != 0 && t != "static-set" {
+		rel = path.Join(parentRel, b.FileName())
+		if t != "directory" && !rs.filter.match(rel, depth) {
+			logger.Debug("Skipping (filtered).", "path", rel)
+			return nil
+		}
+	}
+
 	switch b.Type() {
 	case "directory":
-		dir := filepath.Join(targ, b.FileName())
-		logger.Debug("Fetching directory", "blob", br, "destination", dir)
-		if err := os.MkdirAll(dir, b.FileMode()); err != nil {
-			return fmt.Errorf("mkdirall %q: %w", dir, err)
+		descend := depth == 0 || rs.filter.descend(rel, depth)
+		if !descend && !rs.filter.match(rel, depth) {
+			logger.Debug("Skipping (filtered).", "path", rel)
+			return nil
+		}
+		dir, err := rs.mkdir(filepath.Join(targ, b.FileName()), b.FileMode())
+		if err != nil {
+			return err
 		}
+		if descend {
+			logger.Debug("Fetching directory", "blob", br, "destination", dir)
+			entries, ok := b.DirectoryEntries()
+			if !ok {
+				return fmt.Errorf("bad entries blobref in dir %v", b.BlobRef())
+			}
+			if err = rs.smartFetch(ctx, dir, rel, depth, entries); err != nil {
+				return err
+			}
+		}
+		// after the entries, as they change the modification time
 		if err := setFileMeta(dir, b); err != nil {
 			logger.Error("setFileMeta", "error", err)
 		}
-		entries, ok := b.DirectoryEntries()
-		if !ok {
-			return fmt.Errorf("bad entries blobref in dir %v", b.BlobRef())
-		}
-		return smartFetch(ctx, src, dir, entries)
+		return nil
 	case "static-set":
 		logger.Debug("Fetching directory entries", "blob", br, "destination", targ)
 
-		// directory entries
-		const numWorkers = 10
+		// directory entries, and the subsets of a large directory
+		numWorkers := rs.opts.Workers
+		if numWorkers <= 0 {
+			numWorkers = DefaultSaveWorkers
+		}
 		type work struct {
-			br   blob.Ref
-			errc chan<- error
+			br    blob.Ref
+			depth int
+			errc  chan<- error
 		}
-		members := b.StaticSetMembers()
-		workc := make(chan work, len(members))
+		members, mergeSets := b.StaticSetMembers(), b.StaticSetMergeSets()
+		workc := make(chan work, len(members)+len(mergeSets))
 		defer close(workc)
 		for i := 0; i < numWorkers; i++ {
 			go func() {
 				for wi := range workc {
-					wi.errc <- smartFetch(ctx, src, targ, wi.br)
+					wi.errc <- rs.smartFetch(ctx, targ, rel, wi.depth, wi.br)
 				}
 			}()
 		}
@@ -103,7 +126,12 @@ func smartFetch(ctx context.Context, src blob.Fetcher, targ string, br blob.Ref)
 		for _, mref := range members {
 			errc := make(chan error, 1)
 			errcs = append(errcs, errc)
-			workc <- work{mref, errc}
+			workc <- work{mref, depth + 1, errc}
+		}
+		for _, mref := range mergeSets {
+			errc := make(chan error, 1)
+			errcs = append(errcs, errc)
+			workc <- work{mref, depth, errc}
 		}
 		for _, errc := range errcs {
 			if err := <-errc; err != nil {
@@ -112,34 +140,10 @@ func smartFetch(ctx context.Context, src blob.Fetcher, targ string, br blob.Ref)
 		}
 		return nil
 	case "file":
-		fr, err := schema.NewFileReader(ctx, src, br)
-		if err != nil {
-			return fmt.Errorf("NewFileReader: %w", err)
-		}
-		fr.LoadAllChunks()
-		defer fr.Close()
-
-		name := filepath.Join(targ, b.FileName())
-
-		if fi, err := os.Stat(name); err == nil && fi.Size() == fr.Size() {
-			logger.Debug("Skipping (already exists).", "file", name)
-			return nil
+		if err := rs.filter.reserve(b.PartsSize()); err != nil {
+			return fmt.Errorf("%s: %w", rel, err)
 		}
-
-		logger.Debug("Writing", "blob", br, "destination", name)
-
-		f, err := os.Create(name)
-		if err != nil {
-			return fmt.Errorf("file type: %w", err)
-		}
-		defer f.Close()
-		if _, err := io.Copy(f, fr); err != nil {
-			return fmt.Errorf("copy %s to %s: %w", br, name, err)
-		}
-		if err := setFileMeta(name, b); err != nil {
-			logger.Error("setFileMeta", "error", err)
-		}
-		return nil
+		return rs.writeFile(ctx, filepath.Join(targ, b.FileName()), b)
 	case "symlink":
 		if SkipIrregular {
 			return nil
@@ -152,24 +156,28 @@ func smartFetch(ctx context.Context, src blob.Fetcher, targ string, br blob.Ref)
 		if !ok {
 			return errors.New("blob is not a symlink")
 		}
-		name := filepath.Join(targ, sl.FileName())
-		if _, err := os.Lstat(name); err == nil {
-			logger.Debug("Skipping creating symbolic link " + name + ": A file with that name exists")
-			return nil
-		}
 		target := sl.SymlinkTargetString()
 		if target == "" {
 			return errors.New("symlink without target")
 		}
+		name, skip, err := rs.resolve(filepath.Join(targ, sl.FileName()), func(name string, _ os.FileInfo) bool {
+			old, err := os.Readlink(name)
+			return err == nil && old == target
+		})
+		if err != nil || skip {
+			return err
+		}
 
-		// On Windows, os.Symlink isn't yet implemented as of Go 1.3.
-		// See https://code.google.com/p/go/issues/detail?id=5750
-		err := os.Symlink(target, name)
 		// We won't call setFileMeta for a symlink because:
 		// the permissions of a symlink do not matter and Go's
 		// os.Chtimes always dereferences (does not act on the
 		// symlink but its target).
-		return err
+		return replaceWith(name, func(tmp string) error {
+			if err := os.Symlink(target, tmp); err != nil {
+				return err
+			}
+			return lchown(tmp, b)
+		})
 	case "fifo":
 		if SkipIrregular {
 			return nil
@@ -185,12 +193,12 @@ func smartFetch(ctx context.Context, src blob.Fetcher, targ string, br blob.Ref)
 			return errors.New("blob is not a static FIFO")
 		}
 
-		if _, err := os.Lstat(name); err == nil {
-			logger.Info("Skipping FIFO " + name + ": A file with that name already exists")
-			return nil
+		name, skip, err := rs.resolve(name, func(_ string, fi os.FileInfo) bool { return fi.Mode()&os.ModeNamedPipe != 0 })
+		if err != nil || skip {
+			return err
 		}
 
-		err = syscall.Mkfifo(name, 0600)
+		err = replaceWith(name, func(tmp string) error { return syscall.Mkfifo(tmp, 0600) })
 		if err == ErrNotSupported {
 			logger.Info("Skipping FIFO " + name + ": Unsupported filetype")
 			return nil
@@ -220,9 +228,9 @@ func smartFetch(ctx context.Context, src blob.Fetcher, targ string, br blob.Ref)
 			return errors.New("blob is not a static socket")
 		}
 
-		if _, err := os.Lstat(name); err == nil {
-			logger.Info("Skipping socket " + name + ": A file with that name already exists")
-			return nil
+		name, skip, err := rs.resolve(name, func(_ string, fi os.FileInfo) bool { return fi.Mode()&os.ModeSocket != 0 })
+		if err != nil || skip {
+			return err
 		}
 
 		err = mksocket(name)
@@ -246,15 +254,14 @@ func smartFetch(ctx context.Context, src blob.Fetcher, targ string, br blob.Ref)
 }
 
 func setFileMeta(name string, blob *schema.Blob) error {
+	// chown first, as it may clear the setuid bits
+	err0 := lchown(name, blob)
 	err1 := os.Chmod(name, blob.FileMode())
 	var err2 error
 	if mt := blob.ModTime(); !mt.IsZero() {
 		err2 = os.Chtimes(name, mt, mt)
 	}
-	// TODO: we previously did os.Chown here, but it's rarely wanted,
-	// then the schema.Blob refactor broke it, so it's gone.
-	// Add it back later once we care?
-	for _, err := range []error{err1, err2} {
+	for _, err := range []error{err0, err1, err2} {
 		if err != nil {
 			return err
 		}
@@ -262,6 +269,14 @@ func setFileMeta(name string, blob *schema.Blob) error {
 	return nil
 }
 
+// lchown sets the owner of name, if running as root.
+func lchown(name string, blob *schema.Blob) error {
+	if os.Geteuid() != 0 {
+		return nil
+	}
+	return os.Lchown(name, blob.MapUid(), blob.MapGid())
+}
+
 var ErrNotSupported = errors.New("operation not supported")
 
 func mksocket(path string) error {
@@ -285,14 +300,4 @@ func mksocket(path string) error {
 	return nil
 }
 
-var cmdPkGet = "pk-get"
-
-func init() {
-	if _, err := exec.LookPath("pk-get"); err != nil {
-		if _, err = exec.LookPath("camget"); err == nil {
-			cmdPkGet = "camget"
-		}
-	}
-}
-
 // vim: fileencoding=utf-8:
@@ -14,16 +14,14 @@ import (
 	"io"
 	"log/slog"
 	"net/url"
-	"os"
-	"os/exec"
+	"path/filepath"
 	"strings"
 	"sync"
 
+	"github.com/UNO-SOFT/zlog/v2"
 	"perkeep.org/pkg/auth"
 	"perkeep.org/pkg/blob"
-	"perkeep.org/pkg/blobserver/localdisk"
 	"perkeep.org/pkg/client"
-	"perkeep.org/pkg/schema"
 )
 
 var logger *slog.Logger
@@ -31,11 +29,27 @@ var logger *slog.Logger
 // SetLogger sets the package-level *slog.Logger
 func SetLogger(lgr *slog.Logger) { logger = lgr }
 
+// loggerFromContext returns the logger embedded into ctx by zlog.NewSContext
+// (carrying the request ID, for example), or the package-level logger.
+func loggerFromContext(ctx context.Context) *slog.Logger {
+	if lgr := zlog.SFromContext(ctx); lgr != slog.Default() || logger == nil {
+		return lgr
+	}
+	return logger
+}
+
 // Downloader is the struct for downloading file/dir blobs
 type Downloader struct {
 	cl *client.Client
 	blob.Fetcher
-	args []string
+	server    string
+	secondary string
+	options   []Option
+	prefetch  prefetch
+	verify    bool
+
+	freshMu sync.Mutex
+	fresh   *client.Client // built on the first failure of the cached client
 }
 
 var (
@@ -49,6 +63,14 @@ type clientOptions struct {
 	UseRetryTransport      bool
 	CapCtime               bool
 	NoCache, SkipHaveCache bool
+	SecondaryServer        string
+	Progress               ProgressFunc
+	Identity               string
+	PrefetchDepth          int
+	PrefetchParallel       int
+	CacheDir               string
+	CacheSize              int64
+	Verify                 bool
 }
 
 func (c *clientOptions) apply(opts ...Option) {
@@ -61,6 +83,15 @@ func WithCapCtime(b bool) Option       { return func(o *clientOptions) { o.CapCt
 func WithSkipHaveCache(b bool) Option  { return func(o *clientOptions) { o.SkipHaveCache = b } }
 func WithNoCache(b bool) Option        { return func(o *clientOptions) { o.NoCache = b } }
 
+// WithIdentity sets the keyring (or secret key file) to sign the claims with.
+// If it cannot be loaded, NewUploader fails.
+func WithIdentity(path string) Option { return func(o *clientOptions) { o.Identity = path } }
+
+// WithSecondaryServer sets the server the Downloader tries when the primary fails.
+func WithSecondaryServer(server string) Option {
+	return func(o *clientOptions) { o.SecondaryServer = server }
+}
+
 // NewClient returns a new client for the given server. Auth is set up according
 // to the client config (~/.config/camlistore/client-config.json)
 // and the environment variables.
@@ -74,12 +105,22 @@ func NewClient(server string, clientOpts ...Option) (*client.Client, error) {
 	if ok {
 		return c, nil
 	}
+	c, err := newClient(server, clientOpts...)
+	if err != nil {
+		return nil, err
+	}
+	cachedClient[server] = c
+	return c, nil
+}
+
+// newClient returns a new, not cached client for the server.
+func newClient(server string, clientOpts ...Option) (*client.Client, error) {
 	var authIncluded bool
 	opts := make([]client.ClientOption, 0, 4)
 	if !strings.Contains(server, "://") {
 		opts = append(opts, client.OptionServer(server), client.OptionInsecure(true))
-	} else if strings.HasPrefix(server, "file://") {
-		bs, err := localdisk.New(server[7:])
+	} else if IsLocalServer(server) {
+		bs, err := openLocalStorage(server)
 		if err != nil {
 			return nil, err
 		}
@@ -90,7 +131,7 @@ func NewClient(server string, clientOpts ...Option) (*client.Client, error) {
 			return nil, err
 		}
 		opts = append(opts, client.OptionServer(server))
-		if URL.Scheme == "http" {
+		if URL.Scheme == "http" || InsecureTLS {
 			opts = append(opts, client.OptionInsecure(true))
 		}
 		if u := URL.User; u != nil && u.Username() != "" {
@@ -99,8 +140,8 @@ func NewClient(server string, clientOpts ...Option) (*client.Client, error) {
 			authIncluded = true
 		}
 	}
-	var err error
-	if c, err = client.New(opts...); err != nil {
+	c, err := client.New(opts...)
+	if err != nil {
 		return nil, err
 	}
 	var options clientOptions
@@ -116,7 +157,6 @@ func NewClient(server string, clientOpts ...Option) (*client.Client, error) {
 			return nil, err
 		}
 	}
-	cachedClient[server] = c
 	return c, nil
 }
 
@@ -142,42 +182,54 @@ func NewDownloader(server string, options ...Option) (*Downloader, error) {
 	if err != nil {
 		return nil, err
 	}
-	down = &Downloader{cl: cl}
+	var opts clientOptions
+	opts.apply(options...)
+	down = &Downloader{cl: cl, server: server, secondary: opts.SecondaryServer, options: options, prefetch: opts.prefetch(), verify: opts.Verify}
 
-	if strings.HasPrefix(server, "file://") {
+	if IsLocalServer(server) {
 		down.Fetcher = down.cl
 		cachedDownloader[server] = down
 		return down, nil
 	}
 
-	var opts clientOptions
-	opts.apply(options...)
 	if opts.NoCache {
 		down.Fetcher = down.cl
 	} else {
-		bc, err := NewBadgerCache(down.cl, 512<<20)
+		if opts.CacheSize == 0 {
+			opts.CacheSize = DefaultCacheSize
+		}
+		bc, err := NewBadgerCacheDir(down.cl, opts.CacheDir, opts.CacheSize)
 		if err != nil {
 			return nil, fmt.Errorf("setup local disk cache: %w", err)
 		}
 		logger.Debug("Using temp blob cache directory " + bc.Root)
 		down.Fetcher = bc
 	}
-	if server != "" {
-		down.args = []string{"-server=" + server}
-	} else {
-		down.args = []string{}
-	}
 
 	cachedDownloader[server] = down
 	return down, nil
 }
 
-// Close closes the downloader (the underlying client)
+// Close closes the downloader (the underlying client and cache)
 func (down *Downloader) Close() {
-	if down != nil && down.Fetcher != nil {
+	if down == nil {
+		return
+	}
+	down.freshMu.Lock()
+	if down.fresh != nil {
+		_ = down.fresh.Close()
+		down.fresh = nil
+	}
+	down.freshMu.Unlock()
+	if down.Fetcher != nil {
 		if dc, ok := down.Fetcher.(interface{ Clean() }); ok {
 			dc.Clean()
 		}
+		if dc, ok := down.Fetcher.(*BadgerCache); ok {
+			if err := dc.Close(); err != nil {
+				loggerFromContext(context.Background()).Warn("close cache", "root", dc.Root, "error", err)
+			}
+		}
 	}
 }
 
@@ -236,60 +288,23 @@ func Base64ToRef(arg string) (br blob.Ref, err error) {
 }
 
 // Start starts the downloads of the blobrefs.
-// Just the JSON schema if contents is false, else the content of the blob.
+// Just the JSON schema if contents is false, else the content of the blob,
+// read through a StreamReader.
+//
+// Each blob is tried through the (caching) fetcher, then bypassing the cache,
+// then through a fresh client, and at last on the secondary server.
+// The returned error is a *DownloadError, matching ErrNotFound, ErrCorrupt,
+// ErrTransport or ErrNotFile.
 func (down *Downloader) Start(ctx context.Context, contents bool, items ...blob.Ref) (io.ReadCloser, error) {
 	readers := make([]io.Reader, 0, len(items))
 	closers := make([]io.Closer, 0, len(items))
-	var (
-		rc  io.ReadCloser
-		err error
-	)
 	for _, br := range items {
-		if contents {
-			rc, err = schema.NewFileReader(ctx, down.Fetcher, br)
-			if err == nil {
-				rc.(*schema.FileReader).LoadAllChunks()
-			}
-		} else {
-			var b *blob.Blob
-			b, err = blob.FromFetcher(ctx, down.Fetcher, br)
-			if err == nil {
-				var r io.Reader
-				r, err = b.ReadAll(ctx)
-				rc = struct {
-					io.Reader
-					io.Closer
-				}{r, io.NopCloser(nil)}
-			} else if errors.Is(err, os.ErrNotExist) {
-				return nil, fmt.Errorf("%v: %w", br, err)
-			} else {
-				logger.Error("blob.FromFetcher", "br", br, "error", err)
-			}
-		}
-		if err == nil && rc != nil {
-			readers = append(readers, rc)
-			closers = append(closers, rc)
-			continue
-		}
-		logger.Info("downloading", "blob", br, "error", err)
-		args := append(make([]string, 0, len(down.args)+3), down.args...)
-		if contents {
-			args = append(args, "-contents=true")
-		}
-		if InsecureTLS {
-			args = append(args, "-insecure=true")
-		}
-		args = append(args, br.String())
-		// nosemgrep: go.lang.security.audit.dangerous-exec-command.dangerous-exec-command
-		c := exec.CommandContext(ctx, cmdPkGet, args...)
-		var errBuf bytes.Buffer
-		c.Stderr = &errBuf
-		if rc, err = c.StdoutPipe(); err != nil {
-			return nil, fmt.Errorf("create stdout pipe for %s %q: %s: %w", cmdPkGet, args, errBuf.String(), err)
-		}
-		logger.Info("calling "+cmdPkGet, "args", args)
-		if err = c.Run(); err != nil {
-			return nil, fmt.Errorf("call %s %q: %s: %w", cmdPkGet, args, errBuf.String(), err)
+		rc, err := down.open(ctx, br, func(f blob.Fetcher) (io.ReadCloser, error) {
+			return openBlob(ctx, f, contents, br, down.prefetch)
+		})
+		if err != nil {
+			_ = multiCloser{closers}.Close()
+			return nil, err
 		}
 		readers = append(readers, rc)
 		closers = append(closers, rc)
@@ -306,10 +321,150 @@ func (down *Downloader) Start(ctx context.Context, contents bool, items ...blob.
 	}, nil
 }
 
-// Save saves contents of the blobs into destDir as files
+// Stream returns a StreamReader for the contents of the file br,
+// found by the same strategies as Start.
+func (down *Downloader) Stream(ctx context.Context, br blob.Ref) (*StreamReader, error) {
+	rc, err := down.open(ctx, br, func(f blob.Fetcher) (io.ReadCloser, error) {
+		return openBlob(ctx, f, true, br, down.prefetch)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rc.(*StreamReader), nil
+}
+
+// fetchStrategy is a named way to get a fetcher for a retry.
+type fetchStrategy struct {
+	name    string
+	fetcher func() (blob.Fetcher, error)
+}
+
+func (down *Downloader) strategies() []fetchStrategy {
+	strategies := append(make([]fetchStrategy, 0, 4),
+		fetchStrategy{"fetcher", func() (blob.Fetcher, error) { return down.Fetcher, nil }})
+	if down.cl != nil && down.Fetcher != blob.Fetcher(down.cl) {
+		strategies = append(strategies,
+			fetchStrategy{"nocache", func() (blob.Fetcher, error) { return down.cl, nil }})
+	}
+	if !IsLocalServer(down.server) {
+		strategies = append(strategies,
+			fetchStrategy{"fresh", down.freshClient})
+	}
+	if down.secondary != "" {
+		strategies = append(strategies,
+			fetchStrategy{"secondary", func() (blob.Fetcher, error) { return NewClient(down.secondary, down.options...) }})
+	}
+	return strategies
+}
+
+// freshClient returns the not cached client of the server, with its own
+// transport. It is built once (on the first need), and kept till Close.
+func (down *Downloader) freshClient() (blob.Fetcher, error) {
+	down.freshMu.Lock()
+	defer down.freshMu.Unlock()
+	if down.fresh == nil {
+		cl, err := newClient(down.server, down.options...)
+		if err != nil {
+			return nil, err
+		}
+		down.fresh = cl
+	}
+	return down.fresh, nil
+}
+
+// open opens the blob br with the fetchers of the strategies, in order.
+func (down *Downloader) open(ctx context.Context, br blob.Ref, open func(blob.Fetcher) (io.ReadCloser, error)) (io.ReadCloser, error) {
+	return withStrategies(ctx, down, br, open)
+}
+
+// withStrategies calls get with the fetchers of the strategies of down, in
+// order, till it succeeds.
+func withStrategies[T any](ctx context.Context, down *Downloader, br blob.Ref, get func(blob.Fetcher) (T, error)) (T, error) {
+	logger := loggerFromContext(ctx)
+	var zero T
+	var errs []error
+	for _, s := range down.strategies() {
+		if s.name == "fresh" && len(errs) != 0 && errors.Is(classifyError(errs[len(errs)-1]), ErrNotFound) {
+			continue // the server said it does not have it
+		}
+		f, err := s.fetcher()
+		if err == nil {
+			f = down.verified(f)
+			var v T
+			if v, err = get(f); err == nil {
+				if len(errs) != 0 {
+					logger.Info("downloaded", "blob", br, "strategy", s.name)
+				}
+				return v, nil
+			}
+		}
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return zero, ctxErr
+		}
+		logger.Info("downloading", "blob", br, "strategy", s.name, "error", err)
+		if errs = append(errs, err); errors.Is(classifyError(err), ErrNotFile) {
+			break // it is there, just not a file
+		}
+	}
+	return zero, newDownloadError(br, errs)
+}
+
+// verified returns f, wrapped by a verifying fetcher if the Downloader verifies.
+func (down *Downloader) verified(f blob.Fetcher) blob.Fetcher {
+	if down.verify {
+		return NewVerifyingFetcher(f)
+	}
+	return f
+}
+
+func openBlob(ctx context.Context, f blob.Fetcher, contents bool, br blob.Ref, pf prefetch) (io.ReadCloser, error) {
+	if contents {
+		b, err := fetchSchemaBlob(ctx, f, br)
+		if err != nil {
+			return nil, err
+		}
+		return newStreamReader(ctx, f, b, pf)
+	}
+	b, err := blob.FromFetcher(ctx, f, br)
+	if err != nil {
+		return nil, err
+	}
+	r, err := b.ReadAll(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{r, io.NopCloser(nil)}, nil
+}
+
+// Save saves contents of the blobs into destDir as files,
+// skipping the identical existing files.
+// If contents is false, the blobs are saved as is, named by their refs.
 func (down *Downloader) Save(ctx context.Context, destDir string, contents bool, items ...blob.Ref) error {
+	return down.SaveWith(ctx, destDir, contents, SaveOptions{}, items...)
+}
+
+// SaveWith is Save with options.
+//
+// The files are written through temp files, renamed when complete;
+// a rerun of an interrupted restore reuses the partially written files.
+// Running as root, the ownership is restored, too.
+func (down *Downloader) SaveWith(ctx context.Context, destDir string, contents bool, opts SaveOptions, items ...blob.Ref) error {
+	logger := loggerFromContext(ctx)
+	rs := restorer{src: down.verified(down.Fetcher), opts: opts, pf: down.prefetch, filter: newTreeFilter(opts)}
 	for _, br := range items {
-		if err := smartFetch(ctx, down.Fetcher, destDir, br); err != nil {
+		var err error
+		if contents {
+			err = rs.smartFetch(ctx, destDir, "", 0, br)
+		} else {
+			var data []byte
+			if data, err = fetchAll(ctx, rs.src, br); err == nil {
+				err = rs.writeBlob(ctx, filepath.Join(destDir, br.String()), br, data)
+			}
+		}
+		if err != nil {
 			logger.Error("Save", "error", err)
 			return err
 		}
@@ -0,0 +1,78 @@
+// Copyright 2026 Tamás Gulácsi.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package camutil
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"perkeep.org/pkg/blob"
+	"perkeep.org/pkg/blobserver"
+)
+
+var (
+	// ErrNotFound is returned when the blob is not found on any server.
+	ErrNotFound = errors.New("blob not found")
+	// ErrCorrupt is returned when the blob's contents don't match its ref,
+	// or it cannot be parsed.
+	ErrCorrupt = errors.New("blob is corrupt")
+	// ErrTransport is returned when the servers cannot be reached.
+	ErrTransport = errors.New("transport error")
+	// ErrNotFile is returned when the contents of a blob is asked for, but it
+	// is not a file schema blob - retrying won't help.
+	ErrNotFile = errors.New("not a file")
+)
+
+// DownloadError is the error of downloading a blob.
+// It matches its Kind (ErrNotFound, ErrCorrupt, ErrTransport or ErrNotFile) with errors.Is.
+type DownloadError struct {
+	Ref  blob.Ref
+	Kind error
+	Err  error
+}
+
+func (e *DownloadError) Error() string {
+	return fmt.Sprintf("download %v: %v: %v", e.Ref, e.Kind, e.Err)
+}
+func (e *DownloadError) Unwrap() []error { return []error{e.Kind, e.Err} }
+
+// newDownloadError returns the DownloadError of the failed attempts:
+// ErrNotFile if any found the blob not to be a file,
+// ErrNotFound if all of them said so, ErrCorrupt if any found a corrupt blob,
+// ErrTransport otherwise.
+func newDownloadError(br blob.Ref, errs []error) *DownloadError {
+	kind := ErrNotFound
+	for _, err := range errs {
+		switch k := classifyError(err); k {
+		case ErrNotFile:
+			return &DownloadError{Ref: br, Kind: k, Err: errors.Join(errs...)}
+		case ErrCorrupt:
+			kind = k
+		case ErrTransport:
+			if kind != ErrCorrupt {
+				kind = k
+			}
+		}
+	}
+	return &DownloadError{Ref: br, Kind: kind, Err: errors.Join(errs...)}
+}
+
+// classifyError returns the kind of the error.
+func classifyError(err error) error {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.Is(err, ErrNotFile):
+		return ErrNotFile
+	case errors.Is(err, ErrNotFound), errors.Is(err, os.ErrNotExist):
+		return ErrNotFound
+	case errors.Is(err, ErrCorrupt), errors.Is(err, blobserver.ErrCorruptBlob),
+		errors.As(err, &syntaxErr), errors.As(err, &typeErr):
+		return ErrCorrupt
+	}
+	return ErrTransport
+}
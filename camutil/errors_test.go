@@ -0,0 +1,46 @@
+// Copyright 2026 Tamás Gulácsi.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package camutil
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+
+	"perkeep.org/pkg/blob"
+	"perkeep.org/pkg/blobserver"
+)
+
+func TestNewDownloadError(t *testing.T) {
+	t.Parallel()
+	notFound := fmt.Errorf("fetch: %w", os.ErrNotExist)
+	corrupt := fmt.Errorf("fetch: %w", blobserver.ErrCorruptBlob)
+	transport := errors.New("connection refused")
+	var syntaxErr error = &json.SyntaxError{Offset: 1}
+	notFile := fmt.Errorf("parse: %w: %w", ErrNotFile, syntaxErr)
+	for i, tc := range []struct {
+		errs []error
+		want error
+	}{
+		{[]error{notFound, notFound}, ErrNotFound},
+		{[]error{transport, notFound}, ErrTransport},
+		{[]error{notFound, corrupt, transport}, ErrCorrupt},
+		{[]error{syntaxErr}, ErrCorrupt},
+		{[]error{transport}, ErrTransport},
+		{[]error{transport, notFile}, ErrNotFile},
+	} {
+		err := newDownloadError(blob.Ref{}, tc.errs)
+		if !errors.Is(err, tc.want) {
+			t.Errorf("%d. got %v, wanted %v", i, err.Kind, tc.want)
+		}
+		for _, e := range tc.errs {
+			if !errors.Is(err, e) {
+				t.Errorf("%d. %v does not wrap %v", i, err, e)
+			}
+		}
+	}
+}
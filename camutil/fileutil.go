@@ -7,8 +7,11 @@ package camutil
 // copied from camlistore.org/pkg/blobserver/localdisk/receive.go
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"io"
 	"os"
+	"path/filepath"
 )
 
 // CopyFile is used by Windows (receive_windows.go) and when a posix filesystem doesn't
@@ -26,6 +29,78 @@ func CopyFile(src, dst string) error {
 	}
 	defer dstFile.Close()
 
-	_, err = io.Copy(dstFile, srcFile)
-	return err
+	if _, err = io.Copy(dstFile, srcFile); err != nil {
+		return err
+	}
+	if err = dstFile.Sync(); err != nil {
+		return err
+	}
+	return dstFile.Close()
+}
+
+// DurableCopy copies src to dst durably: it tries a reflink clone, then a hard
+// link, then a streaming copy, through a temp file renamed to dst.
+// The file and its directory are fsynced, and the mtime and mode are preserved.
+// Returns the method used ("clone", "link" or "copy").
+func DurableCopy(src, dst string) (string, error) {
+	srcFile, err := os.Open(src)
+	if err != nil {
+		return "", err
+	}
+	defer srcFile.Close()
+	fi, err := srcFile.Stat()
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Dir(dst)
+	var b [6]byte
+	_, _ = rand.Read(b[:])
+	tmp := filepath.Join(dir, ".tmp-"+filepath.Base(dst)+"-"+hex.EncodeToString(b[:]))
+	defer os.Remove(tmp)
+
+	method := "clone"
+	dstFile, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", err
+	}
+	if err = cloneFile(dstFile, srcFile); err != nil {
+		dstFile.Close()
+		os.Remove(tmp)
+		method = "link"
+		if err = os.Link(src, tmp); err == nil {
+			dstFile, err = os.Open(tmp)
+		} else {
+			method = "copy"
+			if dstFile, err = os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600); err == nil {
+				if _, err = io.Copy(dstFile, srcFile); err != nil {
+					dstFile.Close()
+				}
+			}
+		}
+		if err != nil {
+			return method, err
+		}
+	}
+	if method != "link" { // a link shares the inode with its mode and mtime
+		if err = dstFile.Chmod(fi.Mode().Perm()); err != nil {
+			dstFile.Close()
+			return method, err
+		}
+	}
+	err = dstFile.Sync()
+	if closeErr := dstFile.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return method, err
+	}
+	if method != "link" {
+		if err = os.Chtimes(tmp, fi.ModTime(), fi.ModTime()); err != nil {
+			return method, err
+		}
+	}
+	if err = os.Rename(tmp, dst); err != nil {
+		return method, err
+	}
+	return method, syncDir(dir)
 }
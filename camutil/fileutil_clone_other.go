@@ -0,0 +1,18 @@
+//go:build !linux
+// +build !linux
+
+// Copyright 2026 Tamás Gulácsi.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package camutil
+
+import (
+	"errors"
+	"os"
+)
+
+// cloneFile is not supported on this platform.
+func cloneFile(dst, src *os.File) error {
+	return errors.ErrUnsupported
+}
@@ -25,3 +25,13 @@ func LinkOrCopy(src, dst string) error {
 	}
 	return err
 }
+
+// syncDir fsyncs the directory, to make the renames in it durable.
+func syncDir(dir string) error {
+	dh, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer dh.Close()
+	return dh.Sync()
+}
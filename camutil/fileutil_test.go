@@ -0,0 +1,59 @@
+// Copyright 2026 Tamás Gulácsi.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package camutil
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDurableCopy(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	data := []byte("paranoid copy")
+	if err := os.WriteFile(src, data, 0640); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := os.Chtimes(src, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	for i, dst := range []string{
+		filepath.Join(dir, "dst"),
+		filepath.Join(dir, "dst"), // overwrite
+	} {
+		method, err := DurableCopy(src, dst)
+		if err != nil {
+			t.Fatalf("%d. %s: %+v", i, method, err)
+		}
+		got, err := os.ReadFile(dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("%d. %s: got %q, wanted %q", i, method, got, data)
+		}
+		fi, err := os.Stat(dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !fi.ModTime().Equal(mtime) {
+			t.Errorf("%d. %s: got mtime %v, wanted %v", i, method, fi.ModTime(), mtime)
+		}
+		if fi.Mode().Perm() != 0640 {
+			t.Errorf("%d. %s: got mode %v, wanted %v", i, method, fi.Mode().Perm(), os.FileMode(0640))
+		}
+	}
+	des, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(des) != 2 {
+		t.Errorf("temp files left: %v", des)
+	}
+}
@@ -10,3 +10,6 @@ package camutil
 func LinkOrCopy(src, dst string) error {
 	return CopyFile(src, dst)
 }
+
+// syncDir is a no-op, as directories cannot be fsynced on Windows.
+func syncDir(dir string) error { return nil }
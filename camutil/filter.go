@@ -0,0 +1,115 @@
+// Copyright 2026 Tamás Gulácsi.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package camutil
+
+import (
+	"errors"
+	"path"
+	"strings"
+	"sync/atomic"
+)
+
+// ErrTooLarge is returned when the files of a tree exceed the size limit.
+var ErrTooLarge = errors.New("size limit exceeded")
+
+// treeFilter selects the entries of a tree by their paths relative to the root.
+//
+// A pattern (see path.Match) without a slash matches any path element
+// (so "*.jpg" matches "a/b.jpg" and "docs" matches "docs/x/y"),
+// a pattern with slashes matches the path or one of its parent dirs
+// (so "docs/2020" matches "docs/2020/x").
+type treeFilter struct {
+	include, exclude []string
+	maxDepth         int
+	maxSize          int64
+	size             *atomic.Int64
+}
+
+func newTreeFilter(opts SaveOptions) treeFilter {
+	return treeFilter{
+		include: opts.Include, exclude: opts.Exclude,
+		maxDepth: opts.MaxDepth, maxSize: opts.MaxSize,
+		size: new(atomic.Int64),
+	}
+}
+
+// match reports whether the entry rel at depth (1 for the root's entries) is selected.
+func (tf treeFilter) match(rel string, depth int) bool {
+	if tf.maxDepth > 0 && depth > tf.maxDepth {
+		return false
+	}
+	if matchAny(tf.exclude, rel) {
+		return false
+	}
+	return len(tf.include) == 0 || matchAny(tf.include, rel)
+}
+
+// descend reports whether the directory rel at depth may contain selected entries.
+func (tf treeFilter) descend(rel string, depth int) bool {
+	if tf.maxDepth > 0 && depth >= tf.maxDepth {
+		return false
+	}
+	if matchAny(tf.exclude, rel) {
+		return false
+	}
+	if len(tf.include) == 0 || matchAny(tf.include, rel) {
+		return true
+	}
+	elts := strings.Split(rel, "/")
+	for _, pattern := range tf.include {
+		if !strings.Contains(pattern, "/") {
+			return true // may match deeper
+		}
+		pelts := strings.Split(pattern, "/")
+		if len(pelts) <= len(elts) {
+			continue
+		}
+		ok := true
+		for i, elt := range elts {
+			if m, _ := path.Match(pelts[i], elt); !m {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+// reserve adds size to the total, and returns ErrTooLarge if it exceeds the limit.
+func (tf treeFilter) reserve(size int64) error {
+	if tf.maxSize <= 0 {
+		return nil
+	}
+	if tf.size.Add(size) > tf.maxSize {
+		return ErrTooLarge
+	}
+	return nil
+}
+
+// matchAny reports whether any of the patterns matches rel.
+func matchAny(patterns []string, rel string) bool {
+	if rel == "" {
+		return false
+	}
+	for _, pattern := range patterns {
+		if !strings.Contains(pattern, "/") {
+			for _, elt := range strings.Split(rel, "/") {
+				if m, _ := path.Match(pattern, elt); m {
+					return true
+				}
+			}
+			continue
+		}
+		for p := rel; p != "." && p != "/"; p = path.Dir(p) {
+			if m, _ := path.Match(pattern, p); m {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,51 @@
+// Copyright 2026 Tamás Gulácsi.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package camutil
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestTreeFilter(t *testing.T) {
+	t.Parallel()
+	for _, tC := range []struct {
+		name    string
+		opts    SaveOptions
+		rel     string
+		depth   int
+		match   bool
+		descend bool
+	}{
+		{"all", SaveOptions{}, "a/b/c.txt", 3, true, true},
+		{"depth", SaveOptions{MaxDepth: 2}, "a/b", 2, true, false},
+		{"too deep", SaveOptions{MaxDepth: 2}, "a/b/c.txt", 3, false, false},
+		{"ext", SaveOptions{Include: []string{"*.jpg"}}, "a/b.jpg", 2, true, true},
+		{"ext dir", SaveOptions{Include: []string{"*.jpg"}}, "a", 1, false, true},
+		{"ext miss", SaveOptions{Include: []string{"*.jpg"}}, "a/b.png", 2, false, true},
+		{"path", SaveOptions{Include: []string{"docs/2020"}}, "docs/2020/x.txt", 3, true, true},
+		{"path parent", SaveOptions{Include: []string{"docs/2020"}}, "docs", 1, false, true},
+		{"path other", SaveOptions{Include: []string{"docs/2020"}}, "photos", 1, false, false},
+		{"exclude", SaveOptions{Exclude: []string{".git"}}, "src/.git/HEAD", 3, false, false},
+		{"exclude dir", SaveOptions{Exclude: []string{".git"}}, "src/.git", 2, false, false},
+		{"exclude wins", SaveOptions{Include: []string{"*.go"}, Exclude: []string{"vendor"}}, "vendor/x.go", 2, false, false},
+	} {
+		tf := newTreeFilter(tC.opts)
+		if got := tf.match(tC.rel, tC.depth); got != tC.match {
+			t.Errorf("%s: match(%q)=%t, wanted %t", tC.name, tC.rel, got, tC.match)
+		}
+		if got := tf.descend(tC.rel, tC.depth); got != tC.descend {
+			t.Errorf("%s: descend(%q)=%t, wanted %t", tC.name, tC.rel, got, tC.descend)
+		}
+	}
+
+	tf := newTreeFilter(SaveOptions{MaxSize: 10})
+	if err := tf.reserve(6); err != nil {
+		t.Fatal(err)
+	}
+	if err := tf.reserve(6); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("got %v, wanted ErrTooLarge", err)
+	}
+}
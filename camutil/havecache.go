@@ -0,0 +1,168 @@
+// Copyright 2026 Tamás Gulácsi.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package camutil
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/tgulacsi/camproxy/blobserver/badger"
+	"perkeep.org/pkg/blob"
+	"perkeep.org/pkg/blobserver"
+	"perkeep.org/pkg/client"
+
+	badgerdb "github.com/dgraph-io/badger/v4"
+)
+
+var (
+	haveCacheMu  sync.Mutex
+	haveCacheSto *badger.Storage
+)
+
+// openHaveCache returns the persistent have-cache of the server, stored
+// under the user's cache dir, keyed by the server and its storage generation.
+//
+// The badger DB is locked by the first process opening it: the others run
+// without a have-cache (they get the error of the lock).
+func openHaveCache(ctx context.Context, server string, generation func(context.Context) (string, error)) (badger.HaveCache, error) {
+	gen, err := generation(ctx)
+	if err != nil {
+		return badger.HaveCache{}, err
+	}
+	haveCacheMu.Lock()
+	defer haveCacheMu.Unlock()
+	if haveCacheSto == nil {
+		dn, err := os.UserCacheDir()
+		if err != nil {
+			return badger.HaveCache{}, err
+		}
+		dn = filepath.Join(dn, "perkeep", "havecache")
+		// nosemgrep: go.lang.correctness.permissions.file_permission.incorrect-default-permission
+		if err = os.MkdirAll(dn, 0700); err != nil {
+			return badger.HaveCache{}, err
+		}
+		db, err := badgerdb.Open(badgerdb.DefaultOptions(dn).WithLogger(nil))
+		if err != nil {
+			return badger.HaveCache{}, fmt.Errorf("open %q (is it used by another process?): %w", dn, err)
+		}
+		sto := badger.NewManaged(db, "")
+		haveCacheSto = &sto
+	}
+	return haveCacheSto.HaveCache(server, gen)
+}
+
+// closeHaveCache closes the have-cache DB.
+func closeHaveCache() error {
+	haveCacheMu.Lock()
+	defer haveCacheMu.Unlock()
+	if haveCacheSto == nil {
+		return nil
+	}
+	err := haveCacheSto.Close()
+	haveCacheSto = nil
+	return err
+}
+
+// haveCacheRecheck is the interval of re-checking the server's storage generation.
+var haveCacheRecheck = time.Minute
+
+// haveCacheReceiver answers StatBlobs from the have-cache, and asks the
+// server only for the unknown blobs. The blobs found or received are noted.
+//
+// The server's storage generation is re-checked every haveCacheRecheck, as
+// the server may be wiped or restored while we run: the remembered blobs are
+// dropped when it changes. If it cannot be checked, the cache is not trusted.
+type haveCacheReceiver struct {
+	blobserver.StatReceiver
+	server     string
+	generation func(context.Context) (string, error)
+
+	mu      sync.Mutex
+	hc      badger.HaveCache
+	checked time.Time
+	ok      bool
+}
+
+func newHaveCacheReceiver(ctx context.Context, server string, c *client.Client, options ...Option) (*haveCacheReceiver, error) {
+	return newHaveCacheReceiverGen(ctx, server, c, freshGeneration(server, options...))
+}
+
+// freshGeneration returns the func asking the server for its storage
+// generation - through a new client each time, as a client discovers the
+// server only once, and would return the same generation forever.
+func freshGeneration(server string, options ...Option) func(context.Context) (string, error) {
+	return func(ctx context.Context) (string, error) {
+		c, err := newClient(server, options...)
+		if err != nil {
+			return "", err
+		}
+		return c.StorageGeneration(ctx)
+	}
+}
+
+func newHaveCacheReceiverGen(ctx context.Context, server string, sr blobserver.StatReceiver, generation func(context.Context) (string, error)) (*haveCacheReceiver, error) {
+	hc, err := openHaveCache(ctx, server, generation)
+	if err != nil {
+		return nil, err
+	}
+	return &haveCacheReceiver{StatReceiver: sr, server: server, generation: generation,
+		hc: hc, checked: time.Now(), ok: true}, nil
+}
+
+// cache returns the have-cache, after re-checking the generation if it is due.
+// Returns false if the cache must not be used.
+func (sr *haveCacheReceiver) cache(ctx context.Context) (badger.HaveCache, bool) {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	if time.Since(sr.checked) >= haveCacheRecheck {
+		hc, err := openHaveCache(ctx, sr.server, sr.generation)
+		if sr.ok = err == nil; sr.ok {
+			sr.hc, sr.checked = hc, time.Now()
+		} else {
+			loggerFromContext(ctx).Warn("check storage generation", "server", sr.server, "error", err)
+		}
+	}
+	return sr.hc, sr.ok
+}
+
+func (sr *haveCacheReceiver) ReceiveBlob(ctx context.Context, br blob.Ref, source io.Reader) (blob.SizedRef, error) {
+	sb, err := sr.StatReceiver.ReceiveBlob(ctx, br, source)
+	if err == nil {
+		if hc, ok := sr.cache(ctx); ok {
+			hc.NoteBlobExists(sb.Ref, sb.Size)
+		}
+	}
+	return sb, err
+}
+
+func (sr *haveCacheReceiver) StatBlobs(ctx context.Context, blobs []blob.Ref, fn func(blob.SizedRef) error) error {
+	hc, ok := sr.cache(ctx)
+	if !ok {
+		return sr.StatReceiver.StatBlobs(ctx, blobs, fn)
+	}
+	missing := make([]blob.Ref, 0, len(blobs))
+	for _, br := range blobs {
+		size, ok := hc.StatBlobCache(br)
+		if !ok {
+			missing = append(missing, br)
+			continue
+		}
+		if err := fn(blob.SizedRef{Ref: br, Size: size}); err != nil {
+			return err
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	return sr.StatReceiver.StatBlobs(ctx, missing, func(sb blob.SizedRef) error {
+		hc.NoteBlobExists(sb.Ref, sb.Size)
+		return fn(sb)
+	})
+}
@@ -0,0 +1,105 @@
+// Copyright 2026 Tamás Gulácsi.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package camutil
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/UNO-SOFT/zlog/v2"
+	"perkeep.org/pkg/blob"
+)
+
+func TestHaveCacheGeneration(t *testing.T) {
+	logger = zlog.NewT(t).SLog()
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	t.Setenv("HOME", t.TempDir())
+	defer func(old time.Duration) { haveCacheRecheck = old }(haveCacheRecheck)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := closeHaveCache(); err != nil {
+		t.Fatal(err)
+	}
+	defer closeHaveCache()
+
+	gen, genErr := "1", error(nil)
+	generation := func(context.Context) (string, error) { return gen, genErr }
+	br := blob.RefFromString("wiped")
+	server := fakeStatReceiver{have: map[blob.Ref]bool{}}
+	sr, err := newHaveCacheReceiverGen(ctx, "http://server", server, generation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = sr.ReceiveBlob(ctx, br, strings.NewReader("data")); err != nil {
+		t.Fatal(err)
+	}
+	has := func() bool {
+		var found bool
+		if err := sr.StatBlobs(ctx, []blob.Ref{br}, func(blob.SizedRef) error { found = true; return nil }); err != nil {
+			t.Fatal(err)
+		}
+		return found
+	}
+	if !has() {
+		t.Fatal("received blob is not remembered")
+	}
+
+	// the server is wiped: same generation is not rechecked till due
+	gen = "2"
+	if !has() {
+		t.Error("generation is rechecked too early")
+	}
+	haveCacheRecheck = 0
+	if has() {
+		t.Error("blob of the old generation is remembered")
+	}
+
+	// the cache is not trusted while the generation cannot be checked
+	sr.ReceiveBlob(ctx, br, strings.NewReader("data"))
+	genErr = errors.New("down")
+	if has() {
+		t.Error("cache is used without checking the generation")
+	}
+}
+
+func TestFreshGeneration(t *testing.T) {
+	logger = zlog.NewT(t).SLog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var gen atomic.Value
+	gen.Store("1")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/javascript")
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"blobRoot":          "/bs/",
+			"storageGeneration": gen.Load(),
+		})
+	}))
+	defer srv.Close()
+	server := strings.Replace(srv.URL, "http://", "http://user:pass@", 1)
+
+	// a client discovers the server once
+	c, err := newClient(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	generation := freshGeneration(server)
+	for i, want := range []string{"1", "2"} {
+		gen.Store(want)
+		if got, err := generation(ctx); err != nil || got != want {
+			t.Errorf("%d. got %q (%+v), wanted %q", i, got, err, want)
+		}
+		if got, _ := c.StorageGeneration(ctx); got != "1" {
+			t.Errorf("%d. the old client got %q", i, got)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+// Copyright 2026 Tamás Gulácsi.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package camutil
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	"perkeep.org/pkg/blob"
+	"perkeep.org/pkg/blobserver"
+	"perkeep.org/pkg/schema"
+)
+
+// ErrNoIdentity is returned when claims should be signed, but there is no
+// signing identity.
+var ErrNoIdentity = errors.New("no signing identity (create one with \"camproxy identity init\")")
+
+// Identity is the signing identity of the permanodes and claims:
+// an OpenPGP private key.
+type Identity struct {
+	Entity *openpgp.Entity
+	// ArmoredPublicKey is the contents of the public key blob.
+	ArmoredPublicKey []byte
+	// PublicKeyRef is the ref of the public key blob (camliSigner).
+	PublicKeyRef blob.Ref
+}
+
+// DefaultIdentityPath returns Perkeep's default secret keyring path.
+func DefaultIdentityPath() string {
+	dn, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dn, "perkeep", "identity-secring.gpg")
+}
+
+// LoadIdentity reads the first private key from the (armored or binary)
+// keyring or secret key file at path - DefaultIdentityPath if path is empty.
+// It is an error if there's no usable private key.
+func LoadIdentity(path string) (*Identity, error) {
+	if path == "" {
+		if path = DefaultIdentityPath(); path == "" {
+			return nil, ErrNoIdentity
+		}
+	}
+	fh, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("%q: %w", path, ErrNoIdentity)
+		}
+		return nil, err
+	}
+	defer fh.Close()
+	br := bufio.NewReader(fh)
+	var el openpgp.EntityList
+	if b, _ := br.Peek(10); bytes.HasPrefix(b, []byte("-----BEGIN")) {
+		el, err = openpgp.ReadArmoredKeyRing(br)
+	} else {
+		el, err = openpgp.ReadKeyRing(br)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read keyring %q: %w", path, err)
+	}
+	for _, e := range el {
+		if e.PrivateKey == nil {
+			continue
+		}
+		if e.PrivateKey.Encrypted {
+			return nil, fmt.Errorf("%q: private key %s is encrypted: %w", path, e.PrimaryKey.KeyIdString(), ErrNoIdentity)
+		}
+		return newIdentity(e)
+	}
+	return nil, fmt.Errorf("%q: no private key: %w", path, ErrNoIdentity)
+}
+
+// GenerateIdentity generates a new private key of keyType ("ed25519", "rsa3072" or "rsa4096"),
+// and writes it to path as a binary secret keyring. path must not exist.
+func GenerateIdentity(path, name, email, keyType string) (*Identity, error) {
+	var config packet.Config
+	switch strings.ToLower(keyType) {
+	case "", "ed25519":
+		config.Algorithm, config.Curve = packet.PubKeyAlgoEdDSA, packet.Curve25519
+	case "rsa3072":
+		config.Algorithm, config.RSABits = packet.PubKeyAlgoRSA, 3072
+	case "rsa4096":
+		config.Algorithm, config.RSABits = packet.PubKeyAlgoRSA, 4096
+	default:
+		return nil, fmt.Errorf("unknown key type %q", keyType)
+	}
+	e, err := openpgp.NewEntity(name, "camproxy", email, &config)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err = e.SerializePrivate(&buf, &config); err != nil {
+		return nil, err
+	}
+	// nosemgrep: go.lang.correctness.permissions.file_permission.incorrect-default-permission
+	if err = os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	fh, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = fh.Write(buf.Bytes()); err == nil {
+		err = fh.Sync()
+	}
+	if closeErr := fh.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(path)
+		return nil, err
+	}
+	return newIdentity(e)
+}
+
+func newIdentity(e *openpgp.Entity) (*Identity, error) {
+	var buf bytes.Buffer
+	w, err := armor.Encode(&buf, openpgp.PublicKeyType, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err = e.Serialize(w); err != nil {
+		return nil, err
+	}
+	if err = w.Close(); err != nil {
+		return nil, err
+	}
+	return &Identity{Entity: e, ArmoredPublicKey: buf.Bytes(), PublicKeyRef: blob.RefFromBytes(buf.Bytes())}, nil
+}
+
+// KeyID returns the key ID of the identity.
+func (id *Identity) KeyID() string { return id.Entity.PrimaryKey.KeyIdString() }
+
+// Signer returns the schema.Signer of the identity.
+func (id *Identity) Signer() (*schema.Signer, error) {
+	return schema.NewSigner(id.PublicKeyRef, bytes.NewReader(id.ArmoredPublicKey), id.Entity)
+}
+
+// UploadPublicKey uploads the public key blob to dst, so the claims signed
+// with this identity can be verified.
+func (id *Identity) UploadPublicKey(ctx context.Context, dst blobserver.BlobReceiver) (blob.Ref, error) {
+	sb, err := blobserver.Receive(ctx, dst, id.PublicKeyRef, bytes.NewReader(id.ArmoredPublicKey))
+	return sb.Ref, err
+}
@@ -0,0 +1,88 @@
+// Copyright 2026 Tamás Gulácsi.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package camutil
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"perkeep.org/pkg/blob"
+)
+
+func TestIdentity(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	for _, keyType := range []string{"ed25519", "rsa3072"} {
+		fn := filepath.Join(dir, keyType, "secring.gpg")
+		id, err := GenerateIdentity(fn, "test", "test@example.com", keyType)
+		if err != nil {
+			t.Fatalf("%s: %+v", keyType, err)
+		}
+		if _, err = GenerateIdentity(fn, "test", "test@example.com", keyType); err == nil {
+			t.Errorf("%s: overwrote the existing keyring", keyType)
+		}
+		got, err := LoadIdentity(fn)
+		if err != nil {
+			t.Fatalf("%s: %+v", keyType, err)
+		}
+		if got.KeyID() != id.KeyID() {
+			t.Errorf("%s: got key %s, wanted %s", keyType, got.KeyID(), id.KeyID())
+		}
+		if !bytes.Equal(got.ArmoredPublicKey, id.ArmoredPublicKey) {
+			t.Errorf("%s: public key differs", keyType)
+		}
+		if fi, err := os.Stat(fn); err != nil {
+			t.Fatal(err)
+		} else if fi.Mode().Perm() != 0600 {
+			t.Errorf("%s: keyring mode is %v", keyType, fi.Mode())
+		}
+	}
+
+	if _, err := GenerateIdentity(filepath.Join(dir, "x"), "test", "", "dsa"); err == nil {
+		t.Error("unknown key type is accepted")
+	}
+	if _, err := LoadIdentity(filepath.Join(dir, "nonexistent")); !errors.Is(err, ErrNoIdentity) {
+		t.Errorf("nonexistent: got %v, wanted ErrNoIdentity", err)
+	}
+}
+
+// flakyReceiver fails the first fail ReceiveBlob calls.
+type flakyReceiver struct {
+	fakeStatReceiver
+	fail, calls int
+}
+
+func (sr *flakyReceiver) ReceiveBlob(ctx context.Context, br blob.Ref, source io.Reader) (blob.SizedRef, error) {
+	sr.calls++
+	if sr.calls <= sr.fail {
+		return blob.SizedRef{}, errors.New("network error")
+	}
+	return sr.fakeStatReceiver.ReceiveBlob(ctx, br, source)
+}
+
+func TestUploadPublicKeyRetry(t *testing.T) {
+	t.Parallel()
+	key := []byte("public key")
+	sr := &flakyReceiver{fakeStatReceiver: fakeStatReceiver{have: map[blob.Ref]bool{}}, fail: 1}
+	u := Uploader{StatReceiver: sr,
+		identity: &Identity{ArmoredPublicKey: key, PublicKeyRef: blob.RefFromBytes(key)}}
+	ctx := context.Background()
+	if err := u.uploadPublicKey(ctx); err == nil {
+		t.Fatal("the failure is not returned")
+	}
+	for range 2 {
+		if err := u.uploadPublicKey(ctx); err != nil {
+			t.Fatalf("the failure is remembered: %+v", err)
+		}
+	}
+	if sr.calls != 2 {
+		t.Errorf("got %d uploads, wanted 2", sr.calls)
+	}
+}
@@ -0,0 +1,64 @@
+// Copyright 2026 Tamás Gulácsi.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package camutil
+
+import (
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/tgulacsi/camproxy/blobserver/badger"
+	"perkeep.org/pkg/blobserver"
+	"perkeep.org/pkg/blobserver/localdisk"
+)
+
+// IsLocalServer reports whether the server is a local storage:
+// file:///path (localdisk) or badger:///path (badger DB).
+func IsLocalServer(server string) bool {
+	return strings.HasPrefix(server, "file://") || strings.HasPrefix(server, "badger://")
+}
+
+var (
+	localStorages   = make(map[string]blobserver.Storage)
+	localStoragesMu sync.Mutex
+)
+
+// openLocalStorage opens the local storage of the server - just once, as
+// a badger DB can be opened only once per process.
+func openLocalStorage(server string) (blobserver.Storage, error) {
+	localStoragesMu.Lock()
+	defer localStoragesMu.Unlock()
+	if sto, ok := localStorages[server]; ok {
+		return sto, nil
+	}
+	var sto blobserver.Storage
+	var err error
+	if root, ok := strings.CutPrefix(server, "badger://"); ok {
+		sto, err = badger.New(root, "")
+	} else {
+		sto, err = localdisk.New(strings.TrimPrefix(server, "file://"))
+	}
+	if err != nil {
+		return nil, err
+	}
+	localStorages[server] = sto
+	return sto, nil
+}
+
+// closeLocalStorages closes the opened local storages.
+func closeLocalStorages() error {
+	localStoragesMu.Lock()
+	defer localStoragesMu.Unlock()
+	var firstErr error
+	for k, sto := range localStorages {
+		if c, ok := sto.(io.Closer); ok {
+			if err := c.Close(); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+		delete(localStorages, k)
+	}
+	return firstErr
+}
@@ -6,6 +6,7 @@ package camutil
 
 import (
 	"bytes"
+	"errors"
 	"io"
 
 	lru "github.com/hashicorp/golang-lru"
@@ -69,6 +70,17 @@ func (mc *MimeCache) Close() error {
 	return nil
 }
 
+// Check returns an error iff the disk db (kv) is not open or not usable.
+func (mc *MimeCache) Check() error {
+	if mc.db == nil {
+		return errors.New("mime cache db is not open")
+	}
+	if _, err := mc.db.Get(""); err != nil && !errors.Is(err, sorted.ErrNotFound) {
+		return err
+	}
+	return nil
+}
+
 // Get returns the stored mimetype for the key - empty string if not found
 func (mc *MimeCache) Get(key string) string {
 	if mti, ok := mc.mem.Get(key); ok {
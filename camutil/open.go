@@ -0,0 +1,60 @@
+// Copyright 2026 Tamás Gulácsi.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package camutil
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"github.com/zRedShift/mimemagic"
+	"perkeep.org/pkg/blob"
+	"perkeep.org/pkg/schema"
+)
+
+// File is a random-access handle of a file blob's contents.
+// It implements io.Reader, io.ReaderAt, io.Seeker and io.Closer,
+// and provides Size, ModTime and FileName, too.
+type File struct {
+	*schema.FileReader
+
+	mimeOnce sync.Once
+	mime     string
+}
+
+var _ = io.ReadSeekCloser((*File)(nil))
+var _ = io.ReaderAt((*File)(nil))
+
+// Open opens the file br for random access, found by the same strategies as Start.
+//
+// The chunks are fetched through the Downloader's fetcher,
+// so they're cached if the Downloader has a cache.
+func (down *Downloader) Open(ctx context.Context, br blob.Ref) (*File, error) {
+	rc, err := down.open(ctx, br, func(f blob.Fetcher) (io.ReadCloser, error) {
+		fr, err := schema.NewFileReader(ctx, f, br)
+		if err != nil {
+			return nil, err
+		}
+		return &File{FileReader: fr}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rc.(*File), nil
+}
+
+// MIMEType returns the MIME type of the file, sniffed from its beginning
+// and its name. The result is "" if it cannot be determined.
+func (f *File) MIMEType() string {
+	f.mimeOnce.Do(func() {
+		b := make([]byte, 1024)
+		n, err := f.ReadAt(b, 0)
+		if n == 0 && err != nil {
+			return
+		}
+		f.mime = mimemagic.Match(b[:n], f.FileName()).MediaType()
+	})
+	return f.mime
+}
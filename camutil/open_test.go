@@ -0,0 +1,87 @@
+// Copyright 2026 Tamás Gulácsi.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package camutil
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"perkeep.org/pkg/blob"
+	"perkeep.org/pkg/blobserver"
+	"perkeep.org/pkg/blobserver/memory"
+	"perkeep.org/pkg/schema"
+)
+
+func TestDownloaderOpen(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	const text = "Lorem ipsum dolor sit amet, consectetur adipiscing elit."
+	var sto memory.Storage
+	br, err := schema.WriteFileFromReader(ctx, &sto, "lorem.txt", strings.NewReader(text))
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := &Downloader{Fetcher: &sto, server: "file:///nonexistent"}
+	f, err := down.Open(ctx, br)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if got := f.Size(); got != int64(len(text)) {
+		t.Errorf("size: got %d, wanted %d", got, len(text))
+	}
+	if got := f.FileName(); got != "lorem.txt" {
+		t.Errorf("file name: got %q", got)
+	}
+	if got := f.MIMEType(); got != "text/plain" {
+		t.Errorf("MIME type: got %q", got)
+	}
+	b := make([]byte, 5)
+	if _, err = f.ReadAt(b, 6); err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "ipsum" {
+		t.Errorf("ReadAt: got %q", b)
+	}
+	if _, err = f.Seek(-5, io.SeekEnd); err != nil {
+		t.Fatal(err)
+	}
+	if b, err = io.ReadAll(f); err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "elit." {
+		t.Errorf("read after Seek: got %q", b)
+	}
+}
+
+func TestDownloaderOpenNotFile(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var sto memory.Storage
+	br := blob.RefFromString("not a schema blob")
+	if _, err := blobserver.Receive(ctx, &sto, br, strings.NewReader("not a schema blob")); err != nil {
+		t.Fatal(err)
+	}
+	down := &Downloader{Fetcher: &sto, server: "file:///nonexistent", secondary: "http://127.0.0.1:1"}
+	rc, err := down.Start(ctx, true, br)
+	if err == nil {
+		rc.Close()
+		t.Fatal("got no error for a non-file")
+	}
+	var de *DownloadError
+	if !errors.As(err, &de) || !errors.Is(err, ErrNotFile) {
+		t.Fatalf("got %#v, wanted ErrNotFile", err)
+	}
+	// the secondary is not tried
+	if errs, ok := de.Err.(interface{ Unwrap() []error }); !ok || len(errs.Unwrap()) != 1 {
+		t.Errorf("got %v, wanted the first strategy's error only", de.Err)
+	}
+}
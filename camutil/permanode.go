@@ -0,0 +1,68 @@
+// Copyright 2026 Tamás Gulácsi.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package camutil
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"perkeep.org/pkg/blob"
+	"perkeep.org/pkg/search"
+)
+
+// ErrNoSearch is returned when the permanodes cannot be described,
+// as there is no server with a search handler.
+var ErrNoSearch = errors.New("no search handler")
+
+// Permanode is the current state of a permanode, as described by the server.
+type Permanode struct {
+	Ref     blob.Ref
+	ModTime time.Time
+	Attr    url.Values
+}
+
+// Title returns the title attribute.
+func (p Permanode) Title() string { return p.Attr.Get("title") }
+
+// Content returns the camliContent attribute (invalid if not set).
+func (p Permanode) Content() blob.Ref {
+	br, _ := blob.Parse(p.Attr.Get("camliContent"))
+	return br
+}
+
+// Members returns the camliMember attributes: the members of a collection.
+func (p Permanode) Members() []blob.Ref {
+	members := make([]blob.Ref, 0, len(p.Attr["camliMember"]))
+	for _, s := range p.Attr["camliMember"] {
+		if br, ok := blob.Parse(s); ok {
+			members = append(members, br)
+		}
+	}
+	return members
+}
+
+// DescribePermanodes returns the permanodes among brs, described by the
+// server's search handler. The refs which are not permanodes are left out.
+func (down *Downloader) DescribePermanodes(ctx context.Context, brs ...blob.Ref) (map[blob.Ref]Permanode, error) {
+	if down.cl == nil || IsLocalServer(down.server) {
+		return nil, ErrNoSearch
+	}
+	res, err := down.cl.Describe(ctx, &search.DescribeRequest{BlobRefs: brs})
+	if err != nil {
+		return nil, fmt.Errorf("describe %v: %w", brs, err)
+	}
+	m := make(map[blob.Ref]Permanode, len(brs))
+	for _, br := range brs {
+		db := res.Meta[br.String()]
+		if db == nil || db.Permanode == nil {
+			continue
+		}
+		m[br] = Permanode{Ref: br, ModTime: db.Permanode.ModTime, Attr: db.Permanode.Attr}
+	}
+	return m, nil
+}
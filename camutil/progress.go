@@ -0,0 +1,157 @@
+// Copyright 2026 Tamás Gulácsi.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package camutil
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"perkeep.org/pkg/blob"
+	"perkeep.org/pkg/blobserver"
+)
+
+// Progress is the state of an upload.
+type Progress struct {
+	// Name is the uploaded file's (or directory's) name.
+	Name string `json:"name"`
+	// Size is the total size of the files seen so far.
+	Size int64 `json:"size"`
+	// BytesRead is the number of bytes read from the files.
+	BytesRead int64 `json:"bytesRead"`
+	// Chunks is the number of blobs uploaded.
+	Chunks int `json:"chunks"`
+	// ChunkBytes is the size of the uploaded blobs.
+	ChunkBytes int64 `json:"chunkBytes"`
+	// Deduplicated is the number of blobs already on the server, not uploaded.
+	Deduplicated int `json:"deduplicated"`
+	// Done is true for the last report, when all the uploads using the
+	// context have finished.
+	Done bool `json:"done,omitempty"`
+}
+
+// ProgressFunc is called with the progress of an upload after each blob.
+// It may be called concurrently.
+type ProgressFunc func(Progress)
+
+// WithProgress makes the Uploader report the progress of each upload to f.
+// Such an Uploader is not cached.
+func WithProgress(f ProgressFunc) Option { return func(o *clientOptions) { o.Progress = f } }
+
+type ctxKeyProgress struct{}
+
+// ContextWithProgress returns a context which makes the uploads using it
+// report their progress to f - over the one set WithProgress.
+// All the uploads using the returned context are summed up as one.
+func ContextWithProgress(ctx context.Context, name string, f ProgressFunc) context.Context {
+	return context.WithValue(ctx, ctxKeyProgress{}, &progressReporter{p: Progress{Name: name}, fn: f})
+}
+
+// startProgress returns the context with the progress reporter (nil if there's none),
+// and the func to call at the end of the upload, which sends the final report
+// if this was the last running upload with the reporter.
+//
+// The reporter of the context wins; else, an Uploader created WithProgress
+// starts a new one for each upload.
+func (u *Uploader) startProgress(ctx context.Context, name string) (context.Context, *progressReporter, func()) {
+	pr := progressFromContext(ctx)
+	if pr == nil {
+		if u.progress == nil {
+			return ctx, nil, func() {}
+		}
+		pr = &progressReporter{p: Progress{Name: name}, fn: u.progress}
+		ctx = context.WithValue(ctx, ctxKeyProgress{}, pr)
+	}
+	pr.mu.Lock()
+	pr.running++
+	pr.mu.Unlock()
+	return ctx, pr, pr.done
+}
+
+func progressFromContext(ctx context.Context) *progressReporter {
+	pr, _ := ctx.Value(ctxKeyProgress{}).(*progressReporter)
+	return pr
+}
+
+type progressReporter struct {
+	mu      sync.Mutex
+	p       Progress
+	fn      ProgressFunc
+	running int
+}
+
+// update changes the progress with f, and reports it if report is true.
+func (pr *progressReporter) update(report bool, f func(*Progress)) {
+	if pr == nil {
+		return
+	}
+	pr.mu.Lock()
+	f(&pr.p)
+	p := pr.p
+	pr.mu.Unlock()
+	if report && pr.fn != nil {
+		pr.fn(p)
+	}
+}
+
+// done ends an upload, and sends the final report if it was the last running.
+func (pr *progressReporter) done() {
+	pr.mu.Lock()
+	pr.running--
+	last := pr.running == 0
+	pr.mu.Unlock()
+	if last {
+		pr.update(true, func(p *Progress) { p.Done = true })
+	}
+}
+
+// reader counts the bytes read from r.
+func (pr *progressReporter) reader(r io.Reader) io.Reader {
+	if pr == nil {
+		return r
+	}
+	return progressReader{Reader: r, pr: pr}
+}
+
+// statReceiver counts the uploaded and the deduplicated blobs.
+func (pr *progressReporter) statReceiver(sr blobserver.StatReceiver) blobserver.StatReceiver {
+	if pr == nil {
+		return sr
+	}
+	return progressStatReceiver{StatReceiver: sr, pr: pr}
+}
+
+type progressReader struct {
+	io.Reader
+	pr *progressReporter
+}
+
+func (r progressReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if n > 0 {
+		r.pr.update(false, func(p *Progress) { p.BytesRead += int64(n) })
+	}
+	return n, err
+}
+
+type progressStatReceiver struct {
+	blobserver.StatReceiver
+	pr *progressReporter
+}
+
+func (sr progressStatReceiver) ReceiveBlob(ctx context.Context, br blob.Ref, source io.Reader) (blob.SizedRef, error) {
+	sb, err := sr.StatReceiver.ReceiveBlob(ctx, br, source)
+	if err == nil {
+		sr.pr.update(true, func(p *Progress) { p.Chunks++; p.ChunkBytes += int64(sb.Size) })
+	}
+	return sb, err
+}
+
+func (sr progressStatReceiver) StatBlobs(ctx context.Context, blobs []blob.Ref, fn func(blob.SizedRef) error) error {
+	return sr.StatReceiver.StatBlobs(ctx, blobs, func(sb blob.SizedRef) error {
+		sr.pr.update(true, func(p *Progress) { p.Deduplicated++ })
+		return fn(sb)
+	})
+}
@@ -0,0 +1,106 @@
+// Copyright 2026 Tamás Gulácsi.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package camutil
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"perkeep.org/pkg/blob"
+)
+
+// fakeStatReceiver has the blobs in have.
+type fakeStatReceiver struct {
+	have map[blob.Ref]bool
+}
+
+func (sr fakeStatReceiver) ReceiveBlob(ctx context.Context, br blob.Ref, source io.Reader) (blob.SizedRef, error) {
+	n, err := io.Copy(io.Discard, source)
+	return blob.SizedRef{Ref: br, Size: uint32(n)}, err
+}
+
+func (sr fakeStatReceiver) StatBlobs(ctx context.Context, blobs []blob.Ref, fn func(blob.SizedRef) error) error {
+	for _, br := range blobs {
+		if sr.have[br] {
+			if err := fn(blob.SizedRef{Ref: br, Size: 1}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func TestProgressReporter(t *testing.T) {
+	t.Parallel()
+	var reports []Progress
+	var u Uploader
+	if _, pr, _ := u.startProgress(context.Background(), "none"); pr != nil {
+		t.Error("got a reporter without ContextWithProgress")
+	}
+	ctx := ContextWithProgress(context.Background(), "test", func(p Progress) { reports = append(reports, p) })
+	ctx, pr, done := u.startProgress(ctx, "test")
+	ctx2, pr2, innerDone := u.startProgress(ctx, "inner")
+	if pr2 != pr || ctx2 != ctx {
+		t.Error("nested upload got a new reporter")
+	}
+
+	n, err := io.Copy(io.Discard, pr.reader(strings.NewReader("0123456789")))
+	if err != nil || n != 10 {
+		t.Fatalf("read %d: %+v", n, err)
+	}
+	var a, b blob.Ref
+	sr := pr.statReceiver(fakeStatReceiver{have: map[blob.Ref]bool{a: true}})
+	if _, err = sr.ReceiveBlob(ctx, b, strings.NewReader("abc")); err != nil {
+		t.Fatal(err)
+	}
+	if err = sr.StatBlobs(ctx, []blob.Ref{a}, func(blob.SizedRef) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	innerDone()
+	if len(reports) != 2 {
+		t.Errorf("the nested upload sent a final report: %+v", reports)
+	}
+	done()
+
+	if len(reports) != 3 {
+		t.Fatalf("got %d reports, wanted 3: %+v", len(reports), reports)
+	}
+	want := Progress{Name: "test", BytesRead: 10, Chunks: 1, ChunkBytes: 3, Deduplicated: 1, Done: true}
+	if got := reports[len(reports)-1]; got != want {
+		t.Errorf("got %+v, wanted %+v", got, want)
+	}
+}
+
+func TestUploaderWithProgress(t *testing.T) {
+	t.Parallel()
+	var opts clientOptions
+	var reports, ctxReports []Progress
+	opts.apply(WithProgress(func(p Progress) { reports = append(reports, p) }))
+	u := Uploader{progress: opts.Progress}
+
+	ctx, pr, done := u.startProgress(context.Background(), "a.txt")
+	if pr == nil {
+		t.Fatal("got no reporter WithProgress")
+	}
+	if _, pr2, innerDone := u.startProgress(ctx, "inner"); pr2 != pr {
+		t.Error("nested upload got a new reporter")
+	} else {
+		innerDone()
+	}
+	done()
+	if len(reports) != 1 || reports[0].Name != "a.txt" || !reports[0].Done {
+		t.Errorf("got %+v, wanted one final report of a.txt", reports)
+	}
+
+	// the context's reporter overrides the Uploader's
+	ctx = ContextWithProgress(context.Background(), "ctx", func(p Progress) { ctxReports = append(ctxReports, p) })
+	_, _, done = u.startProgress(ctx, "b.txt")
+	done()
+	if len(reports) != 1 || len(ctxReports) != 1 || ctxReports[0].Name != "ctx" {
+		t.Errorf("got %+v and %+v, wanted the context's report only", reports, ctxReports)
+	}
+}
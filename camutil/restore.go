@@ -0,0 +1,307 @@
+// Copyright 2026 Tamás Gulácsi.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package camutil
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"perkeep.org/pkg/blob"
+	"perkeep.org/pkg/schema"
+)
+
+// RestoreMode tells what Save does with the already existing files.
+type RestoreMode uint8
+
+const (
+	// RestoreSkipIdentical skips the files with the same contents (checked by
+	// hashing them against the chunks), and overwrites the others.
+	RestoreSkipIdentical = RestoreMode(iota)
+	// RestoreOverwrite overwrites the existing files.
+	RestoreOverwrite
+	// RestoreRenameNew skips the identical files, and writes the differing
+	// ones under a new name ("name (1).ext").
+	RestoreRenameNew
+	// RestoreFail skips the identical files, and fails on the differing ones.
+	RestoreFail
+)
+
+var restoreModeNames = []string{"skip-identical", "overwrite", "rename-new", "fail"}
+
+func (m RestoreMode) String() string {
+	if int(m) < len(restoreModeNames) {
+		return restoreModeNames[m]
+	}
+	return fmt.Sprintf("RestoreMode(%d)", m)
+}
+
+// ParseRestoreMode parses the name of a RestoreMode:
+// skip-identical, overwrite, rename-new or fail.
+func ParseRestoreMode(s string) (RestoreMode, error) {
+	for i, nm := range restoreModeNames {
+		if nm == s {
+			return RestoreMode(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown restore mode %q (wanted one of %s)", s, strings.Join(restoreModeNames, ", "))
+}
+
+// DefaultSaveWorkers is the default number of entries of a directory restored concurrently.
+const DefaultSaveWorkers = 10
+
+// SaveOptions are the options of SaveWith.
+type SaveOptions struct {
+	// Mode tells what to do with the already existing files.
+	Mode RestoreMode
+	// Include and Exclude select the entries of the trees by their path
+	// relative to the root ("dir/sub/file.txt"), with path.Match patterns.
+	// A pattern without a slash matches any element of the path;
+	// one with slashes matches the path, or one of its parents.
+	// The directories not selected are not fetched.
+	Include, Exclude []string
+	// MaxDepth limits the depth of the trees: 1 means just the root's entries.
+	MaxDepth int
+	// MaxSize limits the total size of the files - ErrTooLarge is returned
+	// when it would be exceeded.
+	MaxSize int64
+	// Workers is the number of entries of a directory restored concurrently
+	// (DefaultSaveWorkers if not positive).
+	Workers int
+}
+
+// restorer restores the blobs under a dir.
+type restorer struct {
+	src    blob.Fetcher
+	opts   SaveOptions
+	pf     prefetch
+	filter treeFilter
+}
+
+// resolve returns the name to write to, and whether it should be skipped, as
+// the existing file is identical.
+func (rs *restorer) resolve(name string, identical func(string, os.FileInfo) bool) (string, bool, error) {
+	fi, err := os.Lstat(name)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return name, false, nil
+		}
+		return name, false, err
+	}
+	if rs.opts.Mode != RestoreOverwrite && identical(name, fi) {
+		return name, true, nil
+	}
+	switch rs.opts.Mode {
+	case RestoreRenameNew:
+		nm, skip := freeName(name, identical)
+		return nm, skip, nil
+	case RestoreFail:
+		return name, false, fmt.Errorf("%q: %w", name, os.ErrExist)
+	}
+	if fi.IsDir() {
+		return name, false, fmt.Errorf("%q is a directory", name)
+	}
+	return name, false, nil
+}
+
+// mkdir creates the directory dir, if it does not exist.
+// The existing directories are merged into.
+func (rs *restorer) mkdir(dir string, mode os.FileMode) (string, error) {
+	if fi, err := os.Lstat(dir); err == nil && fi.IsDir() {
+		return dir, nil
+	}
+	dir, _, err := rs.resolve(dir, func(string, os.FileInfo) bool { return false })
+	if err != nil {
+		return dir, err
+	}
+	if fi, err := os.Lstat(dir); err == nil && !fi.IsDir() {
+		if err = os.Remove(dir); err != nil {
+			return dir, err
+		}
+	}
+	if err = os.MkdirAll(dir, mode|0700); err != nil {
+		return dir, fmt.Errorf("mkdirall %q: %w", dir, err)
+	}
+	return dir, nil
+}
+
+// writeFile writes the contents of the file schema blob b to name,
+// through a partial file, which is renamed to name when complete.
+//
+// A partial file left by an interrupted restore is reused: its parts
+// matching the chunks are kept, and only the rest is fetched.
+func (rs *restorer) writeFile(ctx context.Context, name string, b *schema.Blob) error {
+	logger := loggerFromContext(ctx)
+	name, skip, err := rs.resolve(name, func(name string, fi os.FileInfo) bool {
+		if !fi.Mode().IsRegular() || fi.Size() != b.PartsSize() {
+			return false
+		}
+		ok, err := rs.identical(ctx, name, b)
+		if err != nil {
+			logger.Warn("compare", "file", name, "error", err)
+		}
+		return ok
+	})
+	if err != nil {
+		return err
+	}
+	if skip {
+		logger.Debug("Skipping (identical).", "file", name)
+		return nil
+	}
+	logger.Debug("Writing", "blob", b.BlobRef(), "destination", name)
+
+	partial := partialName(name, b.BlobRef())
+	fh, err := os.OpenFile(partial, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+	var off int64
+	if fi, err := fh.Stat(); err == nil && fi.Size() != 0 {
+		if off, err = rs.verifiedPrefix(ctx, fh, b, fi.Size()); err != nil {
+			return err
+		}
+		logger.Info("resume", "file", name, "offset", off)
+	}
+	if err = fh.Truncate(off); err != nil {
+		return err
+	}
+	if _, err = fh.Seek(off, io.SeekStart); err != nil {
+		return err
+	}
+	sr, err := newStreamReader(ctx, rs.src, b, rs.pf)
+	if err != nil {
+		return err
+	}
+	defer sr.Close()
+	if _, err = sr.Seek(off, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err = io.Copy(fh, sr); err != nil {
+		return fmt.Errorf("copy %s to %s: %w", b.BlobRef(), partial, err)
+	}
+	if err = fh.Sync(); err != nil {
+		return err
+	}
+	if err = fh.Close(); err != nil {
+		return err
+	}
+	if err = setFileMeta(partial, b); err != nil {
+		logger.Error("setFileMeta", "error", err)
+	}
+	return os.Rename(partial, name)
+}
+
+// writeBlob writes the raw blob br to name, through a temp file.
+func (rs *restorer) writeBlob(ctx context.Context, name string, br blob.Ref, data []byte) error {
+	name, skip, err := rs.resolve(name, func(name string, fi os.FileInfo) bool {
+		if !fi.Mode().IsRegular() || fi.Size() != int64(len(data)) {
+			return false
+		}
+		old, err := os.ReadFile(name)
+		return err == nil && hashMatches(br, old)
+	})
+	if err != nil || skip {
+		return err
+	}
+	return replaceWith(name, func(tmp string) error {
+		return os.WriteFile(tmp, data, 0640)
+	})
+}
+
+// identical reports whether the file is identical with the contents of b.
+func (rs *restorer) identical(ctx context.Context, name string, b *schema.Blob) (bool, error) {
+	fh, err := os.Open(name)
+	if err != nil {
+		return false, err
+	}
+	defer fh.Close()
+	size := b.PartsSize()
+	n, err := rs.verifiedPrefix(ctx, fh, b, size)
+	return err == nil && n == size, err
+}
+
+var errMismatch = errors.New("mismatch")
+
+// verifiedPrefix returns the length of the beginning of r (of size bytes)
+// which matches the chunks of b, checked by hashing - without fetching the chunks.
+func (rs *restorer) verifiedPrefix(ctx context.Context, r io.ReaderAt, b *schema.Blob, size int64) (int64, error) {
+	var off int64
+	var buf []byte
+	err := forEachPart(ctx, rs.src, b, 0, size, func(part chunkPart) error {
+		n := part.hi - part.lo
+		if int64(cap(buf)) < n {
+			buf = make([]byte, n)
+		}
+		buf = buf[:n]
+		if _, err := r.ReadAt(buf, off); err != nil {
+			return errMismatch
+		}
+		if part.br.Valid() {
+			// just the whole chunks can be checked
+			if part.lo != 0 || !hashMatches(part.br, buf) {
+				return errMismatch
+			}
+		} else if bytes.ContainsFunc(buf, func(r rune) bool { return r != 0 }) {
+			return errMismatch
+		}
+		off += n
+		return nil
+	})
+	if err != nil && !errors.Is(err, errMismatch) {
+		return 0, err
+	}
+	return off, nil
+}
+
+// partialName returns the name of the partial file of the restore of br to name.
+func partialName(name string, br blob.Ref) string {
+	s := br.String()
+	if i := strings.IndexByte(s, '-'); i >= 0 {
+		s = s[i+1:]
+	}
+	if len(s) > 12 {
+		s = s[:12]
+	}
+	return filepath.Join(filepath.Dir(name), "."+filepath.Base(name)+"."+s+".partial")
+}
+
+// freeName returns "name (N).ext" for the first N which does not exist,
+// or which is identical (so skip is true) - a rerun does not write another copy.
+func freeName(name string, identical func(string, os.FileInfo) bool) (nm string, skip bool) {
+	ext := filepath.Ext(name)
+	stem := strings.TrimSuffix(name, ext)
+	for i := 1; ; i++ {
+		nm = fmt.Sprintf("%s (%d)%s", stem, i, ext)
+		fi, err := os.Lstat(nm)
+		if errors.Is(err, os.ErrNotExist) {
+			return nm, false
+		}
+		if err == nil && identical(nm, fi) {
+			return nm, true
+		}
+	}
+}
+
+// replaceWith creates a temp file with create, and renames it to name.
+func replaceWith(name string, create func(tmp string) error) error {
+	tmp := filepath.Join(filepath.Dir(name), "."+filepath.Base(name)+".tmp")
+	_ = os.Remove(tmp)
+	if err := create(tmp); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, name); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return nil
+}
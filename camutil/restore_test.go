@@ -0,0 +1,122 @@
+// Copyright 2026 Tamás Gulácsi.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package camutil
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"perkeep.org/pkg/blobserver/memory"
+	"perkeep.org/pkg/schema"
+)
+
+func TestParseRestoreMode(t *testing.T) {
+	t.Parallel()
+	for _, m := range []RestoreMode{RestoreSkipIdentical, RestoreOverwrite, RestoreRenameNew, RestoreFail} {
+		if got, err := ParseRestoreMode(m.String()); err != nil || got != m {
+			t.Errorf("%v: got %v, %v", m, got, err)
+		}
+	}
+	if _, err := ParseRestoreMode("merge"); err == nil {
+		t.Error("parsed an unknown mode")
+	}
+}
+
+func TestRestorerResolve(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	name := filepath.Join(dir, "a.txt")
+	if err := os.WriteFile(name, []byte("a"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	for _, tC := range []struct {
+		mode      RestoreMode
+		identical bool
+		want      string
+		skip      bool
+		err       error
+	}{
+		{RestoreSkipIdentical, true, "a.txt", true, nil},
+		{RestoreSkipIdentical, false, "a.txt", false, nil},
+		{RestoreOverwrite, true, "a.txt", false, nil},
+		{RestoreRenameNew, true, "a.txt", true, nil},
+		{RestoreRenameNew, false, "a (1).txt", false, nil},
+		{RestoreFail, true, "a.txt", true, nil},
+		{RestoreFail, false, "a.txt", false, os.ErrExist},
+	} {
+		rs := restorer{opts: SaveOptions{Mode: tC.mode}}
+		got, skip, err := rs.resolve(name, func(string, os.FileInfo) bool { return tC.identical })
+		if !errors.Is(err, tC.err) {
+			t.Errorf("%v/%t: got error %v, wanted %v", tC.mode, tC.identical, err, tC.err)
+		}
+		if filepath.Base(got) != tC.want || skip != tC.skip {
+			t.Errorf("%v/%t: got %q (skip=%t), wanted %q (skip=%t)", tC.mode, tC.identical, got, skip, tC.want, tC.skip)
+		}
+	}
+
+	// rename-new skips an identical copy of a previous run
+	if err := os.WriteFile(filepath.Join(dir, "a (1).txt"), []byte("b"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	rs := restorer{opts: SaveOptions{Mode: RestoreRenameNew}}
+	for _, copied := range []string{"a (1).txt", "a (2).txt"} {
+		got, skip, err := rs.resolve(name, func(nm string, _ os.FileInfo) bool { return filepath.Base(nm) == copied })
+		if err != nil || filepath.Base(got) != copied || skip != (copied == "a (1).txt") {
+			t.Errorf("%s: got %q (skip=%t), %v", copied, got, skip, err)
+		}
+	}
+}
+
+func TestSaveWith(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	const text = "some text to restore"
+	var sto memory.Storage
+	br, err := schema.WriteFileFromReader(ctx, &sto, "restored.txt", strings.NewReader(text))
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := &Downloader{Fetcher: &sto}
+	dir := t.TempDir()
+	name := filepath.Join(dir, "restored.txt")
+
+	// a partial file of an interrupted restore
+	if err = os.WriteFile(partialName(name, br), []byte(text[:5]), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = down.Save(ctx, dir, true, br); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := os.ReadFile(name); err != nil || string(b) != text {
+		t.Fatalf("got %q, %v", b, err)
+	}
+	if _, err = os.Stat(partialName(name, br)); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("partial file remained: %v", err)
+	}
+
+	if err = os.WriteFile(name, []byte(strings.ToUpper(text)), 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err = down.SaveWith(ctx, dir, true, SaveOptions{Mode: RestoreFail}, br); !errors.Is(err, os.ErrExist) {
+		t.Errorf("fail mode: got %v", err)
+	}
+	if err = down.SaveWith(ctx, dir, true, SaveOptions{Mode: RestoreRenameNew}, br); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := os.ReadFile(filepath.Join(dir, "restored (1).txt")); err != nil || string(b) != text {
+		t.Errorf("rename-new: got %q, %v", b, err)
+	}
+	// a rerun finds the identical copy
+	if err = down.SaveWith(ctx, dir, true, SaveOptions{Mode: RestoreRenameNew}, br); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(filepath.Join(dir, "restored (2).txt")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("rename-new rerun wrote another copy: %v", err)
+	}
+}
@@ -0,0 +1,127 @@
+// Copyright 2026 Tamás Gulácsi.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package camutil
+
+import (
+	"context"
+	"io"
+	"os"
+	"sync"
+
+	"perkeep.org/pkg/blob"
+	"perkeep.org/pkg/blobserver"
+)
+
+// UploadStats is the deduplication statistics of an upload.
+type UploadStats struct {
+	// TotalBytes is the size of the uploaded file(s).
+	TotalBytes int64 `json:"totalBytes"`
+	// NewBytes is the size of the blobs actually sent to the server.
+	NewBytes int64 `json:"newBytes"`
+	// Chunks is the number of blobs (data chunks and schema blobs).
+	Chunks int `json:"chunks"`
+	// ReusedChunks is the number of blobs already on the server.
+	ReusedChunks int `json:"reusedChunks"`
+}
+
+// Existed reports whether everything was already on the server.
+func (s UploadStats) Existed() bool { return s.Chunks != 0 && s.Chunks == s.ReusedChunks }
+
+type ctxKeyStats struct{}
+
+// statsCollector gathers the UploadStats by wrapping the reader and the StatReceiver.
+type statsCollector struct {
+	mu sync.Mutex
+	s  UploadStats
+}
+
+// withStats returns the context with a statsCollector: the one already in ctx
+// (uploads of a directory are summed up), or a new one.
+func withStats(ctx context.Context) (context.Context, *statsCollector) {
+	if sc, ok := ctx.Value(ctxKeyStats{}).(*statsCollector); ok {
+		return ctx, sc
+	}
+	sc := new(statsCollector)
+	return context.WithValue(ctx, ctxKeyStats{}, sc), sc
+}
+
+func (sc *statsCollector) update(f func(*UploadStats)) {
+	sc.mu.Lock()
+	f(&sc.s)
+	sc.mu.Unlock()
+}
+
+// Stats returns the statistics gathered so far.
+func (sc *statsCollector) Stats() UploadStats {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return sc.s
+}
+
+func (sc *statsCollector) reader(r io.Reader) io.Reader {
+	return statsReader{Reader: r, sc: sc}
+}
+
+func (sc *statsCollector) statReceiver(sr blobserver.StatReceiver) blobserver.StatReceiver {
+	return statsStatReceiver{StatReceiver: sr, sc: sc}
+}
+
+type statsReader struct {
+	io.Reader
+	sc *statsCollector
+}
+
+func (r statsReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if n > 0 {
+		r.sc.update(func(s *UploadStats) { s.TotalBytes += int64(n) })
+	}
+	return n, err
+}
+
+type statsStatReceiver struct {
+	blobserver.StatReceiver
+	sc *statsCollector
+}
+
+func (sr statsStatReceiver) ReceiveBlob(ctx context.Context, br blob.Ref, source io.Reader) (blob.SizedRef, error) {
+	sb, err := sr.StatReceiver.ReceiveBlob(ctx, br, source)
+	if err == nil {
+		sr.sc.update(func(s *UploadStats) { s.Chunks++; s.NewBytes += int64(sb.Size) })
+	}
+	return sb, err
+}
+
+func (sr statsStatReceiver) StatBlobs(ctx context.Context, blobs []blob.Ref, fn func(blob.SizedRef) error) error {
+	return sr.StatReceiver.StatBlobs(ctx, blobs, func(sb blob.SizedRef) error {
+		sr.sc.update(func(s *UploadStats) { s.Chunks++; s.ReusedChunks++ })
+		return fn(sb)
+	})
+}
+
+// FromReaderInfoStats is FromReaderInfo, returning the UploadStats, too.
+func (u *Uploader) FromReaderInfoStats(ctx context.Context, fi os.FileInfo, mime string, r io.Reader) (blob.Ref, UploadStats, error) {
+	ctx, sc := withStats(ctx)
+	br, err := u.fromReaderInfo(ctx, fi, mime, sc.reader(r), sc.statReceiver(u.StatReceiver))
+	return br, sc.Stats(), err
+}
+
+// UploadPathStats is UploadPath, returning the UploadStats, too.
+func (u *Uploader) UploadPathStats(ctx context.Context, path, mime string) (blob.Ref, UploadStats, error) {
+	ctx, sc := withStats(ctx)
+	br, err := u.UploadPath(ctx, path, mime)
+	return br, sc.Stats(), err
+}
+
+// UploadFileLazyAttrStats is UploadFileLazyAttr, returning the UploadStats of the content, too.
+func (u *Uploader) UploadFileLazyAttrStats(
+	ctx context.Context,
+	path, mime string,
+	attrs map[string]string,
+) (content, perma blob.Ref, stats UploadStats, err error) {
+	ctx, sc := withStats(ctx)
+	content, perma, err = u.UploadFileLazyAttr(ctx, path, mime, attrs)
+	return content, perma, sc.Stats(), err
+}
@@ -0,0 +1,47 @@
+// Copyright 2026 Tamás Gulácsi.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package camutil
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"perkeep.org/pkg/blob"
+)
+
+func TestStatsCollector(t *testing.T) {
+	t.Parallel()
+	ctx, sc := withStats(context.Background())
+	if _, sc2 := withStats(ctx); sc2 != sc {
+		t.Error("nested upload got a new collector")
+	}
+	if _, err := io.Copy(io.Discard, sc.reader(strings.NewReader("0123456789"))); err != nil {
+		t.Fatal(err)
+	}
+	var a, b blob.Ref
+	sr := sc.statReceiver(fakeStatReceiver{have: map[blob.Ref]bool{a: true}})
+	if err := sr.StatBlobs(ctx, []blob.Ref{a}, func(blob.SizedRef) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if got := sc.Stats(); !got.Existed() {
+		t.Errorf("%+v: not existed", got)
+	}
+	if _, err := sr.ReceiveBlob(ctx, b, strings.NewReader("abc")); err != nil {
+		t.Fatal(err)
+	}
+	want := UploadStats{TotalBytes: 10, NewBytes: 3, Chunks: 2, ReusedChunks: 1}
+	got := sc.Stats()
+	if got != want {
+		t.Errorf("got %+v, wanted %+v", got, want)
+	}
+	if got.Existed() {
+		t.Errorf("%+v: existed", got)
+	}
+	if (UploadStats{}).Existed() {
+		t.Error("empty stats existed")
+	}
+}
@@ -0,0 +1,301 @@
+// Copyright 2026 Tamás Gulácsi.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package camutil
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"perkeep.org/pkg/blob"
+	"perkeep.org/pkg/schema"
+)
+
+const (
+	// DefaultPrefetchDepth is the default number of chunks read ahead.
+	DefaultPrefetchDepth = 8
+	// DefaultPrefetchParallel is the default number of concurrent chunk fetches.
+	DefaultPrefetchParallel = 4
+)
+
+// WithPrefetch sets the read-ahead of the Downloader: at most depth chunks
+// are fetched ahead of the reader, parallel at a time.
+func WithPrefetch(depth, parallel int) Option {
+	return func(o *clientOptions) { o.PrefetchDepth, o.PrefetchParallel = depth, parallel }
+}
+
+// prefetch is the read-ahead of a StreamReader.
+type prefetch struct{ depth, parallel int }
+
+func (o clientOptions) prefetch() prefetch {
+	pf := prefetch{depth: o.PrefetchDepth, parallel: o.PrefetchParallel}
+	if pf.depth <= 0 {
+		pf.depth = DefaultPrefetchDepth
+	}
+	if pf.parallel <= 0 {
+		pf.parallel = DefaultPrefetchParallel
+	}
+	return pf
+}
+
+// StreamReader reads the contents of a file (or bytes) schema blob,
+// fetching only a bounded window of chunks ahead of the reader.
+//
+// Seek restarts the read-ahead at the new position (without fetching the
+// skipped chunks), so it can serve Range requests.
+// The fetches stop when the context is canceled, or the reader is closed.
+type StreamReader struct {
+	ctx      context.Context
+	f        blob.Fetcher
+	b        *schema.Blob
+	size     int64
+	prefetch prefetch
+
+	off   int64
+	pipe  *chunkPipe
+	cur   []byte
+	zeros int64
+	err   error
+}
+
+// chunkPipe is the read-ahead from one position: the walker sends the
+// chunks' futures in order on queue, at most depth of them ahead.
+type chunkPipe struct {
+	queue  chan *chunkFuture
+	sem    chan struct{}
+	cancel context.CancelFunc
+	err    error // set by the walker before closing queue
+}
+
+type chunkFuture struct {
+	done  chan struct{}
+	data  []byte
+	zeros int64
+	err   error
+}
+
+// newStreamReader returns a StreamReader for the file or bytes schema blob b.
+func newStreamReader(ctx context.Context, f blob.Fetcher, b *schema.Blob, pf prefetch) (*StreamReader, error) {
+	if t := b.Type(); t != "file" && t != "bytes" {
+		return nil, fmt.Errorf("%s: %w, but %q", b.BlobRef(), ErrNotFile, t)
+	}
+	pf = clientOptions{PrefetchDepth: pf.depth, PrefetchParallel: pf.parallel}.prefetch()
+	return &StreamReader{ctx: ctx, f: f, b: b, size: b.PartsSize(), prefetch: pf}, nil
+}
+
+// fetchSchemaBlob fetches and parses the schema blob br.
+func fetchSchemaBlob(ctx context.Context, f blob.Fetcher, br blob.Ref) (*schema.Blob, error) {
+	rc, err := fetch(ctx, f, br)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	b, err := schema.BlobFromReader(br, rc)
+	if err != nil {
+		return nil, fmt.Errorf("parse %s: %w: %w", br, ErrNotFile, err)
+	}
+	return b, nil
+}
+
+// Size returns the size of the file.
+func (sr *StreamReader) Size() int64 { return sr.size }
+
+// Read reads the next bytes of the file.
+func (sr *StreamReader) Read(p []byte) (int, error) {
+	if sr.err != nil {
+		return 0, sr.err
+	}
+	if sr.off >= sr.size {
+		return 0, io.EOF
+	}
+	for len(sr.cur) == 0 && sr.zeros == 0 {
+		if sr.pipe == nil {
+			sr.start()
+		}
+		fut, ok := <-sr.pipe.queue
+		if !ok {
+			if sr.err = sr.pipe.err; sr.err == nil {
+				sr.err = io.ErrUnexpectedEOF
+			}
+			return 0, sr.err
+		}
+		select {
+		case <-fut.done:
+		case <-sr.ctx.Done():
+			sr.err = sr.ctx.Err()
+			return 0, sr.err
+		}
+		if fut.err != nil {
+			sr.err = fut.err
+			return 0, sr.err
+		}
+		sr.cur, sr.zeros = fut.data, fut.zeros
+	}
+	var n int
+	if len(sr.cur) != 0 {
+		n = copy(p, sr.cur)
+		sr.cur = sr.cur[n:]
+	} else {
+		n = int(min(int64(len(p)), sr.zeros))
+		clear(p[:n])
+		sr.zeros -= int64(n)
+	}
+	sr.off += int64(n)
+	return n, nil
+}
+
+// Seek sets the position of the next Read.
+func (sr *StreamReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += sr.off
+	case io.SeekEnd:
+		offset += sr.size
+	default:
+		return sr.off, errors.New("seek: invalid whence")
+	}
+	if offset < 0 {
+		return sr.off, errors.New("seek: negative position")
+	}
+	if errors.Is(sr.err, os.ErrClosed) {
+		return sr.off, sr.err
+	}
+	if offset == sr.off && sr.err == nil {
+		return offset, nil
+	}
+	if d := offset - sr.off; d > 0 && d <= int64(len(sr.cur)) && sr.err == nil {
+		sr.cur = sr.cur[d:]
+	} else {
+		sr.stop()
+	}
+	sr.off, sr.err = offset, nil
+	return offset, nil
+}
+
+// Close stops the read-ahead.
+func (sr *StreamReader) Close() error {
+	sr.stop()
+	sr.err = os.ErrClosed
+	return nil
+}
+
+func (sr *StreamReader) stop() {
+	if sr.pipe != nil {
+		sr.pipe.cancel()
+		sr.pipe = nil
+	}
+	sr.cur, sr.zeros = nil, 0
+}
+
+// start starts the read-ahead from the current position.
+func (sr *StreamReader) start() {
+	ctx, cancel := context.WithCancel(sr.ctx)
+	p := &chunkPipe{
+		queue:  make(chan *chunkFuture, sr.prefetch.depth),
+		sem:    make(chan struct{}, sr.prefetch.parallel),
+		cancel: cancel,
+	}
+	sr.pipe = p
+	go func() {
+		defer close(p.queue)
+		p.err = p.walk(ctx, sr.f, sr.b, sr.off, sr.size)
+	}()
+}
+
+// walk sends the futures of the [from, to) bytes of b's contents.
+func (p *chunkPipe) walk(ctx context.Context, f blob.Fetcher, b *schema.Blob, from, to int64) error {
+	return forEachPart(ctx, f, b, from, to, func(part chunkPart) error {
+		fut := &chunkFuture{done: make(chan struct{})}
+		if !part.br.Valid() { // a hole
+			fut.zeros = part.hi - part.lo
+			close(fut.done)
+			return p.send(ctx, fut)
+		}
+		go func() {
+			defer close(fut.done)
+			select {
+			case p.sem <- struct{}{}:
+				defer func() { <-p.sem }()
+			case <-ctx.Done():
+				fut.err = ctx.Err()
+				return
+			}
+			fut.data, fut.err = fetchRange(ctx, f, part.br, part.lo, part.hi)
+		}()
+		return p.send(ctx, fut)
+	})
+}
+
+// chunkPart is the [lo, hi) bytes of the blob br - or hi-lo zeros if br is not valid.
+type chunkPart struct {
+	br     blob.Ref
+	lo, hi int64
+}
+
+// forEachPart calls fn with the chunk parts of the [from, to) bytes of b's
+// contents, in order. The parts before from are skipped without fetching them.
+func forEachPart(ctx context.Context, f blob.Fetcher, b *schema.Blob, from, to int64, fn func(chunkPart) error) error {
+	var pos int64
+	for _, part := range b.ByteParts() {
+		if pos >= to {
+			break
+		}
+		start, end := pos, pos+int64(part.Size)
+		pos = end
+		if end <= from {
+			continue
+		}
+		lo, hi := max(from, start)-start, min(to, end)-start
+		off := int64(part.Offset)
+		switch {
+		case part.BytesRef.Valid() && part.BlobRef.Valid():
+			return fmt.Errorf("part of %s contains both blobRef and bytesRef", b.BlobRef())
+		case part.BytesRef.Valid():
+			sub, err := fetchSchemaBlob(ctx, f, part.BytesRef)
+			if err != nil {
+				return err
+			}
+			if err = forEachPart(ctx, f, sub, off+lo, off+hi, fn); err != nil {
+				return err
+			}
+		default:
+			if err := fn(chunkPart{br: part.BlobRef, lo: off + lo, hi: off + hi}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (p *chunkPipe) send(ctx context.Context, fut *chunkFuture) error {
+	select {
+	case p.queue <- fut:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// fetchRange returns the [lo, hi) bytes of the blob br.
+func fetchRange(ctx context.Context, f blob.Fetcher, br blob.Ref, lo, hi int64) ([]byte, error) {
+	rc, err := fetch(ctx, f, br)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	if lo > 0 {
+		if _, err = io.CopyN(io.Discard, rc, lo); err != nil {
+			return nil, fmt.Errorf("read %s: %w", br, err)
+		}
+	}
+	data := make([]byte, hi-lo)
+	if _, err = io.ReadFull(rc, data); err != nil {
+		return nil, fmt.Errorf("read %s: %w", br, err)
+	}
+	return data, nil
+}
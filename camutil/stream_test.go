@@ -0,0 +1,70 @@
+// Copyright 2026 Tamás Gulácsi.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package camutil
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"testing"
+
+	"perkeep.org/pkg/blobserver/memory"
+	"perkeep.org/pkg/schema"
+)
+
+func TestStreamReader(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	data := make([]byte, 3<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+	var sto memory.Storage
+	br, err := schema.WriteFileFromReader(ctx, &sto, "data.bin", bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := fetchSchemaBlob(ctx, &sto, br)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sr, err := newStreamReader(ctx, &sto, b, prefetch{depth: 2, parallel: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sr.Close()
+	if sr.Size() != int64(len(data)) {
+		t.Fatalf("size: got %d, wanted %d", sr.Size(), len(data))
+	}
+
+	for _, tC := range []struct {
+		name     string
+		off, len int64
+	}{
+		{"all", 0, int64(len(data))},
+		{"head", 0, 100},
+		{"middle", 1<<20 + 17, 1 << 20},
+		{"tail", int64(len(data)) - 10, 10},
+		{"back", 5, 1000},
+	} {
+		if _, err := sr.Seek(tC.off, io.SeekStart); err != nil {
+			t.Fatalf("%s: %+v", tC.name, err)
+		}
+		got, err := io.ReadAll(io.LimitReader(sr, tC.len))
+		if err != nil {
+			t.Fatalf("%s: %+v", tC.name, err)
+		}
+		if want := data[tC.off : tC.off+tC.len]; !bytes.Equal(got, want) {
+			t.Errorf("%s: got %d bytes, mismatch", tC.name, len(got))
+		}
+	}
+
+	if _, err := sr.Seek(0, io.SeekEnd); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := sr.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+		t.Errorf("read at end: got %d, %v", n, err)
+	}
+}
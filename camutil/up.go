@@ -19,11 +19,9 @@ import (
 	"sync"
 	"time"
 
-	"github.com/ProtonMail/go-crypto/openpgp"
-	"github.com/ProtonMail/go-crypto/openpgp/armor"
 	"perkeep.org/pkg/blob"
 	"perkeep.org/pkg/blobserver"
-	"perkeep.org/pkg/blobserver/localdisk"
+	"perkeep.org/pkg/blobserver/memory"
 	"perkeep.org/pkg/client"
 	"perkeep.org/pkg/schema"
 )
@@ -40,6 +38,11 @@ type Uploader struct {
 	env           []string
 	mtx           sync.Mutex
 	skipHaveCache bool
+	progress      ProgressFunc
+	identity      *Identity
+	local         bool
+	pubKeyMu      sync.Mutex
+	pubKeyDone    bool
 }
 
 // ErrFileIsEmpty is the error for zero length files
@@ -62,25 +65,48 @@ func Close() error {
 		cachedDownloader[k].Close()
 		delete(cachedDownloader, k)
 	}
-	return nil
+	err := closeLocalStorages()
+	if hcErr := closeHaveCache(); hcErr != nil && err == nil {
+		err = hcErr
+	}
+	return err
 }
 
 // NewUploader returns a new uploader for uploading files to the given server
 func NewUploader(server string, options ...Option) *Uploader {
 	var opts clientOptions
 	opts.apply(options...)
-	key := fmt.Sprintf("%q\t%t\t%t", server, opts.CapCtime, opts.SkipHaveCache)
+	key := fmt.Sprintf("%q\t%t\t%t\t%q", server, opts.CapCtime, opts.SkipHaveCache, opts.Identity)
 	cachedUploaderMtx.Lock()
 	defer cachedUploaderMtx.Unlock()
 	u, ok := cachedUploader[key]
-	if ok {
+	if ok && opts.Progress == nil {
 		return u
 	}
+	if opts.Progress != nil {
+		key = "" // don't cache
+	}
 	maxProcs := runtime.GOMAXPROCS(-1)
-	if strings.HasPrefix(server, "file://") {
-		recv, err := localdisk.New(server[7:])
+	var id *Identity
+	var signer *schema.Signer
+	if opts.Identity != "" || IsLocalServer(server) {
+		var err error
+		if id, err = LoadIdentity(opts.Identity); err == nil {
+			signer, err = id.Signer()
+		}
 		if err != nil {
-			logger.Error("localdisk.New", "server", server, "error", err)
+			if opts.Identity != "" {
+				logger.Error("load identity", "identity", opts.Identity, "error", err)
+				return nil
+			}
+			logger.Warn("no identity, permanodes cannot be created", "server", server, "error", err)
+			id = nil
+		}
+	}
+	if IsLocalServer(server) {
+		recv, err := openLocalStorage(server)
+		if err != nil {
+			logger.Error("open local storage", "server", server, "error", err)
 			return nil
 		}
 		u = &Uploader{
@@ -88,9 +114,14 @@ func NewUploader(server string, options ...Option) *Uploader {
 			gate:          make(chan struct{}, maxProcs),
 			skipHaveCache: opts.SkipHaveCache,
 			StatReceiver:  recv,
-			Signer:        newDummySigner(),
+			local:         true,
+			Signer:        signer,
+			identity:      id,
+			progress:      opts.Progress,
+		}
+		if key != "" {
+			cachedUploader[key] = u
 		}
-		cachedUploader[key] = u
 		return u
 	}
 	c, err := NewClient(server, options...)
@@ -98,6 +129,14 @@ func NewUploader(server string, options ...Option) *Uploader {
 		logger.Info("NewClient", "server", server, "error", err)
 		return nil
 	}
+	var sr blobserver.StatReceiver = c
+	if !opts.SkipHaveCache {
+		if hcr, err := newHaveCacheReceiver(context.Background(), server, c, options...); err != nil {
+			logger.Warn("no persistent have-cache", "server", server, "error", err)
+		} else {
+			sr = hcr
+		}
+	}
 	u = &Uploader{
 		server:        server,
 		args:          make([]string, 1, 2),
@@ -105,7 +144,10 @@ func NewUploader(server string, options ...Option) *Uploader {
 		gate:          make(chan struct{}, maxProcs),
 		skipHaveCache: opts.SkipHaveCache,
 		Client:        c,
-		StatReceiver:  c,
+		StatReceiver:  sr,
+		Signer:        signer,
+		identity:      id,
+		progress:      opts.Progress,
 	}
 	u.args[0] = cmdPkPut
 	if server != "" {
@@ -125,14 +167,17 @@ func NewUploader(server string, options ...Option) *Uploader {
 			u.env = append(os.Environ(), "CAMLI_DEBUG=true")
 		}
 	}
-	cachedUploader[key] = u
+	if key != "" {
+		cachedUploader[key] = u
+	}
 	return u
 }
 
 // Close closes the Client/Storage.
+// The local storages are shared, and closed by the package-level Close.
 func (u *Uploader) Close() error {
 	var err error
-	if u.StatReceiver != nil {
+	if u.StatReceiver != nil && !u.local {
 		if cl, ok := u.StatReceiver.(io.Closer); ok {
 			err = cl.Close()
 		}
@@ -159,8 +204,8 @@ func (u *Uploader) UploadBytes(ctx context.Context, r io.Reader) (blob.Ref, erro
 		return blob.Ref{}, err
 	}
 	b := bb.Blob()
-	br, err := u.Client.UploadBlob(ctx, b)
-	return br.BlobRef, err
+	sb, err := blobserver.Receive(ctx, u.StatReceiver, b.BlobRef(), strings.NewReader(b.JSON()))
+	return sb.Ref, err
 }
 
 // FromReader uploads the contents of the io.Reader.
@@ -168,13 +213,15 @@ func (u *Uploader) FromReader(ctx context.Context, fileName string, r io.Reader)
 	if err := ctx.Err(); err != nil {
 		return blob.Ref{}, err
 	}
+	ctx, pr, done := u.startProgress(ctx, filepath.Base(fileName))
+	defer done()
 	select {
 	case u.gate <- struct{}{}:
 		defer func() { <-u.gate }()
 	case <-ctx.Done():
 		return blob.Ref{}, ctx.Err()
 	}
-	return schema.WriteFileFromReader(ctx, u.StatReceiver, filepath.Base(fileName), r)
+	return schema.WriteFileFromReader(ctx, pr.statReceiver(u.StatReceiver), filepath.Base(fileName), pr.reader(r))
 }
 
 // FromReaderInfo uploads the contents of r, wrapped with data from fi.
@@ -184,16 +231,37 @@ func (u *Uploader) FromReaderInfo(ctx context.Context, fi os.FileInfo, mime stri
 	if err := ctx.Err(); err != nil {
 		return blob.Ref{}, err
 	}
-	file := schema.NewCommonFileMap(filepath.Base(fi.Name()), fi)
-	file = file.CapCreationTime().SetRawStringField("mimeType", mime)
-	file = file.SetType("file")
+	br, _, err := u.FromReaderInfoStats(ctx, fi, mime, r)
+	return br, err
+}
+
+// fromReaderInfo uploads r through sr.
+func (u *Uploader) fromReaderInfo(ctx context.Context, fi os.FileInfo, mime string, r io.Reader, sr blobserver.StatReceiver) (blob.Ref, error) {
+	file := NewFileMap(fi, mime)
+	ctx, pr, done := u.startProgress(ctx, fi.Name())
+	defer done()
+	pr.update(false, func(p *Progress) { p.Size += fi.Size() })
 	select {
 	case u.gate <- struct{}{}:
 		defer func() { <-u.gate }()
 	case <-ctx.Done():
 		return blob.Ref{}, ctx.Err()
 	}
-	return schema.WriteFileMap(ctx, u.StatReceiver, file, r)
+	return schema.WriteFileMap(ctx, pr.statReceiver(sr), file, pr.reader(r))
+}
+
+// NewFileMap returns the "file" schema builder for fi, as FromReaderInfo uploads it.
+func NewFileMap(fi os.FileInfo, mime string) *schema.Builder {
+	file := schema.NewCommonFileMap(filepath.Base(fi.Name()), fi)
+	file = file.CapCreationTime().SetRawStringField("mimeType", mime)
+	return file.SetType("file")
+}
+
+// HashFileInfo returns the ref FromReaderInfo would return for the same
+// arguments, without uploading anything.
+func HashFileInfo(ctx context.Context, fi os.FileInfo, mime string, r io.Reader) (blob.Ref, error) {
+	var mem memory.Storage
+	return schema.WriteFileMap(ctx, &mem, NewFileMap(fi, mime), r)
 }
 
 // UploadFile uploads the given path (file or directory, recursively), and
@@ -206,19 +274,15 @@ func (u *Uploader) UploadFile(
 	if err = ctx.Err(); err != nil {
 		return
 	}
-	direct := u.StatReceiver != nil
-	if direct {
-		fi, err := os.Stat(path)
-		if err != nil {
-			return content, perma, err
-		}
-		direct = fi.Mode().IsRegular()
-	}
-	if !direct {
+	if u.StatReceiver == nil {
 		return u.UploadFileExt(ctx, path, permanode)
 	}
 
-	if content, err = u.UploadFileMIME(ctx, path, mime); !permanode || err != nil {
+	if content, err = u.UploadPath(ctx, path, mime); !permanode || err != nil {
+		return content, perma, err
+	}
+	if u.Signer != nil || u.Client == nil {
+		perma, err = u.NewPermanode(ctx, map[string]string{"camliContent": content.String()})
 		return content, perma, err
 	}
 	pbRes, err := u.Client.UploadPlannedPermanode(ctx, content.String(), time.Now())
@@ -241,23 +305,16 @@ func (u *Uploader) UploadFileLazyAttr(
 	path, mime string,
 	attrs map[string]string,
 ) (content, perma blob.Ref, err error) {
+	logger := loggerFromContext(ctx)
 	if err = ctx.Err(); err != nil {
 		return
 	}
-	direct := u.StatReceiver != nil
-	if direct {
-		fi, err := os.Stat(path)
-		if err != nil {
-			return content, perma, err
-		}
-		direct = fi.Mode().IsRegular()
-	}
-	if !direct {
+	if u.StatReceiver == nil {
 		return u.UploadFileExtLazyAttr(ctx, path, attrs)
 	}
 
 	filteredAttrs := filterAttrs("camli", attrs)
-	if content, err = u.UploadFileMIME(ctx, path, mime); len(filteredAttrs) == 0 || err != nil {
+	if content, err = u.UploadPath(ctx, path, mime); len(filteredAttrs) == 0 || err != nil {
 		return content, perma, err
 	}
 
@@ -278,6 +335,7 @@ func (u *Uploader) UploadReaderInfoLazyAttr(
 	fi os.FileInfo, mime string, r io.Reader,
 	attrs map[string]string,
 ) (content, perma blob.Ref, err error) {
+	logger := loggerFromContext(ctx)
 	if err = ctx.Err(); err != nil {
 		return
 	}
@@ -305,41 +363,86 @@ func filterAttrs(skipPrefix string, attrs map[string]string) map[string]string {
 
 // NewPermanode returns a new random permanode and sets the given attrs on it.
 // Returns the permanode, and the error.
+//
+// The claims are signed with the identity given WithIdentity, or the client's
+// configured identity. Without any, ErrNoIdentity is returned.
 func (u *Uploader) NewPermanode(ctx context.Context, attrs map[string]string) (blob.Ref, error) {
+	logger := loggerFromContext(ctx)
 	if err := ctx.Err(); err != nil {
 		return blob.Ref{}, err
 	}
-	if u.Client != nil {
+	var perma blob.Ref
+	switch {
+	case u.Signer != nil:
+		var err error
+		if perma, err = u.uploadSigned(ctx, schema.NewUnsignedPermanode()); err != nil {
+			logger.Error("upload permanode", "error", err)
+			return blob.Ref{}, err
+		}
+	case u.Client != nil:
 		pRes, err := u.Client.UploadNewPermanode(ctx)
 		if err != nil {
 			logger.Error("UploadNewPermanode", "error", err)
 			return blob.Ref{}, err
 		}
-		if len(attrs) > 0 {
-			err = u.SetPermanodeAttrs(ctx, pRes.BlobRef, attrs)
-		}
-		return pRes.BlobRef, err
-	}
-	if u.Signer != nil { //nolint:govet
-		signed, err := schema.NewUnsignedPermanode().Sign(ctx, u.Signer)
-		if err != nil {
-			logger.Error("Sign", "signer", u.Signer, "error", err)
+		perma = pRes.BlobRef
+	case u.StatReceiver != nil:
+		return blob.Ref{}, fmt.Errorf("new permanode: %w", ErrNoIdentity)
+	default:
+		refs, err := u.camput(ctx, "permanode")
+		if err != nil || len(refs) == 0 {
 			return blob.Ref{}, err
 		}
-		return blob.RefFromString(signed), err
+		perma = refs[0]
 	}
-	refs, err := u.camput(ctx, "permanode")
-	if err != nil || len(refs) == 0 {
-		return blob.Ref{}, err
+	if len(attrs) == 0 {
+		return perma, nil
 	}
-	err = u.SetPermanodeAttrs(ctx, refs[0], attrs)
-	return refs[0], err
+	return perma, u.SetPermanodeAttrs(ctx, perma, attrs)
+}
+
+// uploadSigned signs the schema blob with the Uploader's identity, and uploads it
+// (with the public key, for the first time).
+func (u *Uploader) uploadSigned(ctx context.Context, bb *schema.Builder) (blob.Ref, error) {
+	if err := u.uploadPublicKey(ctx); err != nil {
+		return blob.Ref{}, fmt.Errorf("upload public key: %w", err)
+	}
+	signed, err := bb.Sign(ctx, u.Signer)
+	if err != nil {
+		return blob.Ref{}, fmt.Errorf("sign: %w", err)
+	}
+	br := blob.RefFromString(signed)
+	if _, err = blobserver.Receive(ctx, u.StatReceiver, br, strings.NewReader(signed)); err != nil {
+		return br, err
+	}
+	return br, nil
+}
+
+// uploadPublicKey uploads the public key of the identity, till it succeeds:
+// the failure (a canceled request, a network error) is not remembered.
+func (u *Uploader) uploadPublicKey(ctx context.Context) error {
+	u.pubKeyMu.Lock()
+	defer u.pubKeyMu.Unlock()
+	if u.pubKeyDone || u.identity == nil {
+		return nil
+	}
+	if _, err := u.identity.UploadPublicKey(ctx, u.StatReceiver); err != nil {
+		return err
+	}
+	u.pubKeyDone = true
+	return nil
 }
 
 // SetPermanodeAttrs sets the attributes on the given permanode.
 func (u *Uploader) SetPermanodeAttrs(ctx context.Context, perma blob.Ref, attrs map[string]string) error {
+	logger := loggerFromContext(ctx)
 	var setAttr func(k, v string) (blob.Ref, error)
-	if u.Client != nil {
+	switch {
+	case u.Signer != nil:
+		setAttr = func(k, v string) (blob.Ref, error) {
+			return u.uploadSigned(ctx, schema.NewSetAttributeClaim(perma, k, v))
+		}
+	case u.Client != nil:
 		setAttr = func(k, v string) (blob.Ref, error) {
 			pRes, err := u.Client.UploadAndSignBlob(ctx, schema.NewSetAttributeClaim(perma, k, v))
 			if err != nil {
@@ -347,7 +450,9 @@ func (u *Uploader) SetPermanodeAttrs(ctx context.Context, perma blob.Ref, attrs
 			}
 			return pRes.BlobRef, nil
 		}
-	} else {
+	case u.StatReceiver != nil:
+		return fmt.Errorf("set attributes: %w", ErrNoIdentity)
+	default:
 		pS := perma.String()
 		setAttr = func(k, v string) (blob.Ref, error) {
 			refs, err := u.camput(ctx, "attr", pS, k, v)
@@ -386,9 +491,12 @@ func (u *Uploader) UploadFileMIME(ctx context.Context, fileName, mimeType string
 	return br, err
 }
 
-// UploadFileExt uploads the given path (file or directory, recursively), and
-// returns the content ref, the permanode ref (if you asked for it), and error
+// UploadFileExt uploads the given path (file or directory, recursively) by calling
+// pk-put (or camput), and returns the content ref, the permanode ref (if you asked for it), and error.
+//
+// UploadFile and UploadFileLazyAttr use UploadPath, which needs no external binary.
 func (u *Uploader) UploadFileExt(ctx context.Context, path string, permanode bool) (content, perma blob.Ref, err error) {
+	logger := loggerFromContext(ctx)
 	logger.Info("UploadFileExt", "path", path, "permanode", permanode)
 	fh, err := os.Open(path)
 	if err != nil {
@@ -422,6 +530,7 @@ func (u *Uploader) UploadFileExt(ctx context.Context, path string, permanode boo
 // UploadFileExtLazyAttr uploads the given path (file or directory, recursively), and
 // returns the content ref, the permanode ref (iff you added attributes).
 func (u *Uploader) UploadFileExtLazyAttr(ctx context.Context, path string, attrs map[string]string) (content, perma blob.Ref, err error) {
+	logger := loggerFromContext(ctx)
 	logger.Info("UploadFileExtLazyAttr", "path", path, "attrs", attrs)
 	filteredAttrs := filterAttrs("camli", attrs)
 	content, perma, err = u.UploadFileExt(ctx, path, len(filteredAttrs) > 0)
@@ -434,6 +543,7 @@ func (u *Uploader) UploadFileExtLazyAttr(ctx context.Context, path string, attrs
 }
 
 func (u *Uploader) camput(ctx context.Context, mode string, modeArgs ...string) ([]blob.Ref, error) {
+	logger := loggerFromContext(ctx)
 	args := make([]string, 0, len(u.args)+1+len(u.opts)+len(modeArgs)+1)
 	args = append(append(append(args, u.args...), mode), u.opts...)
 	var dir string
@@ -547,66 +657,6 @@ func RefToBase64(br blob.Ref) string {
 	return buf.String()
 }
 
-func newDummySigner() *schema.Signer { //nolint:deadcode
-	var privateKeySource *openpgp.Entity
-	for _, fn := range []string{
-		"$HOME/.config/camlistore/identity-secring.gpg",
-		"$HOME/.gnupg/secring.gpg",
-	} {
-		fh, err := os.Open(os.ExpandEnv(fn))
-		if err != nil {
-			logger.Error("open", "file", fn, "error", err)
-			continue
-		}
-		el, err := openpgp.ReadKeyRing(fh)
-		fh.Close()
-		if err != nil {
-			logger.Error("ReadKeyRing", "file", fh.Name(), "error", err)
-			continue
-		}
-		for _, e := range el {
-			if e.PrivateKey == nil {
-				continue
-			}
-			privateKeySource = e
-			break
-		}
-		if privateKeySource != nil {
-			break
-		}
-	}
-	if privateKeySource == nil {
-		var err error
-		if privateKeySource, err = openpgp.NewEntity(
-			"camutil", "test", "camutil@camlistore.org", nil,
-		); err != nil {
-			logger.Error("openpgp.NewEntity", "error", err)
-			return nil
-		}
-	}
-	var buf bytes.Buffer
-	hsh := blob.RefFromString("").Hash()
-	w, err := armor.Encode(io.MultiWriter(&buf, hsh), "PGP PUBLIC KEY BLOCK", nil)
-	if err != nil {
-		logger.Error("armor", "error", err)
-		return nil
-	}
-	if err = privateKeySource.PrimaryKey.Serialize(w); err != nil {
-		logger.Error("serialize", "error", err)
-	}
-	_ = w.Close()
-
-	pubKeyRef := blob.RefFromHash(hsh)
-	armoredPubKey := bytes.NewReader(buf.Bytes())
-
-	signer, err := schema.NewSigner(pubKeyRef, armoredPubKey, privateKeySource)
-	if err != nil {
-		logger.Error("newDummySigner", "pubkey", pubKeyRef, "pubkey", armoredPubKey, "privatekey", privateKeySource, "error", err)
-		return nil
-	}
-	return signer
-}
-
 var cmdPkPut = "pk-put"
 
 func init() {
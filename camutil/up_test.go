@@ -6,9 +6,17 @@ package camutil
 
 import (
 	"context"
+	"fmt"
+	"io"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"perkeep.org/pkg/blob"
+	"perkeep.org/pkg/blobserver"
 
 	"github.com/UNO-SOFT/zlog/v2"
 )
@@ -22,7 +30,11 @@ func TestNewPermanode(t *testing.T) {
 
 	logger = zlog.NewT(t).SLog()
 
-	u := NewUploader("file://"+tempDir, WithCapCtime(true), WithSkipHaveCache(true))
+	keyring := filepath.Join(t.TempDir(), "secring.gpg")
+	if _, err = GenerateIdentity(keyring, "test", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	u := NewUploader("file://"+tempDir, WithCapCtime(true), WithSkipHaveCache(true), WithIdentity(keyring))
 	defer u.Close()
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -37,3 +49,196 @@ func TestNewPermanode(t *testing.T) {
 	}
 	t.Logf("permaKey=%v", permaKey)
 }
+
+func TestUploadPath(t *testing.T) {
+	tempDir := t.TempDir()
+	logger = zlog.NewT(t).SLog()
+
+	src := filepath.Join(tempDir, "src")
+	for _, dn := range []string{"a", filepath.Join("a", "b"), "c"} {
+		if err := os.MkdirAll(filepath.Join(src, dn), 0750); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for fn, content := range map[string]string{
+		"x.txt":                          "x",
+		filepath.Join("a", "y.txt"):      "y",
+		filepath.Join("a", "b", "z.txt"): "zzz",
+		filepath.Join("c", "empty"):      "",
+	} {
+		if err := os.WriteFile(filepath.Join(src, fn), []byte(content), 0640); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("x.txt", filepath.Join(src, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	u := NewUploader("file://"+filepath.Join(tempDir, "blobs"), WithSkipHaveCache(true))
+	defer u.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	root, err := u.UploadPath(ctx, src, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := u.UploadPath(ctx, src, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root != again {
+		t.Errorf("uploading the same tree twice: got %v and %v", root, again)
+	}
+	t.Logf("root=%v", root)
+
+	down, err := NewDownloader("file://"+filepath.Join(tempDir, "blobs"), WithNoCache(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	list, err := down.ReadDir(ctx, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make([]string, len(list))
+	for i, e := range list {
+		names[i] = e.Name
+	}
+	if got, want := strings.Join(names, " "), "a c link x.txt"; got != want {
+		t.Errorf("root: got %q, wanted %q", got, want)
+	}
+	for i, elt := range []struct {
+		Path, Type, Target string
+		Size               int64
+	}{
+		{Path: "x.txt", Type: "file", Size: 1},
+		{Path: "a", Type: "directory"},
+		{Path: "a/y.txt", Type: "file", Size: 1},
+		{Path: "a/b/z.txt", Type: "file", Size: 3},
+		{Path: "c/empty", Type: "file"},
+		{Path: "link", Type: "symlink", Target: "x.txt"},
+	} {
+		e, err := down.Lookup(ctx, root, elt.Path)
+		if err != nil {
+			t.Errorf("%d. %q: %+v", i, elt.Path, err)
+			continue
+		}
+		if e.Name != filepath.Base(elt.Path) || e.Type != elt.Type || e.Size != elt.Size || e.Target != elt.Target {
+			t.Errorf("%d. %q: got %+v, wanted %+v", i, elt.Path, e, elt)
+		}
+	}
+}
+
+// concurrencyReceiver counts the concurrent calls of the wrapped StatReceiver.
+type concurrencyReceiver struct {
+	blobserver.StatReceiver
+	cur, peak atomic.Int64
+}
+
+func (cr *concurrencyReceiver) enter() func() {
+	n := cr.cur.Add(1)
+	for {
+		if p := cr.peak.Load(); n <= p || cr.peak.CompareAndSwap(p, n) {
+			break
+		}
+	}
+	time.Sleep(time.Millisecond) // let the others catch up
+	return func() { cr.cur.Add(-1) }
+}
+
+func (cr *concurrencyReceiver) ReceiveBlob(ctx context.Context, br blob.Ref, r io.Reader) (blob.SizedRef, error) {
+	defer cr.enter()()
+	return cr.StatReceiver.ReceiveBlob(ctx, br, r)
+}
+
+func (cr *concurrencyReceiver) StatBlobs(ctx context.Context, blobs []blob.Ref, fn func(blob.SizedRef) error) error {
+	defer cr.enter()()
+	return cr.StatReceiver.StatBlobs(ctx, blobs, fn)
+}
+
+func TestUploadPathWide(t *testing.T) {
+	tempDir := t.TempDir()
+	logger = zlog.NewT(t).SLog()
+
+	src := filepath.Join(tempDir, "src")
+	for i := range 300 {
+		dn := filepath.Join(src, fmt.Sprintf("d%03d", i))
+		if err := os.MkdirAll(dn, 0750); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dn, "f.txt"), []byte(dn), 0640); err != nil {
+			t.Fatal(err)
+		}
+	}
+	u := NewUploader("file://"+filepath.Join(tempDir, "blobs"), WithSkipHaveCache(true))
+	defer u.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cr := &concurrencyReceiver{StatReceiver: u.StatReceiver}
+	u.StatReceiver = cr
+	if _, err := u.UploadPath(ctx, src, ""); err != nil {
+		t.Fatal(err)
+	}
+	// the file uploads are limited by the gate, the directory blobs are
+	// uploaded by the walkers (limited the same) and the first goroutine
+	if limit := int64(2*cap(u.gate) + 1); cr.peak.Load() > limit {
+		t.Errorf("%d concurrent blob operations for 300 directories, wanted at most %d", cr.peak.Load(), limit)
+	}
+}
+
+func TestLocalServer(t *testing.T) {
+	logger = zlog.NewT(t).SLog()
+	keyring := filepath.Join(t.TempDir(), "secring.gpg")
+	if _, err := GenerateIdentity(keyring, "test", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	fn := filepath.Join(t.TempDir(), "test.txt")
+	if err := os.WriteFile(fn, []byte("something"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	for _, scheme := range []string{"file://", "badger://"} {
+		t.Run(strings.TrimSuffix(scheme, "://"), func(t *testing.T) {
+			server := scheme + filepath.Join(t.TempDir(), "blobs")
+			u := NewUploader(server, WithSkipHaveCache(true), WithIdentity(keyring))
+			if u == nil {
+				t.Fatal("no uploader")
+			}
+			defer u.Close()
+			defer Close()
+
+			if _, err := u.UploadBytes(ctx, strings.NewReader("bytes")); err != nil {
+				t.Errorf("UploadBytes: %+v", err)
+			}
+			content, perma, err := u.UploadFile(ctx, fn, "", true)
+			if err != nil {
+				t.Fatalf("UploadFile: %+v", err)
+			}
+			if !content.Valid() || !perma.Valid() {
+				t.Fatalf("UploadFile: got content=%v perma=%v", content, perma)
+			}
+			if err = u.SetPermanodeAttrs(ctx, perma, map[string]string{"title": "test"}); err != nil {
+				t.Errorf("SetPermanodeAttrs: %+v", err)
+			}
+
+			down, err := NewDownloader(server)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rc, _, err := down.Fetch(ctx, perma)
+			if err != nil {
+				t.Fatalf("fetch permanode %v: %+v", perma, err)
+			}
+			b, err := io.ReadAll(rc)
+			rc.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(string(b), `"camliType": "permanode"`) || !strings.Contains(string(b), "camliSig") {
+				t.Errorf("permanode %v is not a signed permanode: %s", perma, b)
+			}
+		})
+	}
+}
@@ -0,0 +1,175 @@
+// Copyright 2026 Tamás Gulácsi.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package camutil
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"perkeep.org/pkg/blob"
+	"perkeep.org/pkg/blobserver"
+	"perkeep.org/pkg/schema"
+)
+
+// UploadPath uploads the given path: a regular file with the given MIME type,
+// or a directory recursively, as pk-put would, without calling it.
+// Returns the root ref ("file" or "directory" schema blob).
+func (u *Uploader) UploadPath(ctx context.Context, path, mime string) (blob.Ref, error) {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return blob.Ref{}, err
+	}
+	if fi.Mode().IsRegular() {
+		return u.UploadFileMIME(ctx, path, mime)
+	}
+	ctx, _, done := u.startProgress(ctx, fi.Name())
+	defer done()
+	du := dirUploader{Uploader: u,
+		sem:     make(chan struct{}, cap(u.gate)),
+		workers: make(chan struct{}, cap(u.gate)),
+	}
+	return du.upload(ctx, path, fi)
+}
+
+// dirUploader uploads a tree, with the file uploads limited by sem,
+// and the extra goroutines walking the tree by workers.
+type dirUploader struct {
+	*Uploader
+	sem, workers chan struct{}
+}
+
+func (du dirUploader) upload(ctx context.Context, path string, fi os.FileInfo) (blob.Ref, error) {
+	if err := ctx.Err(); err != nil {
+		return blob.Ref{}, err
+	}
+	mode := fi.Mode()
+	switch {
+	case mode.IsRegular():
+		select {
+		case du.sem <- struct{}{}:
+			defer func() { <-du.sem }()
+		case <-ctx.Done():
+			return blob.Ref{}, ctx.Err()
+		}
+		return du.UploadFileMIME(ctx, path, "")
+
+	case mode.IsDir():
+		return du.uploadDir(ctx, path, fi)
+	}
+
+	m := schema.NewCommonFileMap(path, fi)
+	switch {
+	case mode&os.ModeSymlink != 0:
+		target, err := os.Readlink(path)
+		if err != nil {
+			return blob.Ref{}, err
+		}
+		m.SetType("symlink")
+		m.SetSymlinkTarget(target)
+	case mode&os.ModeNamedPipe != 0:
+		m.SetType("fifo")
+	case mode&os.ModeSocket != 0:
+		m.SetType("socket")
+	default:
+		return blob.Ref{}, fmt.Errorf("%q: unsupported file type %v", path, mode.Type())
+	}
+	return du.uploadSchema(ctx, m.Blob())
+}
+
+// uploadDir uploads the entries of the directory concurrently, then the
+// static-set of them and the directory blob.
+//
+// An entry gets its own goroutine only if a worker slot is free, else it is
+// uploaded in the current goroutine - this bounds the goroutines (and the
+// concurrent ReadDirs) without deadlocking on the nested directories.
+func (du dirUploader) uploadDir(ctx context.Context, path string, fi os.FileInfo) (blob.Ref, error) {
+	logger := loggerFromContext(ctx)
+	des, err := os.ReadDir(path)
+	if err != nil {
+		return blob.Ref{}, err
+	}
+	members := make([]blob.Ref, len(des))
+	var wg sync.WaitGroup
+	var errOnce sync.Once
+	var firstErr error
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	work := func(i int, fn string) {
+		fi, err := os.Lstat(fn)
+		if err == nil {
+			members[i], err = du.upload(ctx, fn, fi)
+		}
+		if err != nil {
+			errOnce.Do(func() {
+				firstErr = fmt.Errorf("upload %q: %w", fn, err)
+				cancel()
+			})
+		}
+	}
+	for i, de := range des {
+		if ctx.Err() != nil {
+			break
+		}
+		fn := filepath.Join(path, de.Name())
+		if irregular(de.Type()) && SkipIrregular {
+			logger.Debug("skip irregular", "path", fn, "type", de.Type())
+			continue
+		}
+		select {
+		case du.workers <- struct{}{}:
+			wg.Add(1)
+			go func(i int, fn string) {
+				defer func() { <-du.workers; wg.Done() }()
+				work(i, fn)
+			}(i, fn)
+		default:
+			work(i, fn)
+		}
+	}
+	wg.Wait()
+	if firstErr == nil && ctx.Err() != nil {
+		firstErr = ctx.Err()
+	}
+	if firstErr != nil {
+		return blob.Ref{}, firstErr
+	}
+	refs := members[:0]
+	for _, br := range members {
+		if br.Valid() {
+			refs = append(refs, br)
+		}
+	}
+
+	ss := schema.NewStaticSet()
+	for _, sub := range ss.SetStaticSetMembers(refs) {
+		if _, err = du.uploadSchema(ctx, sub); err != nil {
+			return blob.Ref{}, err
+		}
+	}
+	ssRef, err := du.uploadSchema(ctx, ss.Blob())
+	if err != nil {
+		return blob.Ref{}, err
+	}
+	return du.uploadSchema(ctx, schema.NewCommonFileMap(path, fi).PopulateDirectoryMap(ssRef).Blob())
+}
+
+// uploadSchema uploads the schema blob b.
+func (u *Uploader) uploadSchema(ctx context.Context, b *schema.Blob) (blob.Ref, error) {
+	sr := u.StatReceiver
+	if sc, ok := ctx.Value(ctxKeyStats{}).(*statsCollector); ok {
+		sr = sc.statReceiver(sr)
+	}
+	sb, err := blobserver.Receive(ctx, sr, b.BlobRef(), strings.NewReader(b.JSON()))
+	return sb.Ref, err
+}
+
+// irregular reports whether the type is not a regular file nor a directory.
+func irregular(typ os.FileMode) bool {
+	return typ&(os.ModeSymlink|os.ModeNamedPipe|os.ModeSocket|os.ModeDevice|os.ModeCharDevice|os.ModeIrregular) != 0
+}
@@ -0,0 +1,115 @@
+// Copyright 2026 Tamás Gulácsi.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package camutil
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"perkeep.org/pkg/blob"
+)
+
+// WithVerify makes the Downloader hash every fetched blob against its ref.
+func WithVerify(b bool) Option { return func(o *clientOptions) { o.Verify = b } }
+
+// NewVerifyingFetcher returns a fetcher which hashes every blob fetched from f
+// against its ref. If f is a *BadgerCache, a bad cached blob is evicted and
+// fetched again from the origin.
+// Blobs still not matching their refs are a *DownloadError of ErrCorrupt.
+func NewVerifyingFetcher(f blob.Fetcher) blob.Fetcher {
+	if vf, ok := f.(verifyingFetcher); ok {
+		return vf
+	}
+	return verifyingFetcher{f: f}
+}
+
+type verifyingFetcher struct {
+	f blob.Fetcher
+}
+
+func (vf verifyingFetcher) Fetch(ctx context.Context, br blob.Ref) (io.ReadCloser, uint32, error) {
+	data, err := fetchAll(ctx, vf.f, br)
+	if err != nil {
+		return nil, 0, err
+	}
+	if !hashMatches(br, data) {
+		logger := loggerFromContext(ctx)
+		dc, ok := vf.f.(*BadgerCache)
+		if !ok {
+			return nil, 0, corruptError(br)
+		}
+		logger.Warn("corrupt cached blob, fetching again", "blob", br, "root", dc.Root)
+		if data, err = dc.refetch(ctx, br); err != nil {
+			return nil, 0, err
+		}
+		if !hashMatches(br, data) {
+			return nil, 0, corruptError(br)
+		}
+		if err = dc.store(ctx, br, data); err != nil {
+			logger.Warn("store in cache", "blob", br, "error", err)
+		}
+	}
+	return io.NopCloser(bytes.NewReader(data)), uint32(len(data)), nil
+}
+
+func hashMatches(br blob.Ref, data []byte) bool {
+	h := br.Hash()
+	if h == nil {
+		return false
+	}
+	h.Write(data)
+	return br.HashMatches(h)
+}
+
+func corruptError(br blob.Ref) *DownloadError {
+	return &DownloadError{Ref: br, Kind: ErrCorrupt, Err: errors.New("hash mismatch")}
+}
+
+// VerifyResult is the result of VerifyTree.
+type VerifyResult struct {
+	// Blobs is the number of good blobs, Bytes is their size.
+	Blobs int
+	Bytes int64
+	// Missing, Corrupt and Failed (transport error) are the bad blobs.
+	Missing, Corrupt, Failed []blob.Ref
+}
+
+// OK reports whether all the blobs are good.
+func (vr VerifyResult) OK() bool {
+	return len(vr.Missing) == 0 && len(vr.Corrupt) == 0 && len(vr.Failed) == 0
+}
+
+// VerifyTree fetches br and all the blobs it references (see WalkBlobs)
+// from f, verifying their hashes. The error is nil even if there are bad
+// blobs, unless ctx is canceled.
+func VerifyTree(ctx context.Context, f blob.Fetcher, br blob.Ref) (VerifyResult, error) {
+	var vr VerifyResult
+	err := WalkBlobs(ctx, NewVerifyingFetcher(f), br, func(sb blob.SizedRef, err error) error {
+		if err == nil {
+			vr.Blobs++
+			vr.Bytes += int64(sb.Size)
+			return nil
+		}
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		switch classifyError(err) {
+		case ErrNotFound:
+			vr.Missing = append(vr.Missing, sb.Ref)
+		case ErrCorrupt:
+			vr.Corrupt = append(vr.Corrupt, sb.Ref)
+		default:
+			vr.Failed = append(vr.Failed, sb.Ref)
+		}
+		return nil
+	})
+	if err != nil {
+		return vr, fmt.Errorf("verify %s: %w", br, err)
+	}
+	return vr, nil
+}
@@ -0,0 +1,63 @@
+// Copyright 2026 Tamás Gulácsi.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package camutil
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"testing"
+
+	"perkeep.org/pkg/blob"
+)
+
+type mapFetcher map[blob.Ref]string
+
+func (m mapFetcher) Fetch(ctx context.Context, br blob.Ref) (io.ReadCloser, uint32, error) {
+	s, ok := m[br]
+	if !ok {
+		return nil, 0, os.ErrNotExist
+	}
+	return io.NopCloser(bytes.NewReader([]byte(s))), uint32(len(s)), nil
+}
+
+func TestVerifyingFetcher(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	good, bad, missing := blob.RefFromString("good"), blob.RefFromString("bad"), blob.RefFromString("missing")
+	f := NewVerifyingFetcher(mapFetcher{good: "good", bad: "not bad"})
+	for _, tC := range []struct {
+		name string
+		br   blob.Ref
+		kind error
+	}{
+		{"good", good, nil},
+		{"bad", bad, ErrCorrupt},
+		{"missing", missing, ErrNotFound},
+	} {
+		_, _, err := f.Fetch(ctx, tC.br)
+		if tC.kind == nil {
+			if err != nil {
+				t.Errorf("%s: %+v", tC.name, err)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("%s: no error", tC.name)
+		} else if got := classifyError(err); !errors.Is(got, tC.kind) {
+			t.Errorf("%s: got %v, wanted %v", tC.name, got, tC.kind)
+		}
+	}
+
+	vr, err := VerifyTree(ctx, mapFetcher{bad: "not bad"}, bad)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vr.OK() || len(vr.Corrupt) != 1 || vr.Corrupt[0] != bad {
+		t.Errorf("VerifyTree: got %+v", vr)
+	}
+}
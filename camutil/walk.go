@@ -0,0 +1,81 @@
+// Copyright 2026 Tamás Gulácsi.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package camutil
+
+import (
+	"bytes"
+	"context"
+	"io"
+
+	"perkeep.org/pkg/blob"
+	"perkeep.org/pkg/schema"
+)
+
+// WalkBlobs fetches br from f, and if it is a schema blob, the blobs it
+// references, recursively: the parts of a file, the entries of a directory,
+// the members of a static set.
+//
+// fn is called for each blob with its fetch error - the walk continues
+// (without the references of the failed blob) if fn returns nil.
+func WalkBlobs(ctx context.Context, f blob.Fetcher, br blob.Ref, fn func(blob.SizedRef, error) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	data, err := fetchAll(ctx, f, br)
+	if err = fn(blob.SizedRef{Ref: br, Size: uint32(len(data))}, err); err != nil || data == nil {
+		return err
+	}
+	if !bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		return nil
+	}
+	b, err := schema.BlobFromReader(br, bytes.NewReader(data))
+	if err != nil {
+		return nil // not a schema blob
+	}
+	for _, ref := range schemaRefs(b) {
+		if err = WalkBlobs(ctx, f, ref, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// schemaRefs returns the blobs referenced by the schema blob b.
+func schemaRefs(b *schema.Blob) []blob.Ref {
+	var refs []blob.Ref
+	switch b.Type() {
+	case "file", "bytes":
+		for _, part := range b.ByteParts() {
+			if part.BlobRef.Valid() {
+				refs = append(refs, part.BlobRef)
+			}
+			if part.BytesRef.Valid() {
+				refs = append(refs, part.BytesRef)
+			}
+		}
+	case "directory":
+		if ss, ok := b.DirectoryEntries(); ok {
+			refs = append(refs, ss)
+		}
+	case "static-set":
+		refs = append(refs, b.StaticSetMembers()...)
+		refs = append(refs, b.StaticSetMergeSets()...)
+	}
+	return refs
+}
+
+// fetchAll returns the contents of the blob br - nil on error.
+func fetchAll(ctx context.Context, f blob.Fetcher, br blob.Ref) ([]byte, error) {
+	rc, err := fetch(ctx, f, br)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
@@ -0,0 +1,425 @@
+// Copyright 2026 Tamás Gulácsi.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/UNO-SOFT/zlog/v2"
+	"github.com/tgulacsi/camproxy/camutil"
+	"golang.org/x/net/webdav"
+	"perkeep.org/pkg/blob"
+)
+
+// newDAVHandler returns the WebDAV handler of the stored trees, mounted at prefix.
+//
+// PROPFIND is allowed with Depth 0 or 1 only.
+// Without write, just the reading methods are allowed;
+// with it, PUT uploads the file, and creates a permanode for it,
+// with the path recorded in the "path" attribute.
+func newDAVHandler(prefix string, write bool) http.Handler {
+	h := &webdav.Handler{
+		Prefix:     prefix,
+		FileSystem: davFS{write: write},
+		LockSystem: webdav.NewMemLS(),
+		Logger: func(r *http.Request, err error) {
+			if err != nil {
+				zlog.SFromContext(r.Context()).Info("dav", "method", r.Method, "path", r.URL.Path, "error", err)
+			}
+		},
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "PROPFIND":
+			// listing a whole tree is too expensive - a missing Depth means infinity, too
+			if d := r.Header.Get("Depth"); d != "0" && d != "1" {
+				w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+				w.WriteHeader(http.StatusForbidden)
+				_, _ = io.WriteString(w, `<?xml version="1.0" encoding="utf-8"?>`+
+					`<D:error xmlns:D="DAV:"><D:propfind-finite-depth/></D:error>`)
+				return
+			}
+		case "GET", "HEAD", "OPTIONS":
+		case "PUT", "LOCK", "UNLOCK":
+			if write {
+				break
+			}
+			fallthrough
+		default:
+			http.Error(w, r.Method+" is not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// davFS is the webdav.FileSystem of the stored trees:
+// /<ref> is the directory tree or file ref, or the permanode ref:
+// the collection of its camliMember members (named by their title,
+// or the file name of their camliContent), or its camliContent.
+//
+// The root can't be listed, as there are too many blobs.
+type davFS struct {
+	write bool
+}
+
+var _ = webdav.FileSystem(davFS{})
+
+func (davFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	return os.ErrPermission
+}
+func (davFS) RemoveAll(ctx context.Context, name string) error { return os.ErrPermission }
+func (davFS) Rename(ctx context.Context, oldName, newName string) error {
+	return os.ErrPermission
+}
+
+func (dfs davFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	n, err := dfs.resolve(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+func (dfs davFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0 {
+		if !dfs.write || flag&os.O_CREATE == 0 {
+			return nil, os.ErrPermission
+		}
+		return newDAVUpload(ctx, name)
+	}
+	n, err := dfs.resolve(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	f := &davFile{davNode: n, dfs: dfs, ctx: ctx}
+	if !n.IsDir() {
+		d, err := getDownloader()
+		if err != nil {
+			return nil, err
+		}
+		if f.sr, err = d.Stream(ctx, n.entry.Ref); err != nil {
+			return nil, davError("open", name, err)
+		}
+	}
+	return f, nil
+}
+
+// resolve returns the node of the path name.
+func (dfs davFS) resolve(ctx context.Context, name string) (davNode, error) {
+	name = path.Clean("/" + name)
+	if name == "/" {
+		return davNode{name: "/", root: true}, nil
+	}
+	elts := strings.Split(name[1:], "/")
+	br, ok := blob.Parse(elts[0])
+	if !ok {
+		return davNode{}, davError("stat", name, os.ErrNotExist)
+	}
+	d, err := getDownloader()
+	if err != nil {
+		return davNode{}, err
+	}
+	n, err := dfs.node(ctx, d, elts[0], br, nil)
+	if err != nil {
+		return n, davError("stat", name, err)
+	}
+	for _, elt := range elts[1:] {
+		children, err := dfs.children(ctx, d, n)
+		if err != nil {
+			return n, davError("stat", name, err)
+		}
+		var found bool
+		for _, c := range children {
+			if found = c.name == elt; found {
+				n = c
+				break
+			}
+		}
+		if !found {
+			return n, davError("stat", name, os.ErrNotExist)
+		}
+	}
+	return n, nil
+}
+
+// node returns the node of br, named name (if not empty).
+// p is the described permanode br, if already known.
+func (dfs davFS) node(ctx context.Context, d *camutil.Downloader, name string, br blob.Ref, p *camutil.Permanode) (davNode, error) {
+	if p == nil {
+		e, err := d.Stat(ctx, br)
+		if err != nil {
+			return davNode{}, err
+		}
+		if e.Type != "permanode" {
+			if name == "" {
+				name = e.Name
+			}
+			return davNode{name: name, entry: e}, nil
+		}
+		m, err := d.DescribePermanodes(ctx, br)
+		if err != nil {
+			return davNode{}, err
+		}
+		pp, ok := m[br]
+		if !ok {
+			return davNode{}, os.ErrNotExist
+		}
+		p = &pp
+	}
+	if name == "" {
+		name = p.Title()
+	}
+	if content := p.Content(); content.Valid() && len(p.Members()) == 0 {
+		e, err := d.Stat(ctx, content)
+		if err != nil {
+			return davNode{}, err
+		}
+		if name == "" {
+			name = e.Name
+		}
+		return davNode{name: name, entry: e}, nil
+	}
+	if name == "" {
+		name = br.String()
+	}
+	return davNode{name: name, perma: p}, nil
+}
+
+// children returns the entries of the directory or collection n.
+func (dfs davFS) children(ctx context.Context, d *camutil.Downloader, n davNode) ([]davNode, error) {
+	switch {
+	case n.root:
+		return nil, nil
+	case n.perma != nil:
+		members := n.perma.Members()
+		m, err := d.DescribePermanodes(ctx, members...)
+		if err != nil {
+			return nil, err
+		}
+		children := make([]davNode, 0, len(members))
+		seen := make(map[string]struct{}, len(members))
+		for _, br := range members {
+			var p *camutil.Permanode
+			if pp, ok := m[br]; ok {
+				p = &pp
+			}
+			c, err := dfs.node(ctx, d, "", br, p)
+			if err != nil {
+				zlog.SFromContext(ctx).Warn("dav member", "collection", n.perma.Ref, "member", br, "error", err)
+				continue
+			}
+			if _, ok := seen[c.name]; ok {
+				c.name += " (" + br.String() + ")"
+			}
+			seen[c.name] = struct{}{}
+			children = append(children, c)
+		}
+		return children, nil
+	case n.entry.IsDir():
+		list, err := d.ReadDir(ctx, n.entry.Ref)
+		if err != nil {
+			return nil, err
+		}
+		children := make([]davNode, len(list))
+		for i, e := range list {
+			children[i] = davNode{name: e.Name, entry: e}
+		}
+		return children, nil
+	}
+	return nil, errors.New("not a directory")
+}
+
+// davError returns err as an *os.PathError, as webdav checks it with os.IsNotExist.
+func davError(op, name string, err error) error {
+	if errors.Is(err, camutil.ErrNotFound) {
+		err = os.ErrNotExist
+	}
+	return &os.PathError{Op: op, Path: name, Err: err}
+}
+
+// davNode is a directory, collection or file, implementing os.FileInfo.
+type davNode struct {
+	name  string
+	root  bool
+	entry camutil.DirEntry
+	perma *camutil.Permanode
+}
+
+func (n davNode) Name() string { return n.name }
+func (n davNode) Size() int64  { return n.entry.Size }
+func (n davNode) IsDir() bool  { return n.root || n.perma != nil || n.entry.IsDir() }
+func (n davNode) Sys() any     { return nil }
+func (n davNode) Mode() os.FileMode {
+	if n.IsDir() {
+		return os.ModeDir | 0555
+	}
+	return 0444
+}
+func (n davNode) ModTime() time.Time {
+	if n.perma != nil {
+		return n.perma.ModTime
+	}
+	return n.entry.ModTime
+}
+
+// ETag returns the ref, as the contents are immutable.
+func (n davNode) ETag(ctx context.Context) (string, error) {
+	if n.perma != nil || n.root {
+		return "", webdav.ErrNotImplemented
+	}
+	return `"` + n.entry.Ref.String() + `"`, nil
+}
+
+// ContentType returns the MIME type by the extension, to avoid sniffing.
+func (n davNode) ContentType(ctx context.Context) (string, error) {
+	if t := mime.TypeByExtension(path.Ext(n.name)); t != "" {
+		return t, nil
+	}
+	return "", webdav.ErrNotImplemented
+}
+
+// davFile is an opened davNode.
+type davFile struct {
+	davNode
+	dfs      davFS
+	ctx      context.Context
+	sr       *camutil.StreamReader
+	children []os.FileInfo
+	listed   bool
+}
+
+func (f *davFile) Read(p []byte) (int, error) {
+	if f.sr == nil {
+		return 0, errors.New("is a directory")
+	}
+	return f.sr.Read(p)
+}
+func (f *davFile) Seek(offset int64, whence int) (int64, error) {
+	if f.sr == nil {
+		return 0, errors.New("is a directory")
+	}
+	return f.sr.Seek(offset, whence)
+}
+func (f *davFile) Write(p []byte) (int, error) { return 0, os.ErrPermission }
+func (f *davFile) Stat() (os.FileInfo, error)  { return f.davNode, nil }
+func (f *davFile) Close() error {
+	if f.sr != nil {
+		return f.sr.Close()
+	}
+	return nil
+}
+
+// Readdir returns the next count entries (all of them if count <= 0).
+func (f *davFile) Readdir(count int) ([]os.FileInfo, error) {
+	if !f.IsDir() {
+		return nil, errors.New("not a directory")
+	}
+	if !f.listed {
+		d, err := getDownloader()
+		if err != nil {
+			return nil, err
+		}
+		children, err := f.dfs.children(f.ctx, d, f.davNode)
+		if err != nil {
+			return nil, err
+		}
+		f.children = make([]os.FileInfo, len(children))
+		for i, c := range children {
+			f.children[i] = c
+		}
+		f.listed = true
+	}
+	if count <= 0 {
+		list := f.children
+		f.children = nil
+		return list, nil
+	}
+	if len(f.children) == 0 {
+		return nil, io.EOF
+	}
+	n := min(count, len(f.children))
+	list := f.children[:n]
+	f.children = f.children[n:]
+	return list, nil
+}
+
+// davUpload is a file PUT in write mode: spooled into a temp file,
+// and uploaded on Close.
+type davUpload struct {
+	*os.File
+	ctx  context.Context
+	name string
+}
+
+func newDAVUpload(ctx context.Context, name string) (*davUpload, error) {
+	name = path.Clean("/" + name)
+	if name == "/" || strings.HasSuffix(name, "/") {
+		return nil, os.ErrPermission
+	}
+	fh, err := os.CreateTemp("", "camproxy-dav-")
+	if err != nil {
+		return nil, err
+	}
+	_ = os.Remove(fh.Name())
+	return &davUpload{File: fh, ctx: ctx, name: name}, nil
+}
+
+func (f *davUpload) Readdir(int) ([]os.FileInfo, error) { return nil, errors.New("not a directory") }
+func (f *davUpload) Stat() (os.FileInfo, error) {
+	fi, err := f.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return namedFileInfo{FileInfo: fi, name: path.Base(f.name)}, nil
+}
+
+// Close uploads the file, and creates its permanode.
+func (f *davUpload) Close() error {
+	defer f.File.Close()
+	if err := f.ctx.Err(); err != nil {
+		return err // the request is aborted
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if _, err = f.File.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	u, err := getUploader()
+	if err != nil {
+		return err
+	}
+	content, err := u.FromReaderInfo(f.ctx, fi, mime.TypeByExtension(path.Ext(f.name)), f.File)
+	if err != nil {
+		return err
+	}
+	perma, err := u.NewPermanode(f.ctx, map[string]string{
+		"camliContent": content.String(),
+		"title":        fi.Name(),
+		"path":         f.name,
+	})
+	if err != nil {
+		return err
+	}
+	zlog.SFromContext(f.ctx).Info("dav upload", "path", f.name, "content", content, "permanode", perma)
+	return nil
+}
+
+type namedFileInfo struct {
+	os.FileInfo
+	name string
+}
+
+func (fi namedFileInfo) Name() string { return fi.name }
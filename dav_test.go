@@ -0,0 +1,161 @@
+// Copyright 2026 Tamás Gulácsi.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tgulacsi/camproxy/camutil"
+)
+
+func TestDAVMethods(t *testing.T) {
+	for i, elt := range []struct {
+		method string
+		write  bool
+		code   int
+	}{
+		{"PUT", false, http.StatusMethodNotAllowed},
+		{"MKCOL", false, http.StatusMethodNotAllowed},
+		{"DELETE", true, http.StatusMethodNotAllowed},
+		{"MOVE", true, http.StatusMethodNotAllowed},
+		{"PROPPATCH", true, http.StatusMethodNotAllowed},
+		{"OPTIONS", false, http.StatusOK},
+	} {
+		rec := httptest.NewRecorder()
+		newDAVHandler("/dav", elt.write).ServeHTTP(rec, httptest.NewRequest(elt.method, "/dav/x", nil))
+		if rec.Code != elt.code {
+			t.Errorf("%d. %s (write=%t): got %d, wanted %d", i, elt.method, elt.write, rec.Code, elt.code)
+		}
+	}
+}
+
+func TestDAVResolve(t *testing.T) {
+	ctx := context.Background()
+	n, err := davFS{}.resolve(ctx, "/")
+	if err != nil || !n.IsDir() {
+		t.Errorf("root: got %+v, %v", n, err)
+	}
+	if _, err = (davFS{}).Stat(ctx, "/not-a-ref/x"); !os.IsNotExist(err) {
+		t.Errorf("got %v, wanted not exist", err)
+	}
+	if err = davError("stat", "x", fmt.Errorf("fetch: %w", camutil.ErrNotFound)); !os.IsNotExist(err) {
+		t.Errorf("got %v, wanted not exist", err)
+	}
+	if _, err = (davFS{}).OpenFile(ctx, "/x", os.O_RDWR|os.O_CREATE, 0644); !os.IsPermission(err) {
+		t.Errorf("read-only create: got %v", err)
+	}
+}
+
+// setupBackend sets the server to an empty local storage, for the duration of the test.
+func setupBackend(t *testing.T) (backend string) {
+	t.Helper()
+	camutil.SetLogger(logger)
+	backend = filepath.Join(t.TempDir(), "backend")
+	if err := os.MkdirAll(backend, 0700); err != nil {
+		t.Fatal(err)
+	}
+	oldServer := server
+	t.Cleanup(func() { server = oldServer })
+	server = "file://" + backend
+	return backend
+}
+
+func TestDAVTree(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	setupBackend(t)
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "sub"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	for nm, content := range map[string]string{"a.txt": "aaa", "sub/b.txt": "bbb"} {
+		if err := os.WriteFile(filepath.Join(dir, nm), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	u, err := getUploader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	br, err := u.UploadPath(ctx, dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := newDAVHandler("/dav", false)
+	propfind := func(p, depth string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("PROPFIND", "/dav/"+br.String()+p, nil)
+		if depth != "" {
+			r.Header.Set("Depth", depth)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+	w := propfind("/", "1")
+	if w.Code != http.StatusMultiStatus {
+		t.Fatalf("PROPFIND: got %d: %s", w.Code, w.Body)
+	}
+	for _, nm := range []string{"a.txt", "sub"} {
+		if !strings.Contains(w.Body.String(), nm) {
+			t.Errorf("PROPFIND: %q is not listed: %s", nm, w.Body)
+		}
+	}
+	if w = propfind("/sub/", "1"); w.Code != http.StatusMultiStatus || !strings.Contains(w.Body.String(), "b.txt") {
+		t.Errorf("PROPFIND sub: got %d: %s", w.Code, w.Body)
+	}
+	for _, depth := range []string{"infinity", ""} {
+		if w = propfind("/", depth); w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "propfind-finite-depth") {
+			t.Errorf("PROPFIND depth=%q: got %d: %s", depth, w.Code, w.Body)
+		}
+	}
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/dav/"+br.String()+"/sub/b.txt", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "bbb" {
+		t.Errorf("GET: got %d %q", w.Code, w.Body)
+	}
+}
+
+func TestDAVPut(t *testing.T) {
+	backend := setupBackend(t)
+	keyring := filepath.Join(t.TempDir(), "secring.gpg")
+	if _, err := camutil.GenerateIdentity(keyring, "test", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	defer func(old string) { *flagIdentity = old }(*flagIdentity)
+	*flagIdentity = keyring
+
+	w := httptest.NewRecorder()
+	newDAVHandler("/dav", true).ServeHTTP(w, httptest.NewRequest("PUT", "/dav/docs/new.txt", strings.NewReader("new contents")))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("PUT: got %d: %s", w.Code, w.Body)
+	}
+	// the contents, and the permanode with its path are stored
+	var content, path bool
+	if err := filepath.WalkDir(backend, func(fn string, de os.DirEntry, err error) error {
+		if err != nil || de.IsDir() {
+			return err
+		}
+		b, err := os.ReadFile(fn)
+		content = content || bytes.Equal(b, []byte("new contents"))
+		path = path || bytes.Contains(b, []byte(`"/docs/new.txt"`))
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if !content || !path {
+		t.Errorf("PUT: contents stored: %t, path stored: %t", content, path)
+	}
+}
@@ -0,0 +1,601 @@
+// Copyright 2026 Tamás Gulácsi.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/UNO-SOFT/zlog/v2"
+	"github.com/tgulacsi/camproxy/camutil"
+	"perkeep.org/pkg/blob"
+)
+
+// ftpServer is a minimal FTP server (RFC 959, passive mode only),
+// for the systems with an FTP client, but without curl:
+// STOR uploads the file (the 226 reply contains its ref),
+// RETR downloads the contents of a ref (or short ref),
+// LIST and NLST list the user's recent uploads.
+type ftpServer struct {
+	// check checks the user and password; nil means no authentication.
+	check func(user, password string) bool
+	// passiveLo, passiveHi is the port range of the passive data connections
+	// (any port if zero).
+	passiveLo, passiveHi int
+	// publicIP is the address announced in the PASV reply
+	// (the local address of the control connection if nil).
+	publicIP net.IP
+	// limits and rl are the limits of the HTTP side (no limits if nil).
+	limits *requestLimits
+	rl     *rateLimiter
+}
+
+const (
+	ftpIdleTimeout = 5 * time.Minute
+	ftpDataTimeout = 30 * time.Second
+)
+
+// parsePortRange parses the "lo-hi" port range.
+func parsePortRange(s string) (lo, hi int, err error) {
+	if s == "" {
+		return 0, 0, nil
+	}
+	a, b, _ := strings.Cut(s, "-")
+	if lo, err = strconv.Atoi(strings.TrimSpace(a)); err != nil {
+		return 0, 0, fmt.Errorf("parse %q: %w", s, err)
+	}
+	hi = lo
+	if b != "" {
+		if hi, err = strconv.Atoi(strings.TrimSpace(b)); err != nil {
+			return 0, 0, fmt.Errorf("parse %q: %w", s, err)
+		}
+	}
+	if lo <= 0 || hi < lo || hi > 65535 {
+		return 0, 0, fmt.Errorf("bad port range %q", s)
+	}
+	return lo, hi, nil
+}
+
+// Serve accepts the connections on l, until ctx is canceled.
+func (s *ftpServer) Serve(ctx context.Context, l net.Listener) error {
+	go func() { <-ctx.Done(); l.Close() }()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		go func() {
+			c := &ftpConn{
+				s: s, ctrl: conn,
+				r: bufio.NewReader(conn), w: bufio.NewWriter(conn),
+				logger: logger.With("ftp", conn.RemoteAddr().String()),
+			}
+			c.ctx = zlog.NewSContext(ctx, c.logger)
+			defer c.close()
+			if err := c.serve(); err != nil && !errors.Is(err, io.EOF) {
+				c.logger.Info("ftp", "error", err)
+			}
+		}()
+	}
+}
+
+// ftpConn is an FTP control connection.
+type ftpConn struct {
+	s      *ftpServer
+	ctx    context.Context
+	logger *slog.Logger
+	ctrl   net.Conn
+	r      *bufio.Reader
+	w      *bufio.Writer
+	pasv   net.Listener
+
+	user   string
+	authed bool
+	ascii  bool
+}
+
+func (c *ftpConn) close() {
+	if c.pasv != nil {
+		c.pasv.Close()
+	}
+	c.ctrl.Close()
+}
+
+// authUser returns the user accepted by check, as authUser of the HTTP side:
+// without check, the name in USER is not verified.
+func (c *ftpConn) authUser() string {
+	if c.s.check == nil || !c.authed {
+		return ""
+	}
+	return c.user
+}
+
+// clientKey returns the rate limit key of the client, as clientKey of the HTTP side.
+func (c *ftpConn) clientKey() string {
+	if user := c.authUser(); user != "" {
+		return "user:" + user
+	}
+	return "ip:" + c.ctrl.RemoteAddr().(*net.TCPAddr).IP.String()
+}
+
+// ftpErrCode returns the reply code of the transfer error err.
+func ftpErrCode(err error) int {
+	switch {
+	case errors.Is(err, errTooLarge):
+		return 552
+	case errors.Is(err, errTempBudget), errors.Is(err, errNotEnoughFree):
+		return 452
+	case errors.Is(err, errTooBusy), errors.Is(err, errTooBusyDown), errors.Is(err, errRateLimited):
+		return 450
+	}
+	return 451
+}
+
+func (c *ftpConn) reply(code int, msg string) error {
+	lines := strings.Split(msg, "\n")
+	for i, line := range lines {
+		sep := "-"
+		if i == len(lines)-1 {
+			sep = " "
+		}
+		if _, err := fmt.Fprintf(c.w, "%d%s%s\r\n", code, sep, line); err != nil {
+			return err
+		}
+	}
+	return c.w.Flush()
+}
+
+func (c *ftpConn) serve() error {
+	if err := c.reply(220, "camproxy FTP ready"); err != nil {
+		return err
+	}
+	for {
+		_ = c.ctrl.SetReadDeadline(time.Now().Add(ftpIdleTimeout))
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		cmd, arg, _ := strings.Cut(strings.TrimRight(line, "\r\n"), " ")
+		cmd = strings.ToUpper(cmd)
+		if cmd == "PASS" {
+			c.logger.Debug("ftp", "cmd", cmd)
+		} else {
+			c.logger.Debug("ftp", "cmd", cmd, "arg", arg)
+		}
+		if err = c.handle(cmd, arg); err != nil {
+			return err
+		}
+		if cmd == "QUIT" {
+			return nil
+		}
+	}
+}
+
+func (c *ftpConn) handle(cmd, arg string) error {
+	switch cmd {
+	case "USER":
+		c.user, c.authed = arg, false
+		if c.s.check == nil {
+			c.authed = true
+			return c.reply(230, "Logged in")
+		}
+		return c.reply(331, "Password required")
+	case "PASS":
+		if c.s.check == nil || c.authed {
+			return c.reply(230, "Logged in")
+		}
+		if c.user == "" {
+			return c.reply(503, "Login with USER first")
+		}
+		if !c.s.check(c.user, arg) {
+			c.logger.Warn("ftp login failed", "user", c.user)
+			return c.reply(530, "Login incorrect")
+		}
+		c.authed = true
+		return c.reply(230, "Logged in")
+	case "QUIT":
+		return c.reply(221, "Bye")
+	case "NOOP":
+		return c.reply(200, "OK")
+	case "SYST":
+		return c.reply(215, "UNIX Type: L8")
+	case "FEAT":
+		return c.reply(211, "Features:\n PASV\n EPSV\n SIZE\n UTF8\nEnd")
+	case "OPTS":
+		if strings.EqualFold(arg, "UTF8 ON") {
+			return c.reply(200, "OK")
+		}
+		return c.reply(501, "Unknown option")
+	}
+	if !c.authed {
+		return c.reply(530, "Not logged in")
+	}
+
+	switch cmd {
+	case "PWD", "XPWD":
+		return c.reply(257, `"/" is the current directory`)
+	case "CWD", "XCWD", "CDUP":
+		if cmd == "CDUP" || arg == "/" || arg == "." {
+			return c.reply(250, "OK")
+		}
+		return c.reply(550, "No such directory")
+	case "TYPE":
+		switch strings.ToUpper(strings.TrimSpace(arg)) {
+		case "A", "A N":
+			c.ascii = true
+		case "I", "L 8":
+			c.ascii = false
+		default:
+			return c.reply(504, "Unsupported type")
+		}
+		return c.reply(200, "Type set")
+	case "MODE":
+		if strings.EqualFold(arg, "S") {
+			return c.reply(200, "OK")
+		}
+		return c.reply(504, "Only stream mode is supported")
+	case "STRU":
+		if strings.EqualFold(arg, "F") {
+			return c.reply(200, "OK")
+		}
+		return c.reply(504, "Only file structure is supported")
+	case "PASV", "EPSV":
+		return c.passive(cmd == "EPSV")
+	case "PORT", "EPRT":
+		return c.reply(502, "Only passive mode is supported")
+	case "SIZE":
+		br, err := parseRef(arg)
+		if err != nil {
+			return c.reply(501, err.Error())
+		}
+		d, err := getDownloader()
+		if err != nil {
+			return c.reply(451, err.Error())
+		}
+		e, err := d.Stat(c.ctx, br)
+		if err != nil {
+			return c.reply(550, err.Error())
+		}
+		return c.reply(213, strconv.FormatInt(e.Size, 10))
+	case "RETR":
+		return c.retrieve(arg)
+	case "STOR":
+		return c.store(arg)
+	case "LIST", "NLST":
+		return c.list(cmd == "NLST")
+	}
+	return c.reply(502, "Command not implemented")
+}
+
+// passive opens the listener of the passive data connection.
+func (c *ftpConn) passive(extended bool) error {
+	if c.pasv != nil {
+		c.pasv.Close()
+		c.pasv = nil
+	}
+	local := c.ctrl.LocalAddr().(*net.TCPAddr)
+	ip := c.s.publicIP
+	if ip == nil {
+		ip = local.IP
+	}
+	if !extended && ip.To4() == nil {
+		return c.reply(425, "Use EPSV")
+	}
+	l, err := c.s.listenPassive(local.IP)
+	if err != nil {
+		c.logger.Error("passive listen", "error", err)
+		return c.reply(425, "Cannot open data connection")
+	}
+	c.pasv = l
+	port := l.Addr().(*net.TCPAddr).Port
+	if extended {
+		return c.reply(229, fmt.Sprintf("Entering Extended Passive Mode (|||%d|)", port))
+	}
+	ip4 := ip.To4()
+	return c.reply(227, fmt.Sprintf("Entering Passive Mode (%d,%d,%d,%d,%d,%d)",
+		ip4[0], ip4[1], ip4[2], ip4[3], port>>8, port&0xff))
+}
+
+// listenPassive listens on a free port of the passive range.
+func (s *ftpServer) listenPassive(ip net.IP) (net.Listener, error) {
+	if s.passiveLo == 0 {
+		return net.ListenTCP("tcp", &net.TCPAddr{IP: ip})
+	}
+	n := s.passiveHi - s.passiveLo + 1
+	start := rand.IntN(n)
+	var err error
+	for i := 0; i < n; i++ {
+		var l net.Listener
+		if l, err = net.ListenTCP("tcp", &net.TCPAddr{IP: ip, Port: s.passiveLo + (start+i)%n}); err == nil {
+			return l, nil
+		}
+	}
+	return nil, err
+}
+
+// dataConn accepts the data connection - from the client's address only.
+func (c *ftpConn) dataConn() (net.Conn, error) {
+	if c.pasv == nil {
+		return nil, errors.New("use PASV first")
+	}
+	l := c.pasv
+	c.pasv = nil
+	defer l.Close()
+	_ = l.(*net.TCPListener).SetDeadline(time.Now().Add(ftpDataTimeout))
+	conn, err := l.Accept()
+	if err != nil {
+		return nil, err
+	}
+	want := c.ctrl.RemoteAddr().(*net.TCPAddr).IP
+	if got := conn.RemoteAddr().(*net.TCPAddr).IP; !got.Equal(want) {
+		conn.Close()
+		return nil, fmt.Errorf("data connection from %s, not %s", got, want)
+	}
+	return conn, nil
+}
+
+// transfer runs fn on the data connection, with the 150 and 226 replies.
+func (c *ftpConn) transfer(fn func(net.Conn) (string, error)) error {
+	if err := c.reply(150, "Opening data connection"); err != nil {
+		return err
+	}
+	conn, err := c.dataConn()
+	if err != nil {
+		return c.reply(425, err.Error())
+	}
+	// the data connection may take longer than the idle timeout
+	_ = c.ctrl.SetReadDeadline(time.Time{})
+	msg, err := fn(conn)
+	if cErr := conn.Close(); cErr != nil && err == nil {
+		err = cErr
+	}
+	if err != nil {
+		c.logger.Error("ftp transfer", "error", err)
+		return c.reply(ftpErrCode(err), err.Error())
+	}
+	return c.reply(226, msg)
+}
+
+func (c *ftpConn) retrieve(name string) error {
+	br, err := parseRef(name)
+	if err != nil {
+		return c.reply(501, err.Error())
+	}
+	d, err := getDownloader()
+	if err != nil {
+		return c.reply(451, err.Error())
+	}
+	cl, err := c.s.rl.allow(c.clientKey())
+	if err != nil {
+		return c.reply(ftpErrCode(err), err.Error())
+	}
+	done, err := c.s.limits.startDownload()
+	if err != nil {
+		return c.reply(ftpErrCode(err), err.Error())
+	}
+	defer done()
+	rc, err := d.Start(c.ctx, true, br)
+	if err != nil {
+		return c.reply(550, err.Error())
+	}
+	defer rc.Close()
+	return c.transfer(func(conn net.Conn) (string, error) {
+		w := cl.Writer(c.ctx, conn)
+		if c.ascii {
+			w = &lfToCRLF{w: w}
+		}
+		_, err := io.Copy(w, rc)
+		return "Transfer complete", err
+	})
+}
+
+// store receives the file into a temp file, within the limits of the HTTP
+// uploads, and uploads it - or spools it, if the server is unavailable.
+func (c *ftpConn) store(name string) error {
+	if name = safeBaseFn(name); name == "" || name == "." || name == ".." {
+		return c.reply(553, "Bad file name")
+	}
+	cl, err := c.s.rl.allow(c.clientKey())
+	if err != nil {
+		return c.reply(ftpErrCode(err), err.Error())
+	}
+	q, err := c.s.limits.startUpload(c.authUser())
+	if err != nil {
+		return c.reply(ftpErrCode(err), err.Error())
+	}
+	defer q.Release()
+	dn, err := os.MkdirTemp("", "camproxy")
+	if err != nil {
+		return c.reply(451, err.Error())
+	}
+	defer os.RemoveAll(dn)
+	fn := filepath.Join(dn, name)
+	return c.transfer(func(conn net.Conn) (string, error) {
+		fh, err := os.Create(fn)
+		if err != nil {
+			return "", err
+		}
+		defer fh.Close()
+		w := q.Writer(fh)
+		if c.ascii {
+			w = &crlfToLF{w: w}
+		}
+		mimeType, r := camutil.MIMETypeFromReader(cl.Reader(c.ctx, conn))
+		if _, err = io.Copy(w, r); err != nil {
+			return "", err
+		}
+		if cw, ok := w.(*crlfToLF); ok {
+			if err = cw.Flush(); err != nil {
+				return "", err
+			}
+		}
+		if err = fh.Close(); err != nil {
+			return "", err
+		}
+		content, err := c.upload(fn, name, mimeType)
+		if err != nil {
+			return "", err
+		}
+		return "Transfer complete: " + content.String(), nil
+	})
+}
+
+// upload uploads the received file fn, as the HTTP side does:
+// spooled if the server is unavailable, with a paranoid copy.
+func (c *ftpConn) upload(fn, name, mimeType string) (blob.Ref, error) {
+	fi, err := os.Stat(fn)
+	if err != nil {
+		return blob.Ref{}, err
+	}
+	user := c.authUser()
+	var content blob.Ref
+	var stats camutil.UploadStats
+	u, err := getUploader()
+	if err == nil {
+		content, _, stats, err = u.UploadFileLazyAttrStats(c.ctx, fn, mimeType, nil)
+	}
+	var spooled bool
+	if err != nil && uploadSpool != nil {
+		if bErr := checkBackend(c.ctx); bErr != nil {
+			c.logger.Warn("server is unavailable, spooling", "error", err, "backend", bErr)
+			if content, err = uploadSpool.Add(c.ctx, user, fn, mimeType, nil); err == nil {
+				spooled = true
+			}
+		}
+	}
+	if err != nil {
+		return content, err
+	}
+	if !spooled {
+		countUploadStats(stats)
+	}
+	if mimeType != "" {
+		mimeCache.Set(camutil.RefToBase64(content), mimeType)
+	}
+	uploads.remember(user, recentUpload{Ref: content, Name: name, Size: fi.Size(), Time: time.Now()})
+	c.logger.Info("uploaded", "name", name, "content", content, "spooled", spooled, "existed", stats.Existed(), "stats", stats)
+	if *flagParanoid != "" {
+		if err = saveParanoid(c.ctx, fn, content, paranoidMeta{
+			FileName: name, MIMEType: mimeType, ModTime: fi.ModTime(), Size: fi.Size(),
+			Uploaded: time.Now(), User: user,
+		}); err != nil {
+			c.logger.Error("paranoid copy", "src", fn, "ref", content, "error", err)
+			if *flagParanoidSync {
+				return content, fmt.Errorf("save paranoid copy: %w", err)
+			}
+		}
+	}
+	return content, nil
+}
+
+// list lists the recent uploads of the user, named by their refs.
+func (c *ftpConn) list(namesOnly bool) error {
+	user := c.authUser()
+	list := uploads.recentUploads(user)
+	return c.transfer(func(conn net.Conn) (string, error) {
+		w := bufio.NewWriter(conn)
+		for _, ru := range list {
+			if namesOnly {
+				fmt.Fprintf(w, "%s\r\n", ru.Ref)
+			} else {
+				fmt.Fprintf(w, "%s\r\n", lsLine(0444, user, ru.Size, ru.Time, ru.Ref.String()))
+			}
+		}
+		return "Transfer complete", w.Flush()
+	})
+}
+
+// lsLine returns the "ls -l" line of the file.
+func lsLine(mode os.FileMode, user string, size int64, mtime time.Time, name string) string {
+	ts := mtime.Format("Jan _2 15:04")
+	if time.Since(mtime) > 180*24*time.Hour {
+		ts = mtime.Format("Jan _2  2006")
+	}
+	if user == "" {
+		user = "camproxy"
+	}
+	return fmt.Sprintf("%s 1 %s %s %12d %s %s", mode, user, user, size, ts, name)
+}
+
+// parseRef parses the ref or short ref.
+func parseRef(s string) (blob.Ref, error) {
+	items, err := camutil.ParseBlobNames(nil, []string{strings.TrimPrefix(strings.TrimSpace(s), "/")})
+	if err != nil {
+		return blob.Ref{}, err
+	}
+	return items[0], nil
+}
+
+// lfToCRLF converts the line endings to CRLF, for ASCII mode downloads.
+type lfToCRLF struct {
+	w  io.Writer
+	cr bool
+}
+
+func (t *lfToCRLF) Write(p []byte) (int, error) {
+	var buf []byte
+	for _, b := range p {
+		if b == '\n' && !t.cr {
+			buf = append(buf, '\r')
+		}
+		buf = append(buf, b)
+		t.cr = b == '\r'
+	}
+	if _, err := t.w.Write(buf); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// crlfToLF converts the CRLF line endings to LF, for ASCII mode uploads.
+type crlfToLF struct {
+	w  io.Writer
+	cr bool // a CR is pending
+}
+
+func (t *crlfToLF) Write(p []byte) (int, error) {
+	buf := make([]byte, 0, len(p)+1)
+	for _, b := range p {
+		if t.cr && b != '\n' {
+			buf = append(buf, '\r')
+		}
+		if t.cr = b == '\r'; !t.cr {
+			buf = append(buf, b)
+		}
+	}
+	if _, err := t.w.Write(buf); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Flush writes the pending CR.
+func (t *crlfToLF) Flush() error {
+	if !t.cr {
+		return nil
+	}
+	t.cr = false
+	_, err := t.w.Write([]byte{'\r'})
+	return err
+}
@@ -0,0 +1,262 @@
+// Copyright 2026 Tamás Gulácsi.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"perkeep.org/pkg/blob"
+
+	"github.com/tgulacsi/camproxy/camutil"
+)
+
+func TestParsePortRange(t *testing.T) {
+	for i, elt := range []struct {
+		in     string
+		lo, hi int
+		ok     bool
+	}{
+		{"", 0, 0, true},
+		{"2121", 2121, 2121, true},
+		{"50000-50100", 50000, 50100, true},
+		{"50100-50000", 0, 0, false},
+		{"0-10", 0, 0, false},
+		{"a-b", 0, 0, false},
+	} {
+		lo, hi, err := parsePortRange(elt.in)
+		if (err == nil) != elt.ok || lo != elt.lo || hi != elt.hi {
+			t.Errorf("%d. %q: got %d-%d, %v", i, elt.in, lo, hi, err)
+		}
+	}
+}
+
+func TestLineEndings(t *testing.T) {
+	var buf bytes.Buffer
+	w := &crlfToLF{w: &buf}
+	for _, s := range []string{"a\r", "\nb\r\r", "\nc\r"} {
+		if _, err := io.WriteString(w, s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := buf.String(), "a\nb\r\nc\r"; got != want {
+		t.Errorf("crlfToLF: got %q, wanted %q", got, want)
+	}
+	buf.Reset()
+	if _, err := io.WriteString(&lfToCRLF{w: &buf}, "a\nb\r\nc"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := buf.String(), "a\r\nb\r\nc"; got != want {
+		t.Errorf("lfToCRLF: got %q, wanted %q", got, want)
+	}
+}
+
+// ftpTestConn is a client of the ftpServer under test.
+type ftpTestConn struct {
+	*textproto.Conn
+	t *testing.T
+}
+
+// dialFTP starts s, and logs in as ftptest.
+func dialFTP(ctx context.Context, t *testing.T, s *ftpServer) ftpTestConn {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.check == nil {
+		s.check = func(user, password string) bool { return user == "ftptest" && password == "secret" }
+	}
+	go s.Serve(ctx, l)
+	c, err := textproto.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	fc := ftpTestConn{Conn: c, t: t}
+	fc.cmd(220, "")
+	fc.cmd(530, "LIST")
+	fc.cmd(331, "USER ftptest")
+	fc.cmd(530, "PASS bad")
+	fc.cmd(331, "USER ftptest")
+	fc.cmd(230, "PASS secret")
+	fc.cmd(200, "TYPE I")
+	return fc
+}
+
+// cmd sends the command (if not empty), and reads the reply with the code.
+func (c ftpTestConn) cmd(code int, format string, args ...any) string {
+	c.t.Helper()
+	if format != "" {
+		if err := c.PrintfLine(format, args...); err != nil {
+			c.t.Fatal(err)
+		}
+	}
+	_, msg, err := c.ReadResponse(code)
+	if err != nil {
+		c.t.Fatalf("%q: %v", format, err)
+	}
+	return msg
+}
+
+// pasv opens a passive data connection.
+func (c ftpTestConn) pasv() net.Conn {
+	c.t.Helper()
+	msg := c.cmd(229, "EPSV")
+	var port int
+	if _, err := fmt.Sscanf(msg[strings.Index(msg, "|||"):], "|||%d|)", &port); err != nil {
+		c.t.Fatalf("%q: %v", msg, err)
+	}
+	dc, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return dc
+}
+
+// stor stores content as name, and returns the reply of the transfer.
+func (c ftpTestConn) stor(name, content string) (int, string) {
+	c.t.Helper()
+	dc := c.pasv()
+	defer dc.Close()
+	if err := c.PrintfLine("STOR %s", name); err != nil {
+		c.t.Fatal(err)
+	}
+	if code, msg, _ := c.ReadResponse(0); code != 150 {
+		return code, msg // rejected before the transfer
+	}
+	_, _ = io.WriteString(dc, content)
+	dc.Close()
+	code, msg, _ := c.ReadResponse(0)
+	return code, msg
+}
+
+func TestFTPList(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	br := blob.RefFromString("uploaded")
+	uploads.remember("ftptest", recentUpload{Ref: br, Name: "a.txt", Size: 8, Time: time.Now()})
+
+	c := dialFTP(ctx, t, &ftpServer{})
+	dc := c.pasv()
+	c.cmd(150, "NLST")
+	b, err := io.ReadAll(dc)
+	dc.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.cmd(226, "")
+	if got := strings.TrimSpace(string(b)); got != br.String() {
+		t.Errorf("NLST: got %q, wanted %q", got, br)
+	}
+	c.cmd(221, "QUIT")
+}
+
+func TestFTPStoreRetrieve(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	setupBackend(t)
+	oldMimeCache := mimeCache
+	mimeCache = camutil.NewMimeCache(filepath.Join(t.TempDir(), "mimecache.kv"), 0)
+	t.Cleanup(func() { mimeCache.Close(); mimeCache = oldMimeCache })
+
+	c := dialFTP(ctx, t, &ftpServer{})
+	code, msg := c.stor("b.txt", "stored contents")
+	if code != 226 {
+		t.Fatalf("STOR: got %d %q", code, msg)
+	}
+	ref := msg[strings.LastIndexByte(msg, ' ')+1:]
+	if _, ok := blob.Parse(ref); !ok {
+		t.Fatalf("STOR: no ref in %q", msg)
+	}
+	dc := c.pasv()
+	c.cmd(150, "RETR %s", ref)
+	b, err := io.ReadAll(dc)
+	dc.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.cmd(226, "")
+	if string(b) != "stored contents" {
+		t.Errorf("RETR: got %q", b)
+	}
+}
+
+func TestFTPRetrieveLimits(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	camutil.SetLogger(logger)
+	lim := newRequestLimits(0, 1, 0, 0, nil, 0)
+	done, err := lim.startDownload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := dialFTP(ctx, t, &ftpServer{limits: lim})
+	dc := c.pasv()
+	defer dc.Close()
+	c.cmd(450, "RETR %s", blob.RefFromString("busy"))
+	done()
+	if done, err = lim.startDownload(); err != nil {
+		t.Errorf("the slot is not released: %v", err)
+	} else {
+		done()
+	}
+}
+
+func TestFTPStoreLimits(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	camutil.SetLogger(logger)
+	defer func(old int64) { *flagMinFree = old }(*flagMinFree)
+	*flagMinFree = 0
+	for i, elt := range []struct {
+		limits *requestLimits
+		rl     *rateLimiter
+		code   int
+	}{
+		{limits: newRequestLimits(0, 0, 0, 5, nil, 0), code: 552},
+		{limits: newRequestLimits(0, 0, 0, 0, map[string]int64{"ftptest": 5}, 0), code: 552},
+		{limits: newRequestLimits(0, 0, 0, 0, nil, 5), code: 452},
+		{rl: newRateLimiter(rateLimit{Requests: 0.001}, nil), code: 450},
+	} {
+		c := dialFTP(ctx, t, &ftpServer{limits: elt.limits, rl: elt.rl})
+		if elt.rl != nil {
+			// the first one is allowed
+			if code, msg := c.stor("a.txt", ""); code == elt.code {
+				t.Errorf("%d. first: got %d %q", i, code, msg)
+			}
+		}
+		if code, msg := c.stor("a.txt", "more than five bytes"); code != elt.code {
+			t.Errorf("%d. got %d %q, wanted %d", i, code, msg, elt.code)
+		}
+	}
+
+	lim := newRequestLimits(1, 0, 0, 0, nil, 0)
+	q, err := lim.startUpload("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = lim.startUpload(""); !errors.Is(err, errTooBusy) {
+		t.Errorf("got %v, wanted errTooBusy", err)
+	}
+	q.Release()
+	if q, err = lim.startUpload(""); err != nil {
+		t.Errorf("the slot is not released: %v", err)
+	} else {
+		q.Release()
+	}
+}
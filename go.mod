@@ -13,9 +13,9 @@ require (
 	github.com/remyoudompheng/bigfft v0.0.0-20230129092748-24d4a6f8daec // indirect
 	github.com/syndtr/goleveldb v1.0.1-0.20210305035536-64b5b1c73954 // indirect
 	go4.org v0.0.0-20230225012048-214862532bf5 // indirect
-	golang.org/x/crypto v0.29.0 // indirect
+	golang.org/x/crypto v0.29.0
 	golang.org/x/image v0.22.0 // indirect
-	golang.org/x/net v0.31.0 // indirect
+	golang.org/x/net v0.31.0
 )
 
 require (
@@ -24,6 +24,7 @@ require (
 	github.com/dgraph-io/badger/v4 v4.4.0
 	github.com/rogpeppe/retry v0.1.0
 	github.com/zRedShift/mimemagic v1.2.0
+	golang.org/x/sys v0.27.0
 	perkeep.org v0.0.0-20240423032045-bb15e6eb48bc
 )
 
@@ -63,7 +64,6 @@ require (
 	golang.org/x/exp v0.0.0-20241108190413-2d47ceb2692f // indirect
 	golang.org/x/oauth2 v0.24.0 // indirect
 	golang.org/x/sync v0.9.0 // indirect
-	golang.org/x/sys v0.27.0 // indirect
 	golang.org/x/term v0.26.0 // indirect
 	golang.org/x/text v0.20.0 // indirect
 	golang.zx2c4.com/wireguard/windows v0.5.3 // indirect
@@ -0,0 +1,176 @@
+// Copyright 2026 Tamás Gulácsi.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"perkeep.org/pkg/blob"
+
+	"github.com/tgulacsi/camproxy/camutil"
+)
+
+// shuttingDown is set when the graceful shutdown starts, to fail readiness.
+var shuttingDown atomic.Bool
+
+// serving is set by the serve command: the signal is not re-raised then,
+// to let serveGraceful finish.
+var serving atomic.Bool
+
+// serveGraceful serves s on l until ctx is canceled, then fails the readiness
+// for -drain-delay (for the load balancer to notice), and shuts s down:
+// it returns when the in-flight requests are finished.
+func serveGraceful(ctx context.Context, s *http.Server, l net.Listener) error {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		<-ctx.Done()
+		shuttingDown.Store(true)
+		logger.Info("Shutting down", "drain", *flagDrainDelay)
+		time.Sleep(*flagDrainDelay)
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := s.Shutdown(ctx); err != nil {
+			logger.Error("Shutdown", "error", err)
+		}
+	}()
+	if err := s.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	<-done
+	return nil
+}
+
+type checkResult struct {
+	Status  string `json:"status"`
+	Latency string `json:"latency"`
+	Error   string `json:"error,omitempty"`
+}
+
+type healthResponse struct {
+	Status string                 `json:"status"`
+	Checks map[string]checkResult `json:"checks,omitempty"`
+}
+
+// handleHealth reports liveness: the process is up and serving.
+func handleHealth(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, healthResponse{Status: "ok"})
+}
+
+// handleReady reports readiness: the backend answers, the temp and paranoid
+// dirs are writable with enough free space, and the mime cache is open.
+func handleReady(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	checks := map[string]func(context.Context) error{
+		"backend":   checkBackend,
+		"tempdir":   func(context.Context) error { return checkDir(os.TempDir()) },
+		"mimecache": func(context.Context) error { return checkMimeCache() },
+	}
+	if *flagParanoid != "" {
+		checks["paranoid"] = func(context.Context) error { return checkDir(*flagParanoid) }
+	}
+
+	resp := healthResponse{Status: "ok", Checks: make(map[string]checkResult, len(checks)+1)}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for name, check := range checks {
+		wg.Add(1)
+		go func(name string, check func(context.Context) error) {
+			defer wg.Done()
+			start := time.Now()
+			err := check(ctx)
+			res := checkResult{Status: "ok", Latency: time.Since(start).String()}
+			if err != nil {
+				res.Status, res.Error = "fail", err.Error()
+			}
+			mu.Lock()
+			resp.Checks[name] = res
+			mu.Unlock()
+		}(name, check)
+	}
+	wg.Wait()
+
+	if shuttingDown.Load() {
+		resp.Checks["shutdown"] = checkResult{Status: "fail", Latency: "0s", Error: "shutting down"}
+	}
+	for _, res := range resp.Checks {
+		if res.Status != "ok" {
+			resp.Status = "fail"
+			break
+		}
+	}
+	if resp.Status != "ok" {
+		logger.Info("not ready", "checks", resp.Checks)
+	}
+	writeHealth(w, resp)
+}
+
+func writeHealth(w http.ResponseWriter, resp healthResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if resp.Status == "ok" {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+// checkBackend stats the empty blob on the server through NewClient.
+func checkBackend(ctx context.Context) error {
+	c, err := camutil.NewClient(server)
+	if err != nil {
+		return err
+	}
+	return c.StatBlobs(ctx, []blob.Ref{blob.RefFromString("")},
+		func(blob.SizedRef) error { return nil })
+}
+
+// checkDir checks that dir is writable and has at least -min-free bytes free.
+func checkDir(dir string) error {
+	fh, err := os.CreateTemp(dir, ".camproxy-ready-")
+	if err != nil {
+		return err
+	}
+	name := fh.Name()
+	fh.Close()
+	if err = os.Remove(name); err != nil {
+		return err
+	}
+	return checkFree(dir)
+}
+
+// checkFree checks that dir has at least -min-free bytes free.
+func checkFree(dir string) error {
+	if *flagMinFree <= 0 {
+		return nil
+	}
+	free, err := diskFree(dir)
+	if err != nil || free < 0 {
+		return err
+	}
+	if free < *flagMinFree {
+		return fmt.Errorf("%s: only %d bytes free (need %d)", dir, free, *flagMinFree)
+	}
+	return nil
+}
+
+func checkMimeCache() error {
+	if mimeCache == nil {
+		return errors.New("mime cache is not initialized")
+	}
+	return mimeCache.Check()
+}
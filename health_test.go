@@ -0,0 +1,68 @@
+// Copyright 2026 Tamás Gulácsi.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckDir(t *testing.T) {
+	defer func(old int64) { *flagMinFree = old }(*flagMinFree)
+	dir := t.TempDir()
+	for i, elt := range []struct {
+		dir     string
+		minFree int64
+		ok      bool
+	}{
+		{dir, 0, true},
+		{filepath.Join(dir, "missing"), 0, false},
+		{dir, 1, true},
+		{dir, 1 << 62, false},
+	} {
+		*flagMinFree = elt.minFree
+		if elt.minFree > 1 {
+			if free, _ := diskFree(dir); free < 0 {
+				continue // no statfs here
+			}
+		}
+		if err := checkDir(elt.dir); (err == nil) != elt.ok {
+			t.Errorf("%d. %q (min %d): got %v", i, elt.dir, elt.minFree, err)
+		}
+	}
+}
+
+func TestReadyShuttingDown(t *testing.T) {
+	shuttingDown.Store(true)
+	defer shuttingDown.Store(false)
+	w := httptest.NewRecorder()
+	handleReady(w, httptest.NewRequest("GET", "/_ready", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("got %d, wanted 503", w.Code)
+	}
+	var resp healthResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status != "fail" || resp.Checks["shutdown"].Status != "fail" {
+		t.Errorf("got %+v", resp)
+	}
+	for _, name := range []string{"backend", "tempdir", "mimecache"} {
+		if _, ok := resp.Checks[name]; !ok {
+			t.Errorf("%q check is missing from %+v", name, resp.Checks)
+		}
+	}
+}
+
+func TestHealth(t *testing.T) {
+	w := httptest.NewRecorder()
+	handleHealth(w, httptest.NewRequest("GET", "/_health", nil))
+	if w.Code != http.StatusOK || w.Header().Get("Cache-Control") != "no-store" {
+		t.Errorf("got %d %v", w.Code, w.Header())
+	}
+}
@@ -0,0 +1,359 @@
+// Copyright 2026 Tamás Gulácsi.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/tgulacsi/camproxy/camutil"
+)
+
+// retryAfter is the Retry-After (in seconds) sent when a limit is reached.
+const retryAfter = "5"
+
+var errTempBudget = errors.New("temp disk budget exceeded")
+
+// requestLimits holds the upload/download limits of the proxy.
+type requestLimits struct {
+	uploads, downloads chan struct{}
+	temp               diskBudget
+	maxUpload          int64
+	userMaxUpload      map[string]int64 // overrides maxUpload, still per request
+	maxUserUploads     int              // concurrent uploads per user
+
+	mu          sync.Mutex
+	userUploads map[string]int
+}
+
+func newRequestLimits(maxUploads, maxDownloads, maxUserUploads int, maxUpload int64, userMaxUpload map[string]int64, tempBudget int64) *requestLimits {
+	lim := requestLimits{
+		maxUpload:      maxUpload,
+		userMaxUpload:  userMaxUpload,
+		maxUserUploads: maxUserUploads,
+		userUploads:    make(map[string]int),
+		temp:           diskBudget{max: tempBudget},
+	}
+	if maxUploads > 0 {
+		lim.uploads = make(chan struct{}, maxUploads)
+	}
+	if maxDownloads > 0 {
+		lim.downloads = make(chan struct{}, maxDownloads)
+	}
+	return &lim
+}
+
+// Wrap returns a handler which rejects requests over the limits,
+// without queueing them.
+func (lim *requestLimits) Wrap(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			if !tryAcquire(lim.downloads) {
+				tooBusy(w, http.StatusServiceUnavailable, "too many concurrent downloads")
+				return
+			}
+			defer release(lim.downloads)
+
+		case "POST", "PUT": // PUT is a WebDAV upload
+			user := authUser(r.Context())
+			maxUpload := lim.maxUploadOf(user)
+			if maxUpload > 0 && r.ContentLength > maxUpload {
+				http.Error(w, fmt.Sprintf("request body too large (max %d bytes)", maxUpload),
+					http.StatusRequestEntityTooLarge)
+				return
+			}
+			if !tryAcquire(lim.uploads) {
+				tooBusy(w, http.StatusServiceUnavailable, "too many concurrent uploads")
+				return
+			}
+			defer release(lim.uploads)
+			if user != "" && lim.maxUserUploads > 0 {
+				if !lim.acquireUser(user) {
+					tooBusy(w, http.StatusTooManyRequests, "too many concurrent uploads of "+user)
+					return
+				}
+				defer lim.releaseUser(user)
+			}
+
+			br := &budgetReader{ReadCloser: r.Body, budget: &lim.temp}
+			defer br.release()
+			if r.ContentLength > 0 && !br.reserve(r.ContentLength) {
+				tooBusy(w, http.StatusServiceUnavailable, errTempBudget.Error())
+				return
+			}
+			r.Body = br
+			if maxUpload > 0 {
+				r.Body = http.MaxBytesReader(w, r.Body, maxUpload)
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// maxUploadOf returns the size limit of one upload of user (0 means no limit).
+func (lim *requestLimits) maxUploadOf(user string) int64 {
+	if n, ok := lim.userMaxUpload[user]; ok {
+		return n
+	}
+	return lim.maxUpload
+}
+
+var (
+	errTooLarge      = errors.New("upload too large")
+	errTooBusy       = errors.New("too many concurrent uploads")
+	errTooBusyDown   = errors.New("too many concurrent downloads")
+	errNotEnoughFree = errors.New("not enough free disk space")
+)
+
+// startDownload applies the download concurrency limit of Wrap to a download
+// not through HTTP (FTP). The returned func must be called at the end.
+// A nil lim means no limits.
+func (lim *requestLimits) startDownload() (func(), error) {
+	if lim == nil {
+		return func() {}, nil
+	}
+	if !tryAcquire(lim.downloads) {
+		return nil, errTooBusyDown
+	}
+	return func() { release(lim.downloads) }, nil
+}
+
+// startUpload applies the limits of Wrap to an upload not through HTTP
+// (FTP, SFTP, scp) of user: the concurrency limits, and -min-free of the
+// temp dir. The file is to be grown through the returned uploadQuota,
+// which must be released at the end. A nil lim means no limits.
+func (lim *requestLimits) startUpload(user string) (*uploadQuota, error) {
+	if err := checkFree(os.TempDir()); err != nil {
+		return nil, fmt.Errorf("%w: %w", errNotEnoughFree, err)
+	}
+	if lim == nil {
+		return &uploadQuota{budget: &diskBudget{}}, nil
+	}
+	if !tryAcquire(lim.uploads) {
+		return nil, errTooBusy
+	}
+	q := &uploadQuota{budget: &lim.temp, max: lim.maxUploadOf(user), release: func() { release(lim.uploads) }}
+	if user != "" && lim.maxUserUploads > 0 {
+		if !lim.acquireUser(user) {
+			q.Release()
+			return nil, fmt.Errorf("%w of %s", errTooBusy, user)
+		}
+		q.release = func() { lim.releaseUser(user); release(lim.uploads) }
+	}
+	return q, nil
+}
+
+// uploadQuota is the size limit and the temp budget of an upload
+// not through HTTP.
+type uploadQuota struct {
+	budget   *diskBudget
+	max      int64 // 0 means no limit
+	reserved int64
+	release  func()
+}
+
+// grow checks that the file can grow to size bytes, and reserves the growth
+// from the temp budget.
+func (q *uploadQuota) grow(size int64) error {
+	if q.max > 0 && size > q.max {
+		return fmt.Errorf("%w (max %d bytes)", errTooLarge, q.max)
+	}
+	if over := size - q.reserved; over > 0 {
+		if !q.budget.reserve(over) {
+			return errTempBudget
+		}
+		q.reserved = size
+	}
+	return nil
+}
+
+// Writer returns w, grown through q.
+func (q *uploadQuota) Writer(w io.Writer) io.Writer { return &quotaWriter{w: w, q: q} }
+
+// Release returns the reserved bytes to the budget, and the concurrency slots.
+func (q *uploadQuota) Release() {
+	q.budget.release(q.reserved)
+	q.reserved = 0
+	if q.release != nil {
+		q.release()
+		q.release = nil
+	}
+}
+
+type quotaWriter struct {
+	w io.Writer
+	q *uploadQuota
+	n int64
+}
+
+func (w *quotaWriter) Write(p []byte) (int, error) {
+	if err := w.q.grow(w.n + int64(len(p))); err != nil {
+		return 0, err
+	}
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+func (lim *requestLimits) acquireUser(user string) bool {
+	lim.mu.Lock()
+	defer lim.mu.Unlock()
+	if lim.userUploads[user] >= lim.maxUserUploads {
+		return false
+	}
+	lim.userUploads[user]++
+	return true
+}
+func (lim *requestLimits) releaseUser(user string) {
+	lim.mu.Lock()
+	defer lim.mu.Unlock()
+	if lim.userUploads[user]--; lim.userUploads[user] <= 0 {
+		delete(lim.userUploads, user)
+	}
+}
+
+func tooBusy(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set("Retry-After", retryAfter)
+	http.Error(w, msg, code)
+}
+
+// tryAcquire acquires a slot from the semaphore, without blocking.
+// A nil semaphore means no limit.
+func tryAcquire(sema chan struct{}) bool {
+	if sema == nil {
+		return true
+	}
+	select {
+	case sema <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+func release(sema chan struct{}) {
+	if sema != nil {
+		<-sema
+	}
+}
+
+// diskBudget limits the bytes spooled into the temp dir by all requests.
+type diskBudget struct {
+	mu        sync.Mutex
+	used, max int64
+}
+
+func (db *diskBudget) reserve(n int64) bool {
+	if db.max <= 0 {
+		return true
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.used+n > db.max {
+		return false
+	}
+	db.used += n
+	return true
+}
+func (db *diskBudget) release(n int64) {
+	if db.max <= 0 {
+		return
+	}
+	db.mu.Lock()
+	db.used -= n
+	db.mu.Unlock()
+}
+
+// budgetReader reserves the read bytes from the budget, over the
+// already reserved (Content-Length) amount.
+type budgetReader struct {
+	io.ReadCloser
+	budget         *diskBudget
+	reserved, read int64
+}
+
+func (br *budgetReader) reserve(n int64) bool {
+	if !br.budget.reserve(n) {
+		return false
+	}
+	br.reserved += n
+	return true
+}
+
+func (br *budgetReader) Read(p []byte) (int, error) {
+	n, err := br.ReadCloser.Read(p)
+	br.read += int64(n)
+	if over := br.read - br.reserved; over > 0 && !br.reserve(over) {
+		return n, errTempBudget
+	}
+	return n, err
+}
+
+// release returns the reserved bytes to the budget - the temp dir is removed
+// at the end of the request.
+func (br *budgetReader) release() {
+	br.budget.release(br.reserved)
+	br.reserved = 0
+}
+
+// httpError answers with msg, and the status code of err (see errStatusCode) -
+// with Retry-After, if it is transient.
+func httpError(w http.ResponseWriter, msg string, err error) {
+	code := errStatusCode(err)
+	if code == http.StatusServiceUnavailable {
+		w.Header().Set("Retry-After", retryAfter)
+	}
+	http.Error(w, msg, code)
+}
+
+// errStatusCode returns the HTTP status code for errors from reading the request,
+// or from downloading the blobs.
+func errStatusCode(err error) int {
+	var mbe *http.MaxBytesError
+	switch {
+	case errors.As(err, &mbe), errors.Is(err, camutil.ErrTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, errTempBudget):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, camutil.ErrNotFile):
+		return http.StatusBadRequest
+	case errors.Is(err, camutil.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, camutil.ErrCorrupt):
+		return http.StatusBadGateway
+	case errors.Is(err, camutil.ErrTransport):
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+// parseUserLimits parses the "user=bytes,user2=bytes2" list.
+func parseUserLimits(s string) (map[string]int64, error) {
+	if s == "" {
+		return nil, nil
+	}
+	m := make(map[string]int64)
+	for _, kv := range strings.Split(s, ",") {
+		if kv = strings.TrimSpace(kv); kv == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok {
+			return m, fmt.Errorf("%q: no = in %q", s, kv)
+		}
+		n, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+		if err != nil {
+			return m, fmt.Errorf("%q: %w", kv, err)
+		}
+		m[strings.TrimSpace(k)] = n
+	}
+	return m, nil
+}
@@ -0,0 +1,85 @@
+// Copyright 2026 Tamás Gulácsi.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/tgulacsi/camproxy/camutil"
+)
+
+func TestParseUserLimits(t *testing.T) {
+	for i, elt := range []struct {
+		in   string
+		want map[string]int64
+		ok   bool
+	}{
+		{"", nil, true},
+		{"a=1", map[string]int64{"a": 1}, true},
+		{" a = 1 , b=2,", map[string]int64{"a": 1, "b": 2}, true},
+		{"a", nil, false},
+		{"a=x", nil, false},
+	} {
+		got, err := parseUserLimits(elt.in)
+		if (err == nil) != elt.ok {
+			t.Errorf("%d. %q: got error %v", i, elt.in, err)
+			continue
+		}
+		if !elt.ok {
+			continue
+		}
+		if len(got) != len(elt.want) {
+			t.Errorf("%d. %q: got %v, wanted %v", i, elt.in, got, elt.want)
+		}
+		for k, v := range elt.want {
+			if got[k] != v {
+				t.Errorf("%d. %q: got %v, wanted %v", i, elt.in, got, elt.want)
+			}
+		}
+	}
+}
+
+func TestBudgetReader(t *testing.T) {
+	budget := diskBudget{max: 10}
+	br := &budgetReader{ReadCloser: io.NopCloser(strings.NewReader(strings.Repeat("x", 16))), budget: &budget}
+	if _, err := io.ReadAll(br); !errors.Is(err, errTempBudget) {
+		t.Errorf("wanted errTempBudget, got %v", err)
+	}
+	br.release()
+	if budget.used != 0 {
+		t.Errorf("budget is not released: %d", budget.used)
+	}
+}
+
+func TestErrStatusCode(t *testing.T) {
+	for i, elt := range []struct {
+		err  error
+		want int
+	}{
+		{&http.MaxBytesError{Limit: 1}, http.StatusRequestEntityTooLarge},
+		{fmt.Errorf("archive: %w", camutil.ErrTooLarge), http.StatusRequestEntityTooLarge},
+		{fmt.Errorf("read: %w", errTempBudget), http.StatusServiceUnavailable},
+		{&camutil.DownloadError{Kind: camutil.ErrNotFound}, http.StatusNotFound},
+		{&camutil.DownloadError{Kind: camutil.ErrCorrupt}, http.StatusBadGateway},
+		{&camutil.DownloadError{Kind: camutil.ErrTransport}, http.StatusServiceUnavailable},
+		{&camutil.DownloadError{Kind: camutil.ErrNotFile}, http.StatusBadRequest},
+		{errors.New("other"), http.StatusInternalServerError},
+	} {
+		if got := errStatusCode(elt.err); got != elt.want {
+			t.Errorf("%d. %v: got %d, wanted %d", i, elt.err, got, elt.want)
+		}
+		w := httptest.NewRecorder()
+		httpError(w, "msg", elt.err)
+		if w.Code != elt.want || (w.Header().Get("Retry-After") != "") != (elt.want == http.StatusServiceUnavailable) {
+			t.Errorf("%d. %v: got %d %v", i, elt.err, w.Code, w.Header())
+		}
+	}
+}
@@ -9,11 +9,14 @@ import (
 	"context"
 	"crypto/sha256"
 	"encoding/base64"
+	"encoding/json"
+	"expvar"
 	"flag"
 	"fmt"
 	"io"
 	"mime"
 	"mime/multipart"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
@@ -44,13 +47,57 @@ var (
 	flagSkipIrregular = fs.Bool("skip-irregular", camutil.SkipIrregular, "skip irregular files")
 	//flagServer      = fs.String("server", ":3179", "Camlistore server address")
 	flagNoCache       = fs.Bool("no-cache", true, "no disk cache")
+	flagCacheDir      = fs.String("cache-dir", "", "disk cache dir (default: the user's cache dir/perkeep/blobs)")
+	flagCacheSize     = fs.Int64("cache-size", camutil.DefaultCacheSize, "disk cache size, in bytes")
 	flagCapCtime      = fs.Bool("capctime", false, "forge ctime to be less or equal to mtime")
 	flagNoAuth        = fs.Bool("noauth", false, "no HTTP Basic Authentication, even if CAMLI_AUTH is set")
 	flagListen        = fs.String("listen", ":3178", "listen on")
+	flagVerify        = fs.Bool("verify", false, "hash the downloaded blobs, refetching the corrupt cached ones")
+	flagSecondary     = fs.String("secondary-server", "", "server to download from when the primary fails")
+	flagPrefetchDepth = fs.Int("prefetch-depth", camutil.DefaultPrefetchDepth, "number of chunks to read ahead on downloads")
+	flagPrefetchPar   = fs.Int("prefetch-parallel", camutil.DefaultPrefetchParallel, "number of concurrent chunk fetches per download")
+	flagIdentity      = fs.String("identity", "", "keyring or secret key file to sign the permanodes and claims with (default: the client config's identity)")
 	flagParanoid      = fs.String("paranoid", "", "Paranoid mode: save uploaded files also under this dir")
-	flagSkipHaveCache = fs.Bool("skiphavecache", false, "Skip have cache? (more stress on camlistored)")
+	flagParanoidSync  = fs.Bool("paranoid-sync", false, "respond to uploads only after the paranoid copy is durable")
+	flagSkipHaveCache = fs.Bool("skiphavecache", false, "Skip the persistent have cache? (more stress on camlistored)")
+	flagMinFree       = fs.Int64("min-free", 64<<20, "minimum free bytes in the temp and paranoid dirs for readiness, and in the temp dir for FTP, SFTP and scp uploads")
+	flagDrainDelay    = fs.Duration("drain-delay", 5*time.Second, "on shutdown, report not ready for this long before closing the listener")
+	flagAccessLog     = fs.String("access-log", "", "access log file (rotated); empty means stderr")
+	flagAccessLogSize = fs.Int64("access-log-max-size", 100<<20, "rotate the access log at this size")
+	flagAccessLogKeep = fs.Int("access-log-max-backups", 7, "number of rotated access logs to keep")
+
+	flagMaxUpload         = fs.Int64("max-upload", 0, "maximum upload size of a request, in bytes (0: unlimited)")
+	flagMaxUploadUser     = fs.String("max-upload-override", "", "per-user override of -max-upload, the size limit of one request: user=bytes,user2=bytes")
+	flagMaxUploads        = fs.Int("max-uploads", 0, "maximum number of concurrent uploads (0: unlimited)")
+	flagMaxUserUploads    = fs.Int("max-user-uploads", 0, "maximum number of concurrent uploads per user (0: unlimited)")
+	flagMaxDownloads      = fs.Int("max-downloads", 0, "maximum number of concurrent downloads (0: unlimited)")
+	flagTempBudget        = fs.Int64("temp-budget", 0, "maximum bytes spooled into the temp dir by all requests (0: unlimited)")
+	flagReadTimeout       = fs.Duration("read-timeout", 300*time.Second, "HTTP server read timeout")
+	flagWriteTimeout      = fs.Duration("write-timeout", 300*time.Second, "HTTP server write timeout")
+	flagIdleTimeout       = fs.Duration("idle-timeout", 120*time.Second, "HTTP server keep-alive idle timeout")
+	flagReadHeaderTimeout = fs.Duration("read-header-timeout", 30*time.Second, "HTTP server request header read timeout")
+
+	flagRateRequests = fs.Float64("rate-requests", 0, "default requests/sec limit per client (0: unlimited)")
+	flagRateBytes    = fs.Float64("rate-bytes", 0, "default bytes/sec limit per client (0: unlimited)")
+	flagRateLimits   = fs.String("rate-limits", "", "per-client (user:name or IP) limits: key=requests/sec:bytes/sec,...")
+
+	flagSpool         = fs.String("spool", "", "store-and-forward spool dir for uploads when the server is down")
+	flagSpoolInterval = fs.Duration("spool-interval", 30*time.Second, "spool forwarding interval")
+
+	flagDAV      = fs.Bool("dav", false, "serve the stored trees and permanodes read-only over WebDAV under /dav/")
+	flagDAVWrite = fs.Bool("dav-write", false, "allow uploads (PUT) over WebDAV, creating permanodes (implies -dav)")
+
+	flagFTPListen   = fs.String("ftp-listen", "", "listen for FTP (passive mode) on this address, too (empty: no FTP)")
+	flagFTPPassive  = fs.String("ftp-passive-ports", "", "port range of the FTP passive data connections, as lo-hi (default: any)")
+	flagFTPPublicIP = fs.String("ftp-public-ip", "", "IPv4 address announced for the FTP passive connections (default: the local address)")
+
+	flagSSHListen         = fs.String("ssh-listen", "", "listen for SFTP and scp uploads over SSH on this address, too (empty: no SSH)")
+	flagSSHHostKey        = fs.String("ssh-host-key", defaultSSHHostKeyPath(), "SSH host key file (generated if does not exist)")
+	flagSSHAuthorizedKeys = fs.String("ssh-authorized-keys", "", "authorized_keys file of the SSH public keys (re-read on each login)")
 
 	server string
+
+	uploadSpool *spool
 )
 
 func main() {
@@ -69,28 +116,108 @@ func Main() error {
 			server = client.ExplicitServer()
 			camutil.InsecureTLS = *flagInsecureTLS
 			camutil.SkipIrregular = *flagSkipIrregular
-			s := &http.Server{
-				Addr:           *flagListen,
-				Handler:        http.HandlerFunc(handle),
-				ReadTimeout:    300 * time.Second,
-				WriteTimeout:   300 * time.Second,
-				MaxHeaderBytes: 1 << 20,
-			}
-			if !*flagNoAuth {
-				camliAuth := os.Getenv("CAMLI_AUTH")
-				if camliAuth != "" {
-					s.Handler = camutil.SetupBasicAuthChecker(handle, camliAuth)
+			if *flagIdentity != "" {
+				if _, err := camutil.LoadIdentity(*flagIdentity); err != nil {
+					return fmt.Errorf("load -identity: %w", err)
+				}
+			}
+			userMaxUpload, err := parseUserLimits(*flagMaxUploadUser)
+			if err != nil {
+				return fmt.Errorf("parse -max-upload-override: %w", err)
+			}
+			limits := newRequestLimits(*flagMaxUploads, *flagMaxDownloads, *flagMaxUserUploads,
+				*flagMaxUpload, userMaxUpload, *flagTempBudget)
+			keyLimits, err := parseRateLimits(*flagRateLimits)
+			if err != nil {
+				return fmt.Errorf("parse -rate-limits: %w", err)
+			}
+			rl := newRateLimiter(rateLimit{Requests: *flagRateRequests, Bytes: *flagRateBytes}, keyLimits)
+
+			mux := http.NewServeMux()
+			mux.HandleFunc("/_health", handleHealth)
+			mux.HandleFunc("/_ready", handleReady)
+			mux.Handle("/admin/ratelimit", withAccessLog(authenticate(rl)))
+			mux.Handle("/debug/vars", authenticate(expvar.Handler()))
+			mux.Handle("/_uploads", authenticate(&uploads))
+			mux.Handle("/_uploads/", authenticate(&uploads))
+			if *flagSpool != "" {
+				if uploadSpool, err = newSpool(*flagSpool); err != nil {
+					return fmt.Errorf("open spool %q: %w", *flagSpool, err)
 				}
+				go uploadSpool.Run(ctx, *flagSpoolInterval)
+				mux.Handle("/admin/spool", withAccessLog(authenticate(uploadSpool)))
+			}
+			if *flagDAV || *flagDAVWrite {
+				mux.Handle("/dav/", withAccessLog(authenticate(rl.Wrap(limits.Wrap(newDAVHandler("/dav", *flagDAVWrite))))))
+			}
+			mux.Handle("/", withAccessLog(authenticate(rl.Wrap(limits.Wrap(http.HandlerFunc(handle))))))
+			s := &http.Server{
+				Addr:              *flagListen,
+				Handler:           mux,
+				ReadTimeout:       *flagReadTimeout,
+				WriteTimeout:      *flagWriteTimeout,
+				IdleTimeout:       *flagIdleTimeout,
+				ReadHeaderTimeout: *flagReadHeaderTimeout,
+				MaxHeaderBytes:    1 << 20,
 			}
 			defer func() {
 				camutil.Close()
 			}()
+			var alc io.Closer
+			alc, err = openAccessLog(*flagAccessLog, *flagAccessLogSize, *flagAccessLogKeep)
+			if err != nil {
+				return fmt.Errorf("open access log %q: %w", *flagAccessLog, err)
+			}
+			defer alc.Close()
 			mimeCache = camutil.NewMimeCache(filepath.Join(os.TempDir(),
 				"mimecache-"+os.Getenv("BRUNO_CUS")+"_"+os.Getenv("BRUNO_ENV")+".kv"),
 				0)
 			defer mimeCache.Close()
-			logger.Info("Listening", "http", s.Addr, "camlistore", server)
-			return s.ListenAndServe()
+			if *flagFTPListen != "" {
+				fsrv := ftpServer{check: basicAuthCheck(), limits: limits, rl: rl}
+				if fsrv.passiveLo, fsrv.passiveHi, err = parsePortRange(*flagFTPPassive); err != nil {
+					return fmt.Errorf("parse -ftp-passive-ports: %w", err)
+				}
+				if *flagFTPPublicIP != "" {
+					if fsrv.publicIP = net.ParseIP(*flagFTPPublicIP); fsrv.publicIP == nil {
+						return fmt.Errorf("parse -ftp-public-ip %q", *flagFTPPublicIP)
+					}
+				}
+				fl, err := net.Listen("tcp", *flagFTPListen)
+				if err != nil {
+					return fmt.Errorf("listen for FTP on %q: %w", *flagFTPListen, err)
+				}
+				logger.Info("Listening", "ftp", fl.Addr())
+				go func() {
+					if err := fsrv.Serve(ctx, fl); err != nil {
+						logger.Error("FTP", "error", err)
+					}
+				}()
+			}
+			if *flagSSHListen != "" {
+				ssrv, err := newSSHServer(*flagSSHHostKey, *flagSSHAuthorizedKeys, basicAuthCheck())
+				if err != nil {
+					return fmt.Errorf("SSH server: %w", err)
+				}
+				ssrv.limits, ssrv.rl = limits, rl
+				sl, err := net.Listen("tcp", *flagSSHListen)
+				if err != nil {
+					return fmt.Errorf("listen for SSH on %q: %w", *flagSSHListen, err)
+				}
+				logger.Info("Listening", "ssh", sl.Addr())
+				go func() {
+					if err := ssrv.Serve(ctx, sl); err != nil {
+						logger.Error("SSH", "error", err)
+					}
+				}()
+			}
+			hl, err := net.Listen("tcp", s.Addr)
+			if err != nil {
+				return fmt.Errorf("listen on %q: %w", s.Addr, err)
+			}
+			logger.Info("Listening", "http", hl.Addr(), "camlistore", server)
+			serving.Store(true)
+			return serveGraceful(ctx, s, hl)
 		},
 	}
 
@@ -169,11 +296,252 @@ func Main() error {
 	}
 	flagUseSHA1 := hshCmd.FlagSet.Bool("use-sha1", false, "Force use of sha1")
 
+	paranoidFS := flag.NewFlagSet("paranoid", flag.ContinueOnError)
+	flagParanoidDir := paranoidFS.String("paranoid", "", "paranoid dir")
+	flagPruneDays := paranoidFS.Int("prune-days", 0, "remove the verified copies older than this many days (0: keep all)")
+	paranoidCmd := ffcli.Command{Name: "paranoid", FlagSet: paranoidFS,
+		ShortUsage: "paranoid [-paranoid=dir] [-prune-days=N] verify|replay",
+		Exec: func(ctx context.Context, args []string) error {
+			return flag.ErrHelp
+		},
+	}
+	paranoidExec := func(replay bool) func(ctx context.Context, args []string) error {
+		return func(ctx context.Context, args []string) error {
+			server = client.ExplicitServer()
+			dir := *flagParanoidDir
+			if dir == "" {
+				dir = *flagParanoid
+			}
+			if dir == "" {
+				return fmt.Errorf("no paranoid dir given")
+			}
+			*flagParanoid = dir
+			return paranoidVerify(ctx, dir, time.Duration(*flagPruneDays)*24*time.Hour, replay)
+		}
+	}
+	paranoidCmd.Subcommands = []*ffcli.Command{
+		{Name: "verify", ShortHelp: "re-hash the copies and check them on the server",
+			Exec: paranoidExec(false)},
+		{Name: "replay", ShortHelp: "verify, and upload again the copies missing from the server",
+			Exec: paranoidExec(true)},
+	}
+
+	identityFS := flag.NewFlagSet("identity", flag.ContinueOnError)
+	flagIdentityPath := identityFS.String("identity", camutil.DefaultIdentityPath(), "secret keyring path")
+	flagIdentityName := identityFS.String("name", "camproxy", "name of the new identity")
+	flagIdentityEmail := identityFS.String("email", "", "email of the new identity")
+	flagKeyType := identityFS.String("key-type", "ed25519", "type of the new key: ed25519, rsa3072 or rsa4096")
+	flagUploadPub := identityFS.Bool("upload", true, "upload the public key blob to the server")
+	uploadPub := func(ctx context.Context, id *camutil.Identity) error {
+		if !*flagUploadPub {
+			return nil
+		}
+		server = client.ExplicitServer()
+		c, err := camutil.NewClient(server)
+		if err != nil {
+			return err
+		}
+		br, err := id.UploadPublicKey(ctx, c)
+		if err != nil {
+			return fmt.Errorf("upload public key to %q: %w", server, err)
+		}
+		logger.Info("uploaded public key", "server", server, "ref", br)
+		return nil
+	}
+	identityCmd := ffcli.Command{Name: "identity", FlagSet: identityFS,
+		ShortUsage: "identity [-identity=path] init|show|export-pub",
+		Exec: func(ctx context.Context, args []string) error {
+			return flag.ErrHelp
+		},
+		Subcommands: []*ffcli.Command{
+			{Name: "init", ShortHelp: "generate a new signing key, and upload its public key",
+				Exec: func(ctx context.Context, args []string) error {
+					id, err := camutil.GenerateIdentity(*flagIdentityPath, *flagIdentityName, *flagIdentityEmail, *flagKeyType)
+					if err != nil {
+						return err
+					}
+					fmt.Printf("keyID\t%s\npublicKey\t%s\npath\t%s\n", id.KeyID(), id.PublicKeyRef, *flagIdentityPath)
+					return uploadPub(ctx, id)
+				}},
+			{Name: "show", ShortHelp: "show the signing key",
+				Exec: func(ctx context.Context, args []string) error {
+					id, err := camutil.LoadIdentity(*flagIdentityPath)
+					if err != nil {
+						return err
+					}
+					fmt.Printf("keyID\t%s\nfingerprint\t%X\nalgorithm\t%d\npublicKey\t%s\n",
+						id.KeyID(), id.Entity.PrimaryKey.Fingerprint, id.Entity.PrimaryKey.PubKeyAlgo, id.PublicKeyRef)
+					for name := range id.Entity.Identities {
+						fmt.Printf("identity\t%s\n", name)
+					}
+					return nil
+				}},
+			{Name: "export-pub", ShortHelp: "print the armored public key, and upload it",
+				Exec: func(ctx context.Context, args []string) error {
+					id, err := camutil.LoadIdentity(*flagIdentityPath)
+					if err != nil {
+						return err
+					}
+					if _, err = os.Stdout.Write(id.ArmoredPublicKey); err != nil {
+						return err
+					}
+					return uploadPub(ctx, id)
+				}},
+		},
+	}
+
+	cacheFS := flag.NewFlagSet("cache", flag.ContinueOnError)
+	flagCacheDirCmd := cacheFS.String("cache-dir", camutil.DefaultCacheDir(), "disk cache dir")
+	flagCacheSizeCmd := cacheFS.Int64("cache-size", camutil.DefaultCacheSize, "disk cache size, in bytes")
+	// openCache opens the cache - without evicting anything if maxSize is 0.
+	openCache := func(fetcher blob.Fetcher, maxSize int64) (*camutil.BadgerCache, error) {
+		dc, err := camutil.NewBadgerCacheDir(fetcher, *flagCacheDirCmd, maxSize)
+		if err != nil {
+			return nil, fmt.Errorf("open cache %q (is camproxy running?): %w", *flagCacheDirCmd, err)
+		}
+		return dc, nil
+	}
+	cacheCmd := ffcli.Command{Name: "cache", FlagSet: cacheFS,
+		ShortUsage: "cache [-cache-dir=dir] [-cache-size=bytes] stats|purge|warm <ref>...",
+		Exec: func(ctx context.Context, args []string) error {
+			return flag.ErrHelp
+		},
+		Subcommands: []*ffcli.Command{
+			{Name: "stats", ShortHelp: "show the size of the cache",
+				Exec: func(ctx context.Context, args []string) error {
+					dc, err := openCache(nil, 0)
+					if err != nil {
+						return err
+					}
+					defer dc.Close()
+					st := dc.Stats()
+					fmt.Printf("root\t%s\nblobs\t%d\nbytes\t%d\nmaxBytes\t%d\nlsmSize\t%d\nvlogSize\t%d\n",
+						st.Root, st.Blobs, st.Bytes, *flagCacheSizeCmd, st.LSMSize, st.VLogSize)
+					return nil
+				}},
+			{Name: "purge", ShortHelp: "delete all the cached blobs",
+				Exec: func(ctx context.Context, args []string) error {
+					dc, err := openCache(nil, 0)
+					if err != nil {
+						return err
+					}
+					defer dc.Close()
+					return dc.Purge()
+				}},
+			{Name: "warm", ShortHelp: "fetch the blobs (files, directories recursively) into the cache",
+				Exec: func(ctx context.Context, args []string) error {
+					items, err := camutil.ParseBlobNames(nil, args)
+					if err != nil {
+						return err
+					}
+					if len(items) == 0 {
+						return flag.ErrHelp
+					}
+					server = client.ExplicitServer()
+					c, err := camutil.NewClient(server)
+					if err != nil {
+						return err
+					}
+					dc, err := openCache(c, *flagCacheSizeCmd)
+					if err != nil {
+						return err
+					}
+					defer dc.Close()
+					for _, br := range items {
+						n, size, err := dc.Warm(ctx, br)
+						if err != nil {
+							return fmt.Errorf("warm %s: %w", br, err)
+						}
+						fmt.Printf("%s\t%d blobs\t%d bytes\n", br, n, size)
+					}
+					return nil
+				}},
+		},
+	}
+
+	verifyCmd := ffcli.Command{Name: "verify", ShortUsage: "verify <ref>...",
+		ShortHelp: "fetch the whole file or directory tree, and report the missing or corrupt blobs",
+		Exec: func(ctx context.Context, args []string) error {
+			items, err := camutil.ParseBlobNames(nil, args)
+			if err != nil {
+				return err
+			}
+			if len(items) == 0 {
+				return flag.ErrHelp
+			}
+			server = client.ExplicitServer()
+			c, err := camutil.NewClient(server)
+			if err != nil {
+				return err
+			}
+			var bad int
+			for _, br := range items {
+				vr, err := camutil.VerifyTree(ctx, c, br)
+				if err != nil {
+					return err
+				}
+				for _, x := range []struct {
+					state string
+					refs  []blob.Ref
+				}{{"missing", vr.Missing}, {"corrupt", vr.Corrupt}, {"failed", vr.Failed}} {
+					for _, ref := range x.refs {
+						fmt.Printf("%s\t%s\t%s\n", br, x.state, ref)
+					}
+				}
+				fmt.Printf("%s\t%d good blobs\t%d bytes\n", br, vr.Blobs, vr.Bytes)
+				if !vr.OK() {
+					bad++
+				}
+			}
+			if bad != 0 {
+				return fmt.Errorf("%d of %d trees are incomplete", bad, len(items))
+			}
+			return nil
+		},
+	}
+
+	restoreFS := flag.NewFlagSet("restore", flag.ContinueOnError)
+	flagRestoreMode := restoreFS.String("mode", "skip-identical", "what to do with the existing files: skip-identical, overwrite, rename-new or fail")
+	flagRestoreRaw := restoreFS.Bool("raw", false, "save the blobs as is, not their contents")
+	flagRestoreInclude := restoreFS.String("include", "", "restore only the paths matching these comma-separated patterns")
+	flagRestoreExclude := restoreFS.String("exclude", "", "skip the paths matching these comma-separated patterns")
+	flagRestoreMaxDepth := restoreFS.Int("max-depth", 0, "maximum depth of the trees (0: unlimited)")
+	flagRestoreMaxSize := restoreFS.Int64("max-size", 0, "maximum total size of the files (0: unlimited)")
+	flagRestoreWorkers := restoreFS.Int("workers", camutil.DefaultSaveWorkers, "number of entries restored concurrently")
+	restoreCmd := ffcli.Command{Name: "restore", FlagSet: restoreFS,
+		ShortUsage: "restore [-mode=skip-identical|overwrite|rename-new|fail] [-raw] [-include=pattern] [-exclude=pattern] [-max-depth=N] [-max-size=N] [-workers=N] <dir> <ref>...",
+		ShortHelp:  "restore the files and directories under dir (rerun to resume)",
+		Exec: func(ctx context.Context, args []string) error {
+			if len(args) < 2 {
+				return flag.ErrHelp
+			}
+			mode, err := camutil.ParseRestoreMode(*flagRestoreMode)
+			if err != nil {
+				return err
+			}
+			items, err := camutil.ParseBlobNames(nil, args[1:])
+			if err != nil {
+				return err
+			}
+			server = client.ExplicitServer()
+			d, err := getDownloader()
+			if err != nil {
+				return err
+			}
+			return d.SaveWith(ctx, args[0], !*flagRestoreRaw, camutil.SaveOptions{
+				Mode:    mode,
+				Include: splitList(*flagRestoreInclude), Exclude: splitList(*flagRestoreExclude),
+				MaxDepth: *flagRestoreMaxDepth, MaxSize: *flagRestoreMaxSize,
+				Workers: *flagRestoreWorkers,
+			}, items...)
+		},
+	}
+
 	app := ffcli.Command{Name: "camutil", FlagSet: flag.CommandLine,
 		Exec: func(ctx context.Context, args []string) error {
 			return serveCmd.Exec(ctx, args)
 		},
-		Subcommands: []*ffcli.Command{&serveCmd, &refCmd, &hshCmd, &upBytesCmd},
+		Subcommands: []*ffcli.Command{&serveCmd, &refCmd, &hshCmd, &upBytesCmd, &paranoidCmd, &identityCmd, &cacheCmd, &verifyCmd, &restoreCmd},
 	}
 
 	if err := app.Parse(os.Args[1:]); err != nil {
@@ -202,10 +570,16 @@ func handle(w http.ResponseWriter, r *http.Request) {
 	if r.Body != nil {
 		defer r.Body.Close()
 	}
+	logger := zlog.SFromContext(r.Context())
 	values := r.URL.Query()
 
 	switch r.Method {
 	case "GET":
+		// /<dirref>/sub/path is a path inside the stored tree
+		if root, sub, ok := strings.Cut(r.URL.Path[1:], "/"); ok {
+			serveBrowse(w, r, root, sub)
+			return
+		}
 		// the path is treated as a blobname
 		items, err := camutil.ParseBlobNames(nil, []string{r.URL.Path[1:]})
 		if err != nil {
@@ -216,6 +590,7 @@ func handle(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "a blobref is needed!", 400)
 			return
 		}
+		setAccessRef(r.Context(), items[0].String())
 		content := values.Get("raw") != "1"
 		okMime, nm := "application/json", ""
 		if content {
@@ -227,14 +602,28 @@ func handle(w http.ResponseWriter, r *http.Request) {
 		}
 		d, err := getDownloader()
 		if err != nil {
+			if content && len(items) == 1 && serveParanoid(w, r, items[0], err) {
+				return
+			}
 			http.Error(w,
 				fmt.Sprintf("error getting downloader to %q: %s", server, err),
 				500)
 			return
 		}
+		if format := values.Get("archive"); format != "" {
+			serveArchive(w, r, d, format, items)
+			return
+		}
+		if content && len(items) == 1 && r.Header.Get("Range") != "" {
+			serveRange(w, r, d, items[0], nm, okMime)
+			return
+		}
 		rc, err := d.Start(r.Context(), content, items...)
 		if err != nil {
-			http.Error(w, fmt.Sprintf("download error: %v", err), 500)
+			if content && len(items) == 1 && serveParanoid(w, r, items[0], err) {
+				return
+			}
+			httpError(w, fmt.Sprintf("download error: %v", err), err)
 			return
 		}
 		defer rc.Close()
@@ -259,23 +648,27 @@ func handle(w http.ResponseWriter, r *http.Request) {
 
 	case "POST":
 		u, err := getUploader()
-		if err != nil {
+		if err != nil && uploadSpool == nil {
 			http.Error(w, fmt.Sprintf("error getting uploader to %q: %s", server, err), 500)
 			return
 		}
+		reqID := requestIDFromContext(r.Context())
+		user := authUser(r.Context())
+		status := uploads.start(reqID, user)
+		defer uploads.finish(status)
+		r.Body = status.countBody(r.Body, r.ContentLength)
 		dn, err := os.MkdirTemp("", "camproxy")
 		if err != nil {
 			http.Error(w, fmt.Sprintf("cannot create temporary directory: %s", err), 500)
 			return
 		}
 		var paraSource, paraDest string
+		var paraRef blob.Ref
+		var paraMeta paranoidMeta
 		defer func() {
 			if paraSource != "" && paraDest != "" { // save at last
-				// nosemgrep: go.lang.correctness.permissions.file_permission.incorrect-default-permission
-				_ = os.MkdirAll(filepath.Dir(paraDest), 0700)
-				logger.Info("Paranoid copying", "src", paraSource, "dst", paraDest)
-				if err = camutil.LinkOrCopy(paraSource, paraDest); err != nil {
-					logger.Info("copying", "src", paraSource, "dst", paraDest, "error", err)
+				if err := saveParanoid(r.Context(), paraSource, paraRef, paraMeta); err != nil {
+					logger.Error("paranoid copy", "src", paraSource, "dst", paraDest, "error", err)
 				}
 			}
 			os.RemoveAll(dn)
@@ -313,7 +706,7 @@ func handle(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 		if err != nil {
-			http.Error(w, err.Error(), 500)
+			httpError(w, err.Error(), err)
 			return
 		}
 
@@ -339,19 +732,57 @@ func handle(w http.ResponseWriter, r *http.Request) {
 		}
 
 		var content, perma blob.Ref
-		switch len(filenames) {
-		case 0:
+		var stats camutil.UploadStats
+		status.setPhase("uploading")
+		name := filepath.Base(dn)
+		if len(filenames) == 1 {
+			name = filepath.Base(filenames[0])
+		}
+		uctx := camutil.ContextWithProgress(r.Context(), name, status.setProgress)
+		switch {
+		case len(filenames) == 0:
 			http.Error(w, "no files in request", 400)
 			return
-		case 1:
-			content, perma, err = u.UploadFileLazyAttr(r.Context(), filenames[0], mimetypes[0], attrs)
+		case u == nil:
+			err = fmt.Errorf("no uploader to %q", server)
+		case len(filenames) == 1:
+			content, perma, stats, err = u.UploadFileLazyAttrStats(uctx, filenames[0], mimetypes[0], attrs)
 		default:
-			content, perma, err = u.UploadFileLazyAttr(r.Context(), dn, "", attrs)
+			content, perma, stats, err = u.UploadFileLazyAttrStats(uctx, dn, "", attrs)
+		}
+		var spooled bool
+		if err != nil && uploadSpool != nil {
+			if bErr := checkBackend(r.Context()); bErr != nil {
+				logger.Warn("server is unavailable, spooling", "error", err, "backend", bErr)
+				// the same tree as online: the file, or the directory of the files
+				path, mimeType := dn, ""
+				if len(filenames) == 1 {
+					path, mimeType = filenames[0], mimetypes[0]
+				}
+				if content, err = uploadSpool.Add(r.Context(), user, path, mimeType, attrs); err == nil {
+					spooled = true
+				}
+			}
 		}
 		if err != nil {
 			http.Error(w, fmt.Sprintf("error uploading %q: %s", filenames, err), 500)
 			return
 		}
+		setAccessRef(r.Context(), content.String())
+		if spooled {
+			var size int64
+			for _, fn := range filenames {
+				if fi, err := os.Stat(fn); err == nil {
+					size += fi.Size()
+				}
+			}
+			uploads.remember(user, recentUpload{Ref: content, Name: name, Size: size, Time: time.Now()})
+		} else {
+			uploads.remember(user, recentUpload{Ref: content, Name: name, Size: stats.TotalBytes, Time: time.Now()})
+			countUploadStats(stats)
+			logger.Info("uploaded", "content", content, "existed", stats.Existed(), "stats", stats)
+			setUploadStatsHeaders(w.Header(), stats)
+		}
 		// store mime types
 		shortKey := camutil.RefToBase64(content)
 		if len(filenames) == 1 {
@@ -360,25 +791,65 @@ func handle(w http.ResponseWriter, r *http.Request) {
 			}
 			if *flagParanoid != "" {
 				paraSource, paraDest = filenames[0], getParanoidPath(content)
+				paraRef = content
+				paraMeta = paranoidMeta{
+					FileName: filepath.Base(filenames[0]), MIMEType: mimetypes[0],
+					Uploaded: time.Now(), User: user, Attrs: attrs,
+				}
+				if fi, err := os.Stat(filenames[0]); err == nil {
+					paraMeta.ModTime, paraMeta.Size = fi.ModTime(), fi.Size()
+				}
+				if perma.Valid() {
+					paraMeta.Permanode = perma.String()
+				}
+				if *flagParanoidSync {
+					paraSource, paraDest = "", ""
+					if err = saveParanoid(r.Context(), filenames[0], paraRef, paraMeta); err != nil {
+						logger.Error("paranoid copy", "src", filenames[0], "ref", paraRef, "error", err)
+						http.Error(w, fmt.Sprintf("error saving paranoid copy of %q: %s", filenames[0], err), 500)
+						return
+					}
+				}
 			}
 		}
-		w.Header().Add("Content-Type", "text/plain")
 		b := bytes.NewBuffer(make([]byte, 0, 128))
-		if short {
-			b.WriteString(shortKey)
+		if values.Get("json") == "1" || strings.Contains(r.Header.Get("Accept"), "application/json") {
+			w.Header().Add("Content-Type", "application/json")
+			res := uploadResult{Content: content.String(), Spooled: spooled}
+			if short {
+				res.Content = shortKey
+			}
+			if perma.Valid() {
+				if res.Permanode = perma.String(); short {
+					res.Permanode = camutil.RefToBase64(perma)
+				}
+			}
+			if !spooled {
+				res.Existed, res.Stats = stats.Existed(), &stats
+			}
+			_ = json.NewEncoder(b).Encode(res)
 		} else {
-			b.WriteString(content.String())
-		}
-		if perma.Valid() {
-			b.Write([]byte{'\n'})
+			w.Header().Add("Content-Type", "text/plain")
 			if short {
-				b.WriteString(camutil.RefToBase64(perma))
+				b.WriteString(shortKey)
 			} else {
-				b.WriteString(perma.String())
+				b.WriteString(content.String())
+			}
+			if perma.Valid() {
+				b.Write([]byte{'\n'})
+				if short {
+					b.WriteString(camutil.RefToBase64(perma))
+				} else {
+					b.WriteString(perma.String())
+				}
 			}
 		}
 		w.Header().Add("Content-Length", strconv.Itoa(len(b.Bytes())))
-		w.WriteHeader(201)
+		if spooled {
+			w.WriteHeader(http.StatusAccepted)
+		} else {
+			w.WriteHeader(201)
+		}
 		// nosemgrep: go.lang.security.audit.xss.no-direct-write-to-responsewriter.no-direct-write-to-responsewriter
 		w.Write(b.Bytes())
 	default:
@@ -386,7 +857,43 @@ func handle(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// basicAuthCheck returns the user checker of the other protocols (FTP):
+// the same as authenticate's, nil if there is none.
+func basicAuthCheck() func(user, password string) bool {
+	if *flagNoAuth {
+		return nil
+	}
+	return camutil.BasicAuthCheck(os.Getenv("CAMLI_AUTH"))
+}
+
+// authenticate wraps h with the HTTP Basic Authentication checker,
+// iff CAMLI_AUTH is set and -noauth is not.
+// The accepted user is stored in the context, see authUser.
+func authenticate(h http.Handler) http.Handler {
+	if *flagNoAuth {
+		return h
+	}
+	camliAuth := os.Getenv("CAMLI_AUTH")
+	if camutil.BasicAuthCheck(camliAuth) == nil {
+		return h
+	}
+	return camutil.SetupBasicAuthChecker(func(w http.ResponseWriter, r *http.Request) {
+		user, _, _ := r.BasicAuth()
+		setAccessUser(r.Context(), user)
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), ctxKeyAuthUser{}, user)))
+	}, camliAuth)
+}
+
+type ctxKeyAuthUser struct{}
+
+// authUser returns the user accepted by authenticate - empty if there was no authentication.
+func authUser(ctx context.Context) string {
+	user, _ := ctx.Value(ctxKeyAuthUser{}).(string)
+	return user
+}
+
 func saveDirectTo(destDir string, r *http.Request) (filename, mimeType string, err error) {
+	logger := zlog.SFromContext(r.Context())
 	mimeType = r.Header.Get("Content-Type")
 	lastmod := parseLastModified(r.Header.Get("Last-Modified"), r.URL.Query().Get("mtime"))
 	cd := r.Header.Get("Content-Disposition")
@@ -418,6 +925,7 @@ func saveDirectTo(destDir string, r *http.Request) (filename, mimeType string, e
 	_, err = io.Copy(fh, rdr)
 	if err != nil {
 		logger.Info("saving request body", "dst", fh.Name(), "error", err)
+		return "", "", fmt.Errorf("save request body to %q: %w", fh.Name(), err)
 	}
 	filename = fh.Name()
 	if !lastmod.IsZero() {
@@ -475,6 +983,9 @@ func saveMultipartTo(destDir string, mr *multipart.Reader, qmtime string) (filen
 			}
 		}
 	}
+	if err != nil && err != io.EOF {
+		return nil, nil, fmt.Errorf("read multipart: %w", err)
+	}
 	return filenames, mimetypes, nil
 }
 
@@ -593,15 +1104,115 @@ func (w *respWriter) Close() (err error) {
 	return
 }
 
+// serveArchive serves the trees items as a tar or zip archive,
+// filtered by the include, exclude, depth and max-size query parameters.
+func serveArchive(w http.ResponseWriter, r *http.Request, d *camutil.Downloader, format string, items []blob.Ref) {
+	values := r.URL.Query()
+	var opts camutil.SaveOptions
+	for _, x := range []struct {
+		dest *[]string
+		key  string
+	}{{&opts.Include, "include"}, {&opts.Exclude, "exclude"}} {
+		for _, v := range values[x.key] {
+			*x.dest = append(*x.dest, splitList(v)...)
+		}
+	}
+	var err error
+	if s := values.Get("depth"); s != "" {
+		if opts.MaxDepth, err = strconv.Atoi(s); err != nil {
+			http.Error(w, fmt.Sprintf("depth=%q: %v", s, err), 400)
+			return
+		}
+	}
+	if s := values.Get("max-size"); s != "" {
+		if opts.MaxSize, err = strconv.ParseInt(s, 10, 64); err != nil {
+			http.Error(w, fmt.Sprintf("max-size=%q: %v", s, err), 400)
+			return
+		}
+	}
+	var contentType string
+	switch format {
+	case "tar":
+		contentType = "application/x-tar"
+	case "zip":
+		contentType = "application/zip"
+	default:
+		http.Error(w, fmt.Sprintf("unknown archive format %q", format), 400)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", items[0].String()+"."+format))
+	// the archive is streamed: after the first write, the connection is
+	// aborted on error, so the client sees a truncated download
+	// (ErrTooLarge is returned before writing anything)
+	cw := &countingResponseWriter{ResponseWriter: w}
+	if err = d.WriteArchive(r.Context(), cw, format, opts, items...); err != nil {
+		zlog.SFromContext(r.Context()).Error("archive", "items", items, "error", err)
+		if cw.n != 0 || cw.status != 0 {
+			panic(http.ErrAbortHandler)
+		}
+		w.Header().Del("Content-Disposition")
+		httpError(w, err.Error(), err)
+	}
+}
+
+// splitList splits the comma-separated list s.
+func splitList(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
+// serveRange serves the (Range) request for the contents of br,
+// reading just the requested parts.
+func serveRange(w http.ResponseWriter, r *http.Request, d *camutil.Downloader, br blob.Ref, name, okMime string) {
+	sr, err := d.Stream(r.Context(), br)
+	if err != nil {
+		if serveParanoid(w, r, br, err) {
+			return
+		}
+		httpError(w, fmt.Sprintf("download error: %v", err), err)
+		return
+	}
+	defer sr.Close()
+	if okMime == "" || okMime == "application/octet-stream" {
+		if name != "" {
+			okMime = mimeCache.Get(name)
+		}
+		if okMime == "" {
+			b := make([]byte, 1024)
+			n, _ := io.ReadFull(sr, b)
+			if okMime = camutil.MatchMime(okMime, b[:n]); name != "" && okMime != "" {
+				mimeCache.Set(name, okMime)
+			}
+		}
+	}
+	if okMime != "" {
+		w.Header().Set("Content-Type", okMime)
+	}
+	w.Header().Set("ETag", `"`+br.String()+`"`)
+	http.ServeContent(w, r, "", time.Time{}, sr)
+}
+
 func getUploader() (*camutil.Uploader, error) {
-	return camutil.NewUploader(server,
+	u := camutil.NewUploader(server,
 		camutil.WithCapCtime(*flagCapCtime),
-		camutil.WithSkipHaveCache(*flagSkipHaveCache)), nil
+		camutil.WithSkipHaveCache(*flagSkipHaveCache),
+		camutil.WithIdentity(*flagIdentity))
+	if u == nil {
+		return nil, fmt.Errorf("cannot create uploader to %q", server)
+	}
+	return u, nil
 }
 
 func getDownloader() (*camutil.Downloader, error) {
 	return camutil.NewDownloader(server,
-		camutil.WithNoCache(*flagNoCache))
+		camutil.WithNoCache(*flagNoCache),
+		camutil.WithCache(*flagCacheDir, *flagCacheSize),
+		camutil.WithVerify(*flagVerify),
+		camutil.WithSecondaryServer(*flagSecondary),
+		camutil.WithPrefetch(*flagPrefetchDepth, *flagPrefetchPar))
 }
 
 func getParanoidPath(br blob.Ref) string {
@@ -641,6 +1252,9 @@ func wrapCtx(ctx context.Context) (context.Context, context.CancelFunc) {
 		sig := <-sigCh
 		signal.Stop(sigCh)
 		cancel()
+		if serving.Load() {
+			return // serveGraceful returns after the shutdown - a second signal kills
+		}
 		if p, _ := os.FindProcess(os.Getpid()); p != nil {
 			time.Sleep(time.Second)
 			_ = p.Signal(sig)
@@ -0,0 +1,85 @@
+// Copyright 2026 Tamás Gulácsi.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"perkeep.org/pkg/blob"
+
+	"github.com/tgulacsi/camproxy/camutil"
+)
+
+func TestServeArchiveError(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	setupBackend(t)
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "a.txt"), []byte("aaa"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	u, err := getUploader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := u.UploadPath(ctx, dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down, err := getDownloader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	serve := func(br blob.Ref) (w *httptest.ResponseRecorder, aborted bool) {
+		defer func() {
+			if r := recover(); r != nil {
+				if r != http.ErrAbortHandler {
+					panic(r)
+				}
+				aborted = true
+			}
+		}()
+		w = httptest.NewRecorder()
+		serveArchive(w, httptest.NewRequest("GET", "/"+br.String()+"?archive=tar", nil), down, "tar", []blob.Ref{br})
+		return w, false
+	}
+
+	// nothing is written yet: a proper error
+	w, aborted := serve(blob.RefFromString("missing"))
+	if aborted || w.Code == http.StatusOK || w.Header().Get("Content-Disposition") != "" {
+		t.Errorf("missing: got %d %v (aborted=%t)", w.Code, w.Header(), aborted)
+	}
+
+	// the directory is written, then a chunk of a.txt is missing: abort
+	e, err := down.Lookup(ctx, root, "a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := camutil.NewClient(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var parts []blob.Ref
+	if err = camutil.WalkBlobs(ctx, c, e.Ref, func(sr blob.SizedRef, err error) error {
+		if err == nil && sr.Ref != e.Ref {
+			parts = append(parts, sr.Ref)
+		}
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.RemoveBlobs(ctx, parts); err != nil {
+		t.Fatal(err)
+	}
+	if w, aborted = serve(root); !aborted {
+		t.Errorf("truncated archive is not aborted: got %d, %d bytes", w.Code, w.Body.Len())
+	}
+}
@@ -0,0 +1,349 @@
+// Copyright 2026 Tamás Gulácsi.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"perkeep.org/pkg/blob"
+
+	"github.com/UNO-SOFT/zlog/v2"
+	"github.com/tgulacsi/camproxy/camutil"
+)
+
+// paranoidFallbacks counts the GETs served from the paranoid store.
+var paranoidFallbacks = expvar.NewInt("paranoidFallbacks")
+
+// paranoidMeta is the sidecar metadata of a paranoid copy.
+type paranoidMeta struct {
+	FileName  string            `json:"fileName,omitempty"`
+	MIMEType  string            `json:"mimeType,omitempty"`
+	ModTime   time.Time         `json:"modTime,omitempty"`
+	Size      int64             `json:"size,omitempty"`
+	Uploaded  time.Time         `json:"uploaded,omitempty"`
+	User      string            `json:"user,omitempty"`
+	Attrs     map[string]string `json:"attrs,omitempty"`
+	Permanode string            `json:"permanode,omitempty"`
+}
+
+// getParanoidMetaPath returns the path of the sidecar of the paranoid copy.
+func getParanoidMetaPath(br blob.Ref) string {
+	fn := getParanoidPath(br)
+	if fn == "" {
+		return ""
+	}
+	return strings.TrimSuffix(fn, ".dat") + ".json"
+}
+
+func writeParanoidMeta(br blob.Ref, meta paranoidMeta) error {
+	b, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return writeFileSync(getParanoidMetaPath(br), b)
+}
+
+func readParanoidMeta(br blob.Ref) (paranoidMeta, error) {
+	var meta paranoidMeta
+	b, err := os.ReadFile(getParanoidMetaPath(br))
+	if err != nil {
+		return meta, err
+	}
+	err = json.Unmarshal(b, &meta)
+	return meta, err
+}
+
+// saveParanoid durably copies the uploaded file src as the paranoid copy of br,
+// and writes its sidecar.
+func saveParanoid(ctx context.Context, src string, br blob.Ref, meta paranoidMeta) error {
+	dst := getParanoidPath(br)
+	if dst == "" {
+		return nil
+	}
+	// nosemgrep: go.lang.correctness.permissions.file_permission.incorrect-default-permission
+	if err := os.MkdirAll(filepath.Dir(dst), 0700); err != nil {
+		return err
+	}
+	start := time.Now()
+	method, err := camutil.DurableCopy(src, dst)
+	if err != nil {
+		return fmt.Errorf("%s %q to %q: %w", method, src, dst, err)
+	}
+	zlog.SFromContext(ctx).Info("paranoid copy", "src", src, "dst", dst, "method", method, "dur", time.Since(start))
+	return writeParanoidMeta(br, meta)
+}
+
+// serveParanoid serves the paranoid copy of br, if exists.
+// Returns false if there's no such copy.
+func serveParanoid(w http.ResponseWriter, r *http.Request, br blob.Ref, downloadErr error) bool {
+	fn := getParanoidPath(br)
+	if fn == "" {
+		return false
+	}
+	fh, err := os.Open(fn)
+	if err != nil {
+		return false
+	}
+	defer fh.Close()
+	fi, err := fh.Stat()
+	if err != nil || !fi.Mode().IsRegular() {
+		return false
+	}
+	meta, err := readParanoidMeta(br)
+	if err != nil && !os.IsNotExist(err) {
+		zlog.SFromContext(r.Context()).Warn("read paranoid meta", "ref", br, "error", err)
+	}
+	if meta.MIMEType == "" && mimeCache != nil {
+		meta.MIMEType = mimeCache.Get(camutil.RefToBase64(br))
+	}
+	paranoidFallbacks.Add(1)
+	zlog.SFromContext(r.Context()).Warn("serving paranoid copy", "ref", br, "file", fn, "downloadError", downloadErr)
+	if meta.MIMEType != "" {
+		w.Header().Set("Content-Type", meta.MIMEType)
+	}
+	if meta.FileName != "" {
+		w.Header().Set("Content-Disposition",
+			mime.FormatMediaType("inline", map[string]string{"filename": meta.FileName}))
+	}
+	w.Header().Set("X-Camproxy-Source", "paranoid")
+	http.ServeContent(w, r, meta.FileName, fi.ModTime(), fh)
+	return true
+}
+
+// paranoidFileInfo is the FileInfo of the paranoid copy, with the name and
+// mtime of the uploaded file.
+type paranoidFileInfo struct {
+	os.FileInfo
+	name    string
+	modTime time.Time
+}
+
+func (fi paranoidFileInfo) Name() string { return fi.name }
+func (fi paranoidFileInfo) ModTime() time.Time {
+	if fi.modTime.IsZero() {
+		return fi.FileInfo.ModTime()
+	}
+	return fi.modTime
+}
+
+// paranoidCopy is a paranoid copy with its metadata.
+type paranoidCopy struct {
+	Ref  blob.Ref
+	Path string
+	Meta paranoidMeta
+}
+
+// walkParanoid calls fn for each copy under dir.
+func walkParanoid(dir string, fn func(paranoidCopy) error) error {
+	return filepath.WalkDir(dir, func(path string, de os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if de.IsDir() || !strings.HasSuffix(path, ".dat") {
+			return nil
+		}
+		br, ok := blob.Parse(strings.TrimSuffix(filepath.Base(path), ".dat"))
+		if !ok {
+			return nil
+		}
+		pc := paranoidCopy{Ref: br, Path: path}
+		if b, err := os.ReadFile(strings.TrimSuffix(path, ".dat") + ".json"); err == nil {
+			if err = json.Unmarshal(b, &pc.Meta); err != nil {
+				logger.Warn("parse sidecar", "path", path, "error", err)
+			}
+		}
+		return fn(pc)
+	})
+}
+
+// hash re-hashes the copy through the schema chunking, as it has been uploaded.
+func (pc paranoidCopy) hash(ctx context.Context) (blob.Ref, error) {
+	fh, err := os.Open(pc.Path)
+	if err != nil {
+		return blob.Ref{}, err
+	}
+	defer fh.Close()
+	fi, err := pc.fileInfo(fh)
+	if err != nil {
+		return blob.Ref{}, err
+	}
+	mimeType, r := pc.Meta.MIMEType, io.Reader(fh)
+	if mimeType == "" || mimeType == "application/octet-stream" {
+		mimeType, r = camutil.MIMETypeFromReader(fh)
+	}
+	return camutil.HashFileInfo(ctx, fi, mimeType, r)
+}
+
+func (pc paranoidCopy) fileInfo(fh *os.File) (os.FileInfo, error) {
+	fi, err := fh.Stat()
+	if err != nil {
+		return nil, err
+	}
+	name := pc.Meta.FileName
+	if name == "" {
+		name = fi.Name()
+	}
+	return paranoidFileInfo{FileInfo: fi, name: name, modTime: pc.Meta.ModTime}, nil
+}
+
+// paranoidStatus is the verification result of a paranoid copy.
+type paranoidStatus string
+
+const (
+	paranoidOK       = paranoidStatus("ok")
+	paranoidMismatch = paranoidStatus("mismatch")
+	paranoidMissing  = paranoidStatus("missing")
+	paranoidError    = paranoidStatus("error")
+)
+
+// verify re-hashes the copy, and checks that all the blobs of its file
+// (the schema blob and every part) exist on the server, with good hashes.
+func (pc paranoidCopy) verify(ctx context.Context, f blob.Fetcher) (paranoidStatus, error) {
+	got, err := pc.hash(ctx)
+	if err != nil {
+		return paranoidError, err
+	}
+	if got != pc.Ref {
+		return paranoidMismatch, fmt.Errorf("got %v", got)
+	}
+	vr, err := camutil.VerifyTree(ctx, f, pc.Ref)
+	if err != nil {
+		return paranoidError, err
+	}
+	switch {
+	case len(vr.Corrupt) != 0:
+		return paranoidError, fmt.Errorf("corrupt blobs on the server: %v", vr.Corrupt)
+	case len(vr.Failed) != 0:
+		return paranoidError, fmt.Errorf("cannot fetch %v", vr.Failed)
+	case len(vr.Missing) != 0:
+		if len(vr.Missing) == 1 && vr.Missing[0] == pc.Ref {
+			return paranoidMissing, nil
+		}
+		return paranoidMissing, fmt.Errorf("missing blobs: %v", vr.Missing)
+	}
+	return paranoidOK, nil
+}
+
+// remove removes the copy and its sidecar.
+func (pc paranoidCopy) remove() error {
+	err := os.Remove(pc.Path)
+	if sErr := os.Remove(strings.TrimSuffix(pc.Path, ".dat") + ".json"); sErr != nil && !os.IsNotExist(sErr) && err == nil {
+		err = sErr
+	}
+	return err
+}
+
+// replay uploads the copy again (with its attributes), and updates the sidecar.
+// Returns the new permanode.
+func (pc paranoidCopy) replay(ctx context.Context, u *camutil.Uploader) (blob.Ref, error) {
+	fh, err := os.Open(pc.Path)
+	if err != nil {
+		return blob.Ref{}, err
+	}
+	defer fh.Close()
+	fi, err := pc.fileInfo(fh)
+	if err != nil {
+		return blob.Ref{}, err
+	}
+	mimeType, r := pc.Meta.MIMEType, io.Reader(fh)
+	if mimeType == "" || mimeType == "application/octet-stream" {
+		mimeType, r = camutil.MIMETypeFromReader(fh)
+	}
+	content, perma, err := u.UploadReaderInfoLazyAttr(ctx, fi, mimeType, r, pc.Meta.Attrs)
+	if err != nil {
+		return perma, err
+	}
+	if content != pc.Ref {
+		return perma, fmt.Errorf("replayed %s as %v", pc.Ref, content)
+	}
+	if perma.Valid() {
+		pc.Meta.Permanode = perma.String()
+		if err = writeParanoidMeta(pc.Ref, pc.Meta); err != nil {
+			logger.Warn("update sidecar", "path", pc.Path, "error", err)
+		}
+	}
+	return perma, nil
+}
+
+// paranoidVerify verifies all the paranoid copies under dir, prints their
+// status, and prunes the verified ones older than pruneAge (if not zero).
+// With replay, the copies missing from the server are uploaded again.
+func paranoidVerify(ctx context.Context, dir string, pruneAge time.Duration, replay bool) error {
+	c, err := camutil.NewClient(server)
+	if err != nil {
+		return err
+	}
+	var u *camutil.Uploader
+	if replay {
+		if u, err = getUploader(); err != nil {
+			return err
+		}
+	}
+	counts := make(map[paranoidStatus]int)
+	var pruned, replayed int
+	err = walkParanoid(dir, func(pc paranoidCopy) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		status, err := pc.verify(ctx, c)
+		counts[status]++
+		msg := ""
+		if err != nil {
+			msg = err.Error()
+		}
+		fmt.Printf("%s\t%s\t%s\t%s\n", status, pc.Ref, pc.Path, msg)
+		switch status {
+		case paranoidMissing:
+			if !replay {
+				return nil
+			}
+			perma, err := pc.replay(ctx, u)
+			if err != nil {
+				fmt.Printf("replay\t%s\t%s\t%s\n", pc.Ref, pc.Path, err)
+				return nil
+			}
+			replayed++
+			fmt.Printf("replayed\t%s\t%s\t%s\n", pc.Ref, pc.Path, perma)
+		case paranoidOK:
+			if pruneAge <= 0 {
+				return nil
+			}
+			uploaded := pc.Meta.Uploaded
+			if uploaded.IsZero() {
+				if fi, err := os.Stat(pc.Path); err == nil {
+					uploaded = fi.ModTime()
+				}
+			}
+			if uploaded.IsZero() || time.Since(uploaded) < pruneAge {
+				return nil
+			}
+			if err := pc.remove(); err != nil {
+				logger.Warn("prune", "path", pc.Path, "error", err)
+				return nil
+			}
+			pruned++
+			fmt.Printf("pruned\t%s\t%s\n", pc.Ref, pc.Path)
+		}
+		return nil
+	})
+	logger.Info("paranoid verify", "counts", counts, "pruned", pruned, "replayed", replayed)
+	if err != nil {
+		return err
+	}
+	if n := counts[paranoidMismatch] + counts[paranoidError] + counts[paranoidMissing] - replayed; n != 0 {
+		return fmt.Errorf("%d paranoid copies have problems", n)
+	}
+	return nil
+}
@@ -0,0 +1,207 @@
+// Copyright 2026 Tamás Gulácsi.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"perkeep.org/pkg/blob"
+
+	"github.com/tgulacsi/camproxy/camutil"
+)
+
+// setupParanoid sets -paranoid and the server to an empty local storage,
+// for the duration of the test.
+func setupParanoid(t *testing.T) (dir string) {
+	t.Helper()
+	camutil.SetLogger(logger)
+	dir = t.TempDir()
+	backend := filepath.Join(dir, "backend")
+	// nosemgrep: go.lang.correctness.permissions.file_permission.incorrect-default-permission
+	if err := os.MkdirAll(backend, 0700); err != nil {
+		t.Fatal(err)
+	}
+	oldParanoid, oldServer, oldMimeCache := *flagParanoid, server, mimeCache
+	t.Cleanup(func() { *flagParanoid, server, mimeCache = oldParanoid, oldServer, oldMimeCache })
+	*flagParanoid, server = filepath.Join(dir, "paranoid"), "file://"+backend
+	mimeCache = camutil.NewMimeCache(filepath.Join(dir, "mimecache.kv"), 0)
+	t.Cleanup(func() { mimeCache.Close() })
+	return dir
+}
+
+// newParanoidCopy saves content as the paranoid copy of an upload named name,
+// and returns its ref, as the server would return it.
+func newParanoidCopy(ctx context.Context, t *testing.T, name, mimeType, content string, uploaded time.Time) blob.Ref {
+	t.Helper()
+	src := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(src, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	br, err := camutil.HashFileInfo(ctx, paranoidFileInfo{FileInfo: fi, name: name, modTime: fi.ModTime()},
+		mimeType, strings.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = saveParanoid(ctx, src, br, paranoidMeta{
+		FileName: name, MIMEType: mimeType, ModTime: fi.ModTime(), Size: fi.Size(),
+		Uploaded: uploaded,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return br
+}
+
+func TestParanoidFallback(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	setupParanoid(t)
+	br := newParanoidCopy(ctx, t, "hello.txt", "text/x-hello", "hello world", time.Now())
+
+	before := paranoidFallbacks.Value()
+	w := httptest.NewRecorder()
+	handle(w, httptest.NewRequest("GET", "/"+br.String(), nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", w.Code, w.Body)
+	}
+	if got := w.Body.String(); got != "hello world" {
+		t.Errorf("got %q", got)
+	}
+	for k, want := range map[string]string{
+		"Content-Type":      "text/x-hello",
+		"X-Camproxy-Source": "paranoid",
+	} {
+		if got := w.Header().Get(k); got != want {
+			t.Errorf("%s: got %q, wanted %q", k, got, want)
+		}
+	}
+	if got := w.Header().Get("Content-Disposition"); !strings.Contains(got, "hello.txt") {
+		t.Errorf("Content-Disposition: got %q", got)
+	}
+	if got := paranoidFallbacks.Value(); got != before+1 {
+		t.Errorf("fallbacks: got %d, wanted %d", got, before+1)
+	}
+
+	// Range requests are served from the copy, too
+	r := httptest.NewRequest("GET", "/"+br.String(), nil)
+	r.Header.Set("Range", "bytes=6-")
+	w = httptest.NewRecorder()
+	handle(w, r)
+	if w.Code != http.StatusPartialContent || w.Body.String() != "world" {
+		t.Errorf("range: got %d %q", w.Code, w.Body)
+	}
+
+	// without a copy, the download error is returned
+	other := blob.RefFromString("no copy")
+	w = httptest.NewRecorder()
+	handle(w, httptest.NewRequest("GET", "/"+other.String(), nil))
+	if w.Code == http.StatusOK || w.Header().Get("X-Camproxy-Source") != "" {
+		t.Errorf("no copy: got %d %v", w.Code, w.Header())
+	}
+	if b, _ := io.ReadAll(w.Body); strings.Contains(string(b), "hello") {
+		t.Errorf("no copy: got %q", b)
+	}
+}
+
+func TestServeParanoidNoCopy(t *testing.T) {
+	setupParanoid(t)
+	w := httptest.NewRecorder()
+	if serveParanoid(w, httptest.NewRequest("GET", "/", nil), blob.RefFromString("x"), errors.New("down")) {
+		t.Error("served a nonexistent copy")
+	}
+}
+
+func TestParanoidVerify(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	setupParanoid(t)
+	old := time.Now().Add(-30 * 24 * time.Hour)
+	good := newParanoidCopy(ctx, t, "good.txt", "text/plain", "good contents", old)
+	chunked := newParanoidCopy(ctx, t, "chunked.txt", "text/plain", "chunked contents", old)
+	bad := newParanoidCopy(ctx, t, "bad.txt", "text/plain", "bad contents", old)
+	if err := os.WriteFile(getParanoidPath(bad), []byte("corrupted!!!"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := camutil.NewClient(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	status := make(map[blob.Ref]paranoidStatus)
+	check := func() {
+		t.Helper()
+		clear(status)
+		if err := walkParanoid(*flagParanoid, func(pc paranoidCopy) error {
+			if pc.Meta.FileName == "" {
+				t.Errorf("%v: no sidecar", pc.Ref)
+			}
+			status[pc.Ref], _ = pc.verify(ctx, c)
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check()
+	if status[good] != paranoidMissing || status[chunked] != paranoidMissing || status[bad] != paranoidMismatch {
+		t.Fatalf("got %v", status)
+	}
+
+	// replay uploads the missing one, the corrupted one is an error
+	if err = paranoidVerify(ctx, *flagParanoid, 0, true); err == nil {
+		t.Error("the corrupted copy is not reported")
+	}
+	check()
+	if status[good] != paranoidOK || status[chunked] != paranoidOK || status[bad] != paranoidMismatch {
+		t.Fatalf("after replay: got %v", status)
+	}
+
+	// the file schema blob is there, but a chunk of it is not
+	var parts []blob.Ref
+	if err = camutil.WalkBlobs(ctx, c, chunked, func(sr blob.SizedRef, err error) error {
+		if err == nil && sr.Ref != chunked {
+			parts = append(parts, sr.Ref)
+		}
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(parts) == 0 {
+		t.Fatalf("%v has no parts", chunked)
+	}
+	if err = c.RemoveBlobs(ctx, parts[:1]); err != nil {
+		t.Fatal(err)
+	}
+	check()
+	if status[chunked] != paranoidMissing {
+		t.Fatalf("missing chunk: got %v", status)
+	}
+
+	// prune removes the verified old copies only
+	_ = paranoidVerify(ctx, *flagParanoid, 24*time.Hour, false)
+	if _, err = os.Stat(getParanoidPath(good)); !os.IsNotExist(err) {
+		t.Errorf("verified copy is not pruned: %v", err)
+	}
+	if _, err = os.Stat(getParanoidMetaPath(good)); !os.IsNotExist(err) {
+		t.Errorf("sidecar is not pruned: %v", err)
+	}
+	if _, err = os.Stat(getParanoidPath(bad)); err != nil {
+		t.Errorf("corrupted copy is pruned: %v", err)
+	}
+	if _, err = os.Stat(getParanoidPath(chunked)); err != nil {
+		t.Errorf("copy with a missing chunk is pruned: %v", err)
+	}
+}
@@ -0,0 +1,375 @@
+// Copyright 2026 Tamás Gulácsi.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tokenBucket is a token bucket: it is refilled with rate tokens per second,
+// up to burst tokens.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate, burst float64) *tokenBucket {
+	if burst < 1 {
+		burst = math.Max(1, rate)
+	}
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if !b.last.IsZero() {
+		b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	}
+	b.last = now
+}
+
+// Allow takes one token if available, or returns the time to wait for it.
+func (b *tokenBucket) Allow(now time.Time) (bool, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(now)
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+// Take takes n tokens - going into debt if needed -, and returns the time
+// to wait until the debt is paid back.
+func (b *tokenBucket) Take(now time.Time, n float64) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(now)
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// Tokens returns the currently available tokens.
+func (b *tokenBucket) Tokens(now time.Time) float64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(now)
+	return b.tokens
+}
+
+// rateLimit is the requests/sec and bytes/sec limit.
+type rateLimit struct {
+	Requests float64 `json:"requests"`
+	Bytes    float64 `json:"bytes"`
+}
+
+type clientLimiter struct {
+	limit        rateLimit
+	reqs, bytes  *tokenBucket
+	mu           sync.Mutex
+	requests     int64
+	rejected     int64
+	bytesRead    int64
+	bytesWritten int64
+	lastSeen     time.Time
+}
+
+// rateLimiter limits the requests and the bandwidth per client key
+// (authenticated user or client IP).
+type rateLimiter struct {
+	mu        sync.Mutex
+	clients   map[string]*clientLimiter
+	def       rateLimit
+	keyLimits map[string]rateLimit
+	lastPrune time.Time
+}
+
+func newRateLimiter(def rateLimit, keyLimits map[string]rateLimit) *rateLimiter {
+	return &rateLimiter{clients: make(map[string]*clientLimiter), def: def, keyLimits: keyLimits}
+}
+
+// clientKey returns the key of the client: the user accepted by
+// authenticate, or the client IP - the unverified Authorization header
+// is not trusted, as it could be rotated to get fresh buckets.
+func clientKey(r *http.Request) string {
+	if user := authUser(r.Context()); user != "" {
+		return "user:" + user
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+func (rl *rateLimiter) get(key string, now time.Time) *clientLimiter {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if now.Sub(rl.lastPrune) > time.Minute {
+		rl.lastPrune = now
+		for k, cl := range rl.clients {
+			cl.mu.Lock()
+			idle := now.Sub(cl.lastSeen) > 10*time.Minute
+			cl.mu.Unlock()
+			if idle {
+				delete(rl.clients, k)
+			}
+		}
+	}
+	cl := rl.clients[key]
+	if cl == nil {
+		limit, ok := rl.keyLimits[key]
+		if !ok {
+			_, k, _ := strings.Cut(key, ":")
+			if limit, ok = rl.keyLimits[k]; !ok {
+				limit = rl.def
+			}
+		}
+		cl = &clientLimiter{limit: limit}
+		if limit.Requests > 0 {
+			cl.reqs = newTokenBucket(limit.Requests, 0)
+		}
+		if limit.Bytes > 0 {
+			cl.bytes = newTokenBucket(limit.Bytes, limit.Bytes)
+		}
+		rl.clients[key] = cl
+	}
+	cl.mu.Lock()
+	cl.lastSeen = now
+	cl.mu.Unlock()
+	return cl
+}
+
+// Wrap returns a handler which rejects the requests over the limit with 429,
+// and shapes the request and response bodies to the bytes/sec limit.
+func (rl *rateLimiter) Wrap(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cl, wait := rl.admit(clientKey(r), time.Now())
+		if wait > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			http.Error(w, "too many requests", http.StatusTooManyRequests)
+			return
+		}
+		if cl.bytes != nil {
+			ctx := r.Context()
+			r.Body = &shapedReader{ReadCloser: r.Body, ctx: ctx, cl: cl}
+			w = &shapedResponseWriter{ResponseWriter: w, ctx: ctx, cl: cl}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// errRateLimited is the error of the requests over the limit.
+var errRateLimited = errors.New("too many requests")
+
+// allow is the rate limit of Wrap for the requests not through HTTP
+// (FTP, SFTP, scp), with the same client key: it returns the limiter of key
+// to shape the transfer with, or errRateLimited. A nil rl means no limits.
+func (rl *rateLimiter) allow(key string) (*clientLimiter, error) {
+	if rl == nil {
+		return nil, nil
+	}
+	cl, wait := rl.admit(key, time.Now())
+	if wait > 0 {
+		return nil, fmt.Errorf("%w, retry after %s", errRateLimited, wait.Round(time.Second))
+	}
+	return cl, nil
+}
+
+// admit counts a request of key, and returns its limiter,
+// or the time to wait if the request is over the limit.
+func (rl *rateLimiter) admit(key string, now time.Time) (*clientLimiter, time.Duration) {
+	cl := rl.get(key, now)
+	cl.mu.Lock()
+	cl.requests++
+	cl.mu.Unlock()
+	if cl.reqs != nil {
+		if ok, wait := cl.reqs.Allow(now); !ok {
+			cl.mu.Lock()
+			cl.rejected++
+			cl.mu.Unlock()
+			return cl, wait
+		}
+	}
+	return cl, 0
+}
+
+// Reader returns r shaped to the bytes/sec limit.
+func (cl *clientLimiter) Reader(ctx context.Context, r io.Reader) io.Reader {
+	if cl == nil || cl.bytes == nil {
+		return r
+	}
+	return &shapedReader{ReadCloser: io.NopCloser(r), ctx: ctx, cl: cl}
+}
+
+// Writer returns w shaped to the bytes/sec limit.
+func (cl *clientLimiter) Writer(ctx context.Context, w io.Writer) io.Writer {
+	if cl == nil || cl.bytes == nil {
+		return w
+	}
+	return &shapedWriter{w: w, ctx: ctx, cl: cl}
+}
+
+// wait takes n bytes from the client's bucket and sleeps to pay back the debt.
+func (cl *clientLimiter) wait(ctx context.Context, n int, read bool) error {
+	cl.mu.Lock()
+	if read {
+		cl.bytesRead += int64(n)
+	} else {
+		cl.bytesWritten += int64(n)
+	}
+	cl.mu.Unlock()
+	if n <= 0 {
+		return nil
+	}
+	d := cl.bytes.Take(time.Now(), float64(n))
+	if d <= 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+type shapedReader struct {
+	io.ReadCloser
+	ctx context.Context
+	cl  *clientLimiter
+}
+
+func (r *shapedReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if waitErr := r.cl.wait(r.ctx, n, true); waitErr != nil && err == nil {
+		err = waitErr
+	}
+	return n, err
+}
+
+type shapedWriter struct {
+	w   io.Writer
+	ctx context.Context
+	cl  *clientLimiter
+}
+
+func (w *shapedWriter) Write(p []byte) (int, error) {
+	if err := w.cl.wait(w.ctx, len(p), false); err != nil {
+		return 0, err
+	}
+	return w.w.Write(p)
+}
+
+type shapedResponseWriter struct {
+	http.ResponseWriter
+	ctx context.Context
+	cl  *clientLimiter
+}
+
+func (w *shapedResponseWriter) Write(p []byte) (int, error) {
+	if err := w.cl.wait(w.ctx, len(p), false); err != nil {
+		return 0, err
+	}
+	return w.ResponseWriter.Write(p)
+}
+func (w *shapedResponseWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
+
+type clientUsage struct {
+	Key           string    `json:"key"`
+	Limit         rateLimit `json:"limit"`
+	RequestTokens *float64  `json:"requestTokens,omitempty"`
+	ByteTokens    *float64  `json:"byteTokens,omitempty"`
+	Requests      int64     `json:"requests"`
+	Rejected      int64     `json:"rejected"`
+	BytesRead     int64     `json:"bytesRead"`
+	BytesWritten  int64     `json:"bytesWritten"`
+	LastSeen      time.Time `json:"lastSeen"`
+}
+
+// ServeHTTP shows the current usage per key.
+func (rl *rateLimiter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	rl.mu.Lock()
+	usage := make([]clientUsage, 0, len(rl.clients))
+	for k, cl := range rl.clients {
+		cl.mu.Lock()
+		u := clientUsage{
+			Key: k, Limit: cl.limit,
+			Requests: cl.requests, Rejected: cl.rejected,
+			BytesRead: cl.bytesRead, BytesWritten: cl.bytesWritten,
+			LastSeen: cl.lastSeen,
+		}
+		cl.mu.Unlock()
+		if cl.reqs != nil {
+			f := cl.reqs.Tokens(now)
+			u.RequestTokens = &f
+		}
+		if cl.bytes != nil {
+			f := cl.bytes.Tokens(now)
+			u.ByteTokens = &f
+		}
+		usage = append(usage, u)
+	}
+	rl.mu.Unlock()
+	sort.Slice(usage, func(i, j int) bool { return usage[i].Key < usage[j].Key })
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(struct {
+		Default rateLimit     `json:"default"`
+		Clients []clientUsage `json:"clients"`
+	}{rl.def, usage})
+}
+
+// parseRateLimits parses the "key=requests/sec:bytes/sec,..." list.
+func parseRateLimits(s string) (map[string]rateLimit, error) {
+	if s == "" {
+		return nil, nil
+	}
+	m := make(map[string]rateLimit)
+	for _, kv := range strings.Split(s, ",") {
+		if kv = strings.TrimSpace(kv); kv == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok {
+			return m, fmt.Errorf("%q: no = in %q", s, kv)
+		}
+		reqs, bytes, _ := strings.Cut(v, ":")
+		var limit rateLimit
+		var err error
+		if reqs != "" {
+			if limit.Requests, err = strconv.ParseFloat(reqs, 64); err != nil {
+				return m, fmt.Errorf("%q: %w", kv, err)
+			}
+		}
+		if bytes != "" {
+			if limit.Bytes, err = strconv.ParseFloat(bytes, 64); err != nil {
+				return m, fmt.Errorf("%q: %w", kv, err)
+			}
+		}
+		m[strings.TrimSpace(k)] = limit
+	}
+	return m, nil
+}
@@ -0,0 +1,85 @@
+// Copyright 2026 Tamás Gulácsi.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	b := newTokenBucket(2, 2)
+	for i := 0; i < 2; i++ {
+		if ok, _ := b.Allow(now); !ok {
+			t.Fatalf("%d. not allowed", i)
+		}
+	}
+	ok, wait := b.Allow(now)
+	if ok {
+		t.Fatal("allowed over burst")
+	}
+	if wait != 500*time.Millisecond {
+		t.Errorf("wait=%s, wanted 500ms", wait)
+	}
+	if ok, _ = b.Allow(now.Add(wait)); !ok {
+		t.Error("not allowed after wait")
+	}
+
+	b = newTokenBucket(100, 100)
+	if d := b.Take(now, 300); d != 2*time.Second {
+		t.Errorf("Take(300)=%s, wanted 2s", d)
+	}
+}
+
+func TestParseRateLimits(t *testing.T) {
+	m, err := parseRateLimits("user:a=1:1024, 10.0.0.1=:2048")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := m["user:a"]; got != (rateLimit{Requests: 1, Bytes: 1024}) {
+		t.Errorf("user:a: got %+v", got)
+	}
+	if got := m["10.0.0.1"]; got != (rateLimit{Bytes: 2048}) {
+		t.Errorf("10.0.0.1: got %+v", got)
+	}
+}
+
+func TestClientKey(t *testing.T) {
+	var got string
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { got = clientKey(r) })
+	do := func(h http.Handler, user, passw, bearer string) int {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = "10.0.0.1:1234"
+		if user != "" {
+			r.SetBasicAuth(user, passw)
+		} else if bearer != "" {
+			r.Header.Set("Authorization", "Bearer "+bearer)
+		}
+		w := httptest.NewRecorder()
+		got = ""
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	// without authentication, the Authorization header is not trusted
+	t.Setenv("CAMLI_AUTH", "")
+	for _, elt := range [][3]string{{"a", "x", ""}, {"b", "y", ""}, {"", "", "tok"}} {
+		do(authenticate(h), elt[0], elt[1], elt[2])
+		if got != "ip:10.0.0.1" {
+			t.Errorf("no auth, %q: got %q", elt, got)
+		}
+	}
+
+	t.Setenv("CAMLI_AUTH", "userpass:alice:secret")
+	if code := do(authenticate(h), "alice", "bad", ""); code != http.StatusUnauthorized || got != "" {
+		t.Errorf("bad password: got %d %q", code, got)
+	}
+	if do(authenticate(h), "alice", "secret", ""); got != "user:alice" {
+		t.Errorf("good password: got %q", got)
+	}
+}
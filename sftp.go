@@ -0,0 +1,521 @@
+// Copyright 2026 Tamás Gulácsi.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tgulacsi/camproxy/camutil"
+	"perkeep.org/pkg/blob"
+)
+
+// The SFTP (version 3) packet types and status codes,
+// see draft-ietf-secsh-filexfer-02.
+const (
+	sshFxpInit     = 1
+	sshFxpVersion  = 2
+	sshFxpOpen     = 3
+	sshFxpClose    = 4
+	sshFxpRead     = 5
+	sshFxpWrite    = 6
+	sshFxpLstat    = 7
+	sshFxpFstat    = 8
+	sshFxpSetstat  = 9
+	sshFxpFsetstat = 10
+	sshFxpOpendir  = 11
+	sshFxpReaddir  = 12
+	sshFxpRemove   = 13
+	sshFxpMkdir    = 14
+	sshFxpRmdir    = 15
+	sshFxpRealpath = 16
+	sshFxpStat     = 17
+	sshFxpRename   = 18
+	sshFxpReadlink = 19
+	sshFxpSymlink  = 20
+	sshFxpStatus   = 101
+	sshFxpHandle   = 102
+	sshFxpData     = 103
+	sshFxpName     = 104
+	sshFxpAttrs    = 105
+
+	sshFxOK               = 0
+	sshFxEOF              = 1
+	sshFxNoSuchFile       = 2
+	sshFxPermissionDenied = 3
+	sshFxFailure          = 4
+	sshFxBadMessage       = 5
+	sshFxOpUnsupported    = 8
+
+	sshFxfWrite = 0x02
+
+	sshFileXferAttrSize        = 0x01
+	sshFileXferAttrPermissions = 0x04
+	sshFileXferAttrACModTime   = 0x08
+
+	sftpMaxPacket  = 1 << 18
+	sftpMaxRead    = 1 << 15
+	sftpDirEntries = 100
+)
+
+// sftpServer serves the SFTP subsystem of an SSH session:
+// /<ref>/sub/path reads the file (or lists the directory) of the stored tree,
+// a file written into / is uploaded when closed, and the refs of the uploads
+// are listed in /receipt.txt.
+type sftpServer struct {
+	ss      *sshSession
+	r       *bufio.Reader
+	w       io.Writer
+	handles map[string]any
+	next    uint64
+}
+
+// sftpEntry is a file or directory of the SFTP tree.
+type sftpEntry struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	mtime   time.Time
+	ref     blob.Ref
+	receipt bool
+}
+
+type sftpReadFile struct {
+	data []byte // the receipt
+	sr   *camutil.StreamReader
+}
+type sftpWriteFile struct {
+	name string
+	fh   *os.File
+	q    *uploadQuota
+	cl   *clientLimiter
+}
+type sftpDir struct{ entries []sftpEntry }
+
+func newSFTPServer(ss *sshSession, rw io.ReadWriter) *sftpServer {
+	return &sftpServer{ss: ss, r: bufio.NewReader(rw), w: rw, handles: make(map[string]any)}
+}
+
+// serve serves the requests until EOF.
+func (s *sftpServer) serve() error {
+	defer s.closeAll()
+	for {
+		pkt, err := s.readPacket()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		if err = s.handle(pkt); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *sftpServer) closeAll() {
+	for _, h := range s.handles {
+		switch h := h.(type) {
+		case *sftpReadFile:
+			if h.sr != nil {
+				h.sr.Close()
+			}
+		case *sftpWriteFile:
+			h.close()
+		}
+	}
+}
+
+func (h *sftpWriteFile) close() {
+	h.fh.Close()
+	os.Remove(h.fh.Name())
+	h.q.Release()
+}
+
+func (s *sftpServer) readPacket() ([]byte, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(s.r, hdr[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(hdr[:])
+	if n == 0 || n > sftpMaxPacket {
+		return nil, fmt.Errorf("bad packet length %d", n)
+	}
+	pkt := make([]byte, n)
+	if _, err := io.ReadFull(s.r, pkt); err != nil {
+		return nil, err
+	}
+	return pkt, nil
+}
+
+func (s *sftpServer) send(m sftpMsg) error {
+	b := make([]byte, 4, 4+len(m))
+	binary.BigEndian.PutUint32(b, uint32(len(m)))
+	_, err := s.w.Write(append(b, m...))
+	return err
+}
+
+func (s *sftpServer) status(id uint32, code uint32, msg string) error {
+	return s.send(sftpMsg{sshFxpStatus}.u32(id).u32(code).str(msg).str(""))
+}
+
+// errStatus sends the status of err.
+func (s *sftpServer) errStatus(id uint32, err error) error {
+	code := uint32(sshFxFailure)
+	switch {
+	case err == nil:
+		code = sshFxOK
+	case errors.Is(err, os.ErrNotExist), errors.Is(err, camutil.ErrNotFound):
+		code = sshFxNoSuchFile
+	case errors.Is(err, os.ErrPermission):
+		code = sshFxPermissionDenied
+	}
+	if err != nil && code == sshFxFailure {
+		s.ss.logger.Warn("sftp", "error", err)
+	}
+	msg := "OK"
+	if err != nil {
+		msg = err.Error()
+	}
+	return s.status(id, code, msg)
+}
+
+func (s *sftpServer) handle(pkt []byte) error {
+	typ := pkt[0]
+	p := sftpParser{b: pkt[1:]}
+	if typ == sshFxpInit {
+		return s.send(sftpMsg{sshFxpVersion}.u32(3))
+	}
+	id := p.u32()
+	if p.err != nil {
+		return p.err
+	}
+	switch typ {
+	case sshFxpRealpath:
+		name := path.Clean("/" + p.str())
+		return s.send(sftpMsg{sshFxpName}.u32(id).u32(1).str(name).str(name).u32(0))
+
+	case sshFxpStat, sshFxpLstat:
+		e, err := s.resolve(p.str())
+		if err != nil {
+			return s.errStatus(id, err)
+		}
+		return s.send(sftpMsg{sshFxpAttrs}.u32(id).attrs(e))
+
+	case sshFxpFstat:
+		switch h := s.handles[p.str()].(type) {
+		case *sftpWriteFile:
+			fi, err := h.fh.Stat()
+			if err != nil {
+				return s.errStatus(id, err)
+			}
+			return s.send(sftpMsg{sshFxpAttrs}.u32(id).attrs(sftpEntry{name: h.name, size: fi.Size(), mode: 0644, mtime: fi.ModTime()}))
+		case *sftpReadFile:
+			e := sftpEntry{mode: 0444, size: int64(len(h.data)), mtime: time.Now()}
+			if h.sr != nil {
+				e.size = h.sr.Size()
+			}
+			return s.send(sftpMsg{sshFxpAttrs}.u32(id).attrs(e))
+		case *sftpDir:
+			return s.send(sftpMsg{sshFxpAttrs}.u32(id).attrs(sftpEntry{mode: os.ModeDir | 0555}))
+		}
+		return s.status(id, sshFxFailure, "bad handle")
+
+	case sshFxpSetstat, sshFxpFsetstat:
+		return s.status(id, sshFxOK, "ignored")
+
+	case sshFxpOpen:
+		name, pflags := p.str(), p.u32()
+		if p.err != nil {
+			return s.status(id, sshFxBadMessage, p.err.Error())
+		}
+		return s.open(id, name, pflags)
+
+	case sshFxpOpendir:
+		return s.opendir(id, p.str())
+
+	case sshFxpReaddir:
+		h, ok := s.handles[p.str()].(*sftpDir)
+		if !ok {
+			return s.status(id, sshFxFailure, "bad handle")
+		}
+		if len(h.entries) == 0 {
+			return s.status(id, sshFxEOF, "EOF")
+		}
+		list := h.entries[:min(len(h.entries), sftpDirEntries)]
+		h.entries = h.entries[len(list):]
+		m := sftpMsg{sshFxpName}.u32(id).u32(uint32(len(list)))
+		for _, e := range list {
+			m = m.str(e.name).str(lsLine(e.mode, s.ss.user, e.size, e.mtime, e.name)).attrs(e)
+		}
+		return s.send(m)
+
+	case sshFxpRead:
+		handle, off, n := p.str(), p.u64(), p.u32()
+		h, ok := s.handles[handle].(*sftpReadFile)
+		if !ok || p.err != nil {
+			return s.status(id, sshFxFailure, "bad handle")
+		}
+		data, err := h.readAt(int64(off), int(min(n, sftpMaxRead)))
+		if err != nil {
+			return s.errStatus(id, err)
+		}
+		if len(data) == 0 {
+			return s.status(id, sshFxEOF, "EOF")
+		}
+		return s.send(sftpMsg{sshFxpData}.u32(id).bytes(data))
+
+	case sshFxpWrite:
+		handle, off, data := p.str(), p.u64(), p.bytes()
+		h, ok := s.handles[handle].(*sftpWriteFile)
+		if !ok || p.err != nil {
+			return s.status(id, sshFxFailure, "bad handle")
+		}
+		// the file can't grow over -max-upload, or the temp budget
+		end := off + uint64(len(data))
+		if end < off || end > math.MaxInt64 {
+			return s.errStatus(id, errTooLarge)
+		}
+		if err := h.q.grow(int64(end)); err != nil {
+			return s.errStatus(id, err)
+		}
+		if h.cl != nil && h.cl.bytes != nil {
+			if err := h.cl.wait(s.ss.ctx, len(data), true); err != nil {
+				return s.errStatus(id, err)
+			}
+		}
+		_, err := h.fh.WriteAt(data, int64(off))
+		return s.errStatus(id, err)
+
+	case sshFxpClose:
+		handle := p.str()
+		h := s.handles[handle]
+		delete(s.handles, handle)
+		switch h := h.(type) {
+		case *sftpReadFile:
+			if h.sr != nil {
+				h.sr.Close()
+			}
+		case *sftpWriteFile:
+			_, err := s.ss.upload(h.name, h.fh)
+			h.close()
+			return s.errStatus(id, err)
+		case nil:
+			return s.status(id, sshFxFailure, "bad handle")
+		}
+		return s.status(id, sshFxOK, "OK")
+
+	case sshFxpRemove, sshFxpMkdir, sshFxpRmdir, sshFxpRename, sshFxpSymlink:
+		return s.status(id, sshFxPermissionDenied, "read-only, except uploads into /")
+	case sshFxpReadlink:
+		return s.status(id, sshFxOpUnsupported, "no symlinks")
+	}
+	return s.status(id, sshFxOpUnsupported, "unsupported")
+}
+
+func (s *sftpServer) addHandle(h any) string {
+	s.next++
+	handle := strconv.FormatUint(s.next, 10)
+	s.handles[handle] = h
+	return handle
+}
+
+func (s *sftpServer) open(id uint32, name string, pflags uint32) error {
+	name = path.Clean("/" + name)
+	if pflags&sshFxfWrite != 0 {
+		if path.Dir(name) != "/" || name == "/"+sshReceiptName {
+			return s.status(id, sshFxPermissionDenied, "upload into / only")
+		}
+		q, cl, err := s.ss.startUpload()
+		if err != nil {
+			return s.errStatus(id, err)
+		}
+		fh, err := os.CreateTemp("", "camproxy-sftp-")
+		if err != nil {
+			q.Release()
+			return s.errStatus(id, err)
+		}
+		h := &sftpWriteFile{name: path.Base(name), fh: fh, q: q, cl: cl}
+		return s.send(sftpMsg{sshFxpHandle}.u32(id).str(s.addHandle(h)))
+	}
+	e, err := s.resolve(name)
+	if err != nil {
+		return s.errStatus(id, err)
+	}
+	if e.mode.IsDir() {
+		return s.status(id, sshFxFailure, name+" is a directory")
+	}
+	h := &sftpReadFile{}
+	if e.receipt {
+		h.data = s.ss.receiptBytes()
+	} else {
+		d, err := getDownloader()
+		if err != nil {
+			return s.errStatus(id, err)
+		}
+		if h.sr, err = d.Stream(s.ss.ctx, e.ref); err != nil {
+			return s.errStatus(id, err)
+		}
+	}
+	return s.send(sftpMsg{sshFxpHandle}.u32(id).str(s.addHandle(h)))
+}
+
+func (s *sftpServer) opendir(id uint32, name string) error {
+	e, err := s.resolve(name)
+	if err != nil {
+		return s.errStatus(id, err)
+	}
+	if !e.mode.IsDir() {
+		return s.status(id, sshFxFailure, name+" is not a directory")
+	}
+	var entries []sftpEntry
+	if !e.ref.Valid() { // the root
+		entries = append(s.ss.uploadedEntries(), s.receiptEntry())
+	} else {
+		d, err := getDownloader()
+		if err != nil {
+			return s.errStatus(id, err)
+		}
+		list, err := d.ReadDir(s.ss.ctx, e.ref)
+		if err != nil {
+			return s.errStatus(id, err)
+		}
+		for _, de := range list {
+			entries = append(entries, newSFTPEntry(de))
+		}
+	}
+	return s.send(sftpMsg{sshFxpHandle}.u32(id).str(s.addHandle(&sftpDir{entries: entries})))
+}
+
+func (s *sftpServer) receiptEntry() sftpEntry {
+	return sftpEntry{name: sshReceiptName, size: int64(len(s.ss.receiptBytes())), mode: 0444, mtime: time.Now(), receipt: true}
+}
+
+// resolve returns the entry of the path name.
+func (s *sftpServer) resolve(name string) (sftpEntry, error) {
+	name = path.Clean("/" + name)
+	switch name {
+	case "/":
+		return sftpEntry{name: "/", mode: os.ModeDir | 0555, mtime: time.Now()}, nil
+	case "/" + sshReceiptName:
+		return s.receiptEntry(), nil
+	}
+	first, rest, _ := strings.Cut(name[1:], "/")
+	if rest == "" {
+		if e, ok := s.ss.uploadedEntry(first); ok {
+			return e, nil
+		}
+	}
+	br, err := parseRef(first)
+	if err != nil {
+		return sftpEntry{}, fmt.Errorf("%s: %w", name, os.ErrNotExist)
+	}
+	d, err := getDownloader()
+	if err != nil {
+		return sftpEntry{}, err
+	}
+	de, err := d.Lookup(s.ss.ctx, br, rest)
+	if err != nil {
+		return sftpEntry{}, err
+	}
+	e := newSFTPEntry(de)
+	e.name = path.Base(name)
+	return e, nil
+}
+
+func newSFTPEntry(de camutil.DirEntry) sftpEntry {
+	e := sftpEntry{name: de.Name, size: de.Size, mode: 0444, mtime: de.ModTime, ref: de.Ref}
+	if de.IsDir() {
+		e.mode = os.ModeDir | 0555
+	}
+	return e
+}
+
+// readAt reads at most n bytes from off.
+func (h *sftpReadFile) readAt(off int64, n int) ([]byte, error) {
+	if h.sr == nil {
+		if off >= int64(len(h.data)) {
+			return nil, nil
+		}
+		return h.data[off:min(int64(len(h.data)), off+int64(n))], nil
+	}
+	if cur, _ := h.sr.Seek(0, io.SeekCurrent); cur != off {
+		if _, err := h.sr.Seek(off, io.SeekStart); err != nil {
+			return nil, err
+		}
+	}
+	b := make([]byte, n)
+	k, err := io.ReadFull(h.sr, b)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	return b[:k], err
+}
+
+// sftpMsg builds an SFTP packet.
+type sftpMsg []byte
+
+func (m sftpMsg) u32(v uint32) sftpMsg { return binary.BigEndian.AppendUint32(m, v) }
+func (m sftpMsg) u64(v uint64) sftpMsg { return binary.BigEndian.AppendUint64(m, v) }
+func (m sftpMsg) str(s string) sftpMsg { return append(m.u32(uint32(len(s))), s...) }
+func (m sftpMsg) bytes(b []byte) sftpMsg {
+	return append(m.u32(uint32(len(b))), b...)
+}
+func (m sftpMsg) attrs(e sftpEntry) sftpMsg {
+	mode := uint32(e.mode.Perm()) | 0o100000
+	if e.mode.IsDir() {
+		mode = uint32(e.mode.Perm()) | 0o040000
+	}
+	mt := uint32(e.mtime.Unix())
+	return m.u32(sshFileXferAttrSize | sshFileXferAttrPermissions | sshFileXferAttrACModTime).
+		u64(uint64(e.size)).u32(mode).u32(mt).u32(mt)
+}
+
+// sftpParser parses an SFTP packet; the first error is kept in err.
+type sftpParser struct {
+	b   []byte
+	err error
+}
+
+var errShortPacket = errors.New("short packet")
+
+func (p *sftpParser) u32() uint32 {
+	if len(p.b) < 4 {
+		p.err, p.b = errShortPacket, nil
+		return 0
+	}
+	v := binary.BigEndian.Uint32(p.b)
+	p.b = p.b[4:]
+	return v
+}
+func (p *sftpParser) u64() uint64 {
+	if len(p.b) < 8 {
+		p.err, p.b = errShortPacket, nil
+		return 0
+	}
+	v := binary.BigEndian.Uint64(p.b)
+	p.b = p.b[8:]
+	return v
+}
+func (p *sftpParser) bytes() []byte {
+	n := p.u32()
+	if uint32(len(p.b)) < n {
+		p.err, p.b = errShortPacket, nil
+		return nil
+	}
+	b := p.b[:n]
+	p.b = p.b[n:]
+	return b
+}
+func (p *sftpParser) str() string { return string(p.bytes()) }
@@ -0,0 +1,288 @@
+// Copyright 2026 Tamás Gulácsi.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestHasFlag(t *testing.T) {
+	for i, elt := range []struct {
+		args []string
+		want bool
+	}{
+		{[]string{"-t", "/"}, true},
+		{[]string{"-r", "-t", "--", "x"}, true},
+		{[]string{"-rt", "x"}, true},
+		{[]string{"-f", "x"}, false},
+		{[]string{"--t", "t"}, false},
+	} {
+		if got := hasFlag(elt.args, 't'); got != elt.want {
+			t.Errorf("%d. %q: got %t, wanted %t", i, elt.args, got, elt.want)
+		}
+	}
+}
+
+// newTestSSHKey returns a new public key.
+func newTestSSHKey(t *testing.T) ssh.PublicKey {
+	t.Helper()
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+// authorizedKeyLine returns the authorized_keys line of key.
+func authorizedKeyLine(options string, key ssh.PublicKey, comment string) string {
+	line := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+	if options != "" {
+		line = options + " " + line
+	}
+	if comment != "" {
+		line += " " + comment
+	}
+	return line + "\n"
+}
+
+func TestAuthorizedKey(t *testing.T) {
+	a, b, c, d := newTestSSHKey(t), newTestSSHKey(t), newTestSSHKey(t), newTestSSHKey(t)
+	file := []byte("# comment\n" +
+		authorizedKeyLine(`environment="CAMPROXY_USER=alice",no-pty`, a, "someone@laptop") +
+		authorizedKeyLine("", b, "bob@host") +
+		authorizedKeyLine("", c, ""))
+	for i, elt := range []struct {
+		key  ssh.PublicKey
+		user string
+		ok   bool
+	}{
+		{a, "alice", true},
+		{b, "bob", true},
+		{c, "", true},
+		{d, "", false},
+	} {
+		if user, ok := authorizedKey(file, elt.key); user != elt.user || ok != elt.ok {
+			t.Errorf("%d. got %q/%t, wanted %q/%t", i, user, ok, elt.user, elt.ok)
+		}
+	}
+}
+
+// testConnMetadata is the ssh.ConnMetadata of a login as user.
+type testConnMetadata struct {
+	ssh.ConnMetadata
+	user string
+}
+
+func (md testConnMetadata) User() string { return md.user }
+
+func TestSSHKeyUser(t *testing.T) {
+	dir := t.TempDir()
+	bound, unbound := newTestSSHKey(t), newTestSSHKey(t)
+	authFile := filepath.Join(dir, "authorized_keys")
+	if err := os.WriteFile(authFile, []byte(
+		authorizedKeyLine(`environment="CAMPROXY_USER=alice"`, bound, "")+
+			authorizedKeyLine("", unbound, "")), 0600); err != nil {
+		t.Fatal(err)
+	}
+	s, err := newSSHServer(filepath.Join(dir, "host_key"), authFile, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, elt := range []struct {
+		key  ssh.PublicKey
+		user string
+		ok   bool
+	}{
+		{bound, "alice", true},
+		{bound, "bob", false},
+		{unbound, "alice", false},
+		{unbound, "", false},
+	} {
+		perms, err := s.config.PublicKeyCallback(testConnMetadata{user: elt.user}, elt.key)
+		if (err == nil) != elt.ok {
+			t.Errorf("%d. %q: got %+v", i, elt.user, err)
+			continue
+		}
+		if elt.ok && perms.Extensions[sshUserExt] != elt.user {
+			t.Errorf("%d. got permissions %+v, wanted user %q", i, perms, elt.user)
+		}
+	}
+}
+
+// sftpTestClient serves the SFTP subsystem of ss on a pipe, and returns the
+// function sending a request, and reading its reply.
+func sftpTestClient(t *testing.T, ss *sshSession) func(sftpMsg) (byte, *sftpParser) {
+	cc, sc := net.Pipe()
+	t.Cleanup(func() { cc.Close() })
+	go func() { defer sc.Close(); _ = newSFTPServer(ss, sc).serve() }()
+	_ = cc.SetDeadline(time.Now().Add(10 * time.Second))
+
+	return func(m sftpMsg) (byte, *sftpParser) {
+		t.Helper()
+		b := binary.BigEndian.AppendUint32(nil, uint32(len(m)))
+		if _, err := cc.Write(append(b, m...)); err != nil {
+			t.Fatal(err)
+		}
+		var hdr [4]byte
+		if _, err := io.ReadFull(cc, hdr[:]); err != nil {
+			t.Fatal(err)
+		}
+		pkt := make([]byte, binary.BigEndian.Uint32(hdr[:]))
+		if _, err := io.ReadFull(cc, pkt); err != nil {
+			t.Fatal(err)
+		}
+		return pkt[0], &sftpParser{b: pkt[1:]}
+	}
+}
+
+func TestSFTPReceipt(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	ss := &sshSession{ctx: ctx, logger: logger}
+	ss.receipt.WriteString("sha224-abc\ta.txt\n")
+	call := sftpTestClient(t, ss)
+
+	if typ, p := call(sftpMsg{sshFxpInit}.u32(3)); typ != sshFxpVersion || p.u32() != 3 {
+		t.Fatalf("INIT: got %d", typ)
+	}
+	if typ, p := call(sftpMsg{sshFxpRealpath}.u32(1).str(".")); typ != sshFxpName {
+		t.Fatalf("REALPATH: got %d", typ)
+	} else if p.u32(); p.u32() != 1 || p.str() != "/" {
+		t.Errorf("REALPATH: bad answer")
+	}
+
+	typ, p := call(sftpMsg{sshFxpOpendir}.u32(2).str("/"))
+	if typ != sshFxpHandle || p.u32() != 2 {
+		t.Fatalf("OPENDIR: got %d", typ)
+	}
+	dh := p.str()
+	typ, p = call(sftpMsg{sshFxpReaddir}.u32(3).str(dh))
+	if typ != sshFxpName {
+		t.Fatalf("READDIR: got %d", typ)
+	}
+	p.u32()
+	var names []string
+	for n := p.u32(); n > 0; n-- {
+		names = append(names, p.str())
+		p.str() // longname
+		p.u32()
+		p.u64()
+		p.u32()
+		p.u32()
+		p.u32()
+	}
+	if p.err != nil || len(names) != 1 || names[0] != sshReceiptName {
+		t.Errorf("READDIR: got %q (%v)", names, p.err)
+	}
+	if typ, p = call(sftpMsg{sshFxpReaddir}.u32(4).str(dh)); typ != sshFxpStatus || p.u32() != 4 || p.u32() != sshFxEOF {
+		t.Errorf("READDIR: wanted EOF, got %d", typ)
+	}
+
+	typ, p = call(sftpMsg{sshFxpOpen}.u32(5).str("/" + sshReceiptName).u32(1).u32(0))
+	if typ != sshFxpHandle || p.u32() != 5 {
+		t.Fatalf("OPEN: got %d", typ)
+	}
+	fh := p.str()
+	typ, p = call(sftpMsg{sshFxpRead}.u32(6).str(fh).u64(0).u32(1024))
+	if typ != sshFxpData || p.u32() != 6 {
+		t.Fatalf("READ: got %d", typ)
+	}
+	if got, want := p.str(), "sha224-abc\ta.txt\n"; got != want {
+		t.Errorf("READ: got %q, wanted %q", got, want)
+	}
+	if typ, p = call(sftpMsg{sshFxpClose}.u32(7).str(fh)); typ != sshFxpStatus || p.u32() != 7 || p.u32() != sshFxOK {
+		t.Errorf("CLOSE: got %d", typ)
+	}
+	if typ, p = call(sftpMsg{sshFxpRemove}.u32(8).str("/" + sshReceiptName)); typ != sshFxpStatus || p.u32() != 8 || p.u32() != sshFxPermissionDenied {
+		t.Errorf("REMOVE: got %d", typ)
+	}
+}
+
+func TestSFTPWriteLimits(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	defer func(old int64) { *flagMinFree = old }(*flagMinFree)
+	*flagMinFree = 0
+	ss := &sshSession{ctx: ctx, logger: logger, user: "alice",
+		limits: newRequestLimits(1, 0, 0, 10, nil, 0)}
+	call := sftpTestClient(t, ss)
+	if typ, _ := call(sftpMsg{sshFxpInit}.u32(3)); typ != sshFxpVersion {
+		t.Fatalf("INIT: got %d", typ)
+	}
+	open := func(id uint32) (byte, *sftpParser) {
+		return call(sftpMsg{sshFxpOpen}.u32(id).str("/a.txt").u32(sshFxfWrite).u32(0))
+	}
+	typ, p := open(1)
+	if typ != sshFxpHandle || p.u32() != 1 {
+		t.Fatalf("OPEN: got %d", typ)
+	}
+	fh := p.str()
+	// just one upload at a time
+	if typ, p = open(2); typ != sshFxpStatus || p.u32() != 2 || p.u32() != sshFxFailure {
+		t.Errorf("second OPEN: got %d", typ)
+	}
+
+	for i, elt := range []struct {
+		off  uint64
+		data string
+		code uint32
+	}{
+		{0, "hello", sshFxOK},
+		{5, "world", sshFxOK},
+		{8, "past the end", sshFxFailure},
+		{1 << 40, "x", sshFxFailure},
+		{math.MaxUint64 - 1, "xx", sshFxFailure},
+	} {
+		id := uint32(10 + i)
+		typ, p := call(sftpMsg{sshFxpWrite}.u32(id).str(fh).u64(elt.off).str(elt.data))
+		if typ != sshFxpStatus || p.u32() != id {
+			t.Fatalf("%d. WRITE: got %d", i, typ)
+		}
+		if code := p.u32(); code != elt.code {
+			t.Errorf("%d. WRITE %d+%d: got %d (%s), wanted %d", i, elt.off, len(elt.data), code, p.str(), elt.code)
+		}
+	}
+
+	// without enough free space, the upload is refused
+	*flagMinFree = 1 << 62
+	if free, _ := diskFree(os.TempDir()); free >= 0 {
+		ss2 := &sshSession{ctx: ctx, logger: logger, user: "bob"}
+		call2 := sftpTestClient(t, ss2)
+		call2(sftpMsg{sshFxpInit}.u32(3))
+		if typ, p := call2(sftpMsg{sshFxpOpen}.u32(1).str("/b.txt").u32(sshFxfWrite).u32(0)); typ != sshFxpStatus || p.u32() != 1 || p.u32() != sshFxFailure {
+			t.Errorf("OPEN without free space: got %d", typ)
+		}
+	}
+}
+
+func TestSSHServerNoAuth(t *testing.T) {
+	hostKey := filepath.Join(t.TempDir(), "host_key")
+	if _, err := newSSHServer(hostKey, "", nil); err == nil {
+		t.Error("SSH server without authentication is started")
+	}
+	if _, err := os.Stat(hostKey); err == nil {
+		t.Error("host key is generated for a server which does not start")
+	}
+	if _, err := newSSHServer(hostKey, "", func(string, string) bool { return false }); err != nil {
+		t.Errorf("with a password checker: %+v", err)
+	}
+}
@@ -0,0 +1,106 @@
+//go:build unix
+
+// Copyright 2026 Tamás Gulácsi.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/tgulacsi/camproxy/camutil"
+)
+
+func TestGracefulShutdown(t *testing.T) {
+	camutil.SetLogger(logger)
+	setupBackend(t)
+	defer shuttingDown.Store(false)
+	defer serving.Store(false)
+	defer func(old time.Duration) { *flagDrainDelay = old }(*flagDrainDelay)
+	*flagDrainDelay = 2 * time.Second
+	serving.Store(true)
+	ctx, cancel := wrapCtx(context.Background())
+	defer cancel()
+
+	started, release := make(chan struct{}), make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/_ready", handleReady)
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		_, _ = io.WriteString(w, "done")
+	})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	errCh := make(chan error, 1)
+	go func() { errCh <- serveGraceful(ctx, &http.Server{Handler: mux}, l) }()
+	base := "http://" + l.Addr().String()
+
+	slow := make(chan string, 1)
+	go func() {
+		resp, err := http.Get(base + "/slow")
+		if err != nil {
+			slow <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		slow <- string(b)
+	}()
+	<-started
+
+	if err = syscall.Kill(os.Getpid(), syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+	<-ctx.Done()
+	for !shuttingDown.Load() {
+		time.Sleep(10 * time.Millisecond)
+	}
+	// readiness fails while draining
+	resp, err := http.Get(base + "/_ready")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var hr healthResponse
+	err = json.NewDecoder(resp.Body).Decode(&hr)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusServiceUnavailable || hr.Checks["shutdown"].Status != "fail" {
+		t.Errorf("ready: got %d %+v", resp.StatusCode, hr)
+	}
+
+	// after the drain, the listener is closed, but the request is still served
+	for {
+		c, err := net.DialTimeout("tcp", l.Addr().String(), time.Second)
+		if err != nil {
+			break
+		}
+		c.Close()
+		time.Sleep(50 * time.Millisecond)
+	}
+	select {
+	case err := <-errCh:
+		t.Fatalf("returned with a request in flight: %v", err)
+	default:
+	}
+	close(release)
+	if got := <-slow; got != "done" {
+		t.Errorf("in-flight request: got %q", got)
+	}
+	if err = <-errCh; err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,299 @@
+// Copyright 2026 Tamás Gulácsi.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"perkeep.org/pkg/blob"
+	"perkeep.org/pkg/blobserver"
+
+	"github.com/UNO-SOFT/zlog/v2"
+	"github.com/tgulacsi/camproxy/camutil"
+)
+
+// spool is the store-and-forward upload spool: when the server is down,
+// the uploads are stored locally (blobs under dir/blobs, pending permanode
+// operations under dir/queue), and forwarded when the server recovers.
+type spool struct {
+	dir   string
+	up    *camutil.Uploader
+	blobs blobserver.Storage
+	kick  chan struct{}
+
+	mu      sync.Mutex
+	lastRun time.Time
+	lastErr string
+}
+
+// spoolEntry is the pending permanode (and attributes) operation of a spooled upload.
+type spoolEntry struct {
+	ID        string            `json:"id"`
+	Created   time.Time         `json:"created"`
+	User      string            `json:"user,omitempty"`
+	FileName  string            `json:"fileName"`
+	MIMEType  string            `json:"mimeType,omitempty"`
+	Content   blob.Ref          `json:"content"`
+	Attrs     map[string]string `json:"attrs,omitempty"`
+	Attempts  int               `json:"attempts,omitempty"`
+	LastError string            `json:"lastError,omitempty"`
+}
+
+func newSpool(dir string) (*spool, error) {
+	for _, dn := range []string{filepath.Join(dir, "blobs"), filepath.Join(dir, "queue")} {
+		// nosemgrep: go.lang.correctness.permissions.file_permission.incorrect-default-permission
+		if err := os.MkdirAll(dn, 0700); err != nil {
+			return nil, err
+		}
+	}
+	up := camutil.NewUploader("file://" + filepath.Join(dir, "blobs"))
+	if up == nil {
+		return nil, fmt.Errorf("cannot open spool blob storage under %q", dir)
+	}
+	blobs, ok := up.StatReceiver.(blobserver.Storage)
+	if !ok {
+		return nil, fmt.Errorf("spool blob storage %T is not a blobserver.Storage", up.StatReceiver)
+	}
+	return &spool{dir: dir, up: up, blobs: blobs, kick: make(chan struct{}, 1)}, nil
+}
+
+// Add stores the file or directory tree in the spool, and returns its content
+// ref - the same as the server would return.
+// Only the attrs without "camli" prefix are kept for the permanode, as online.
+func (sp *spool) Add(ctx context.Context, user, path, mimeType string, attrs map[string]string) (blob.Ref, error) {
+	content, err := sp.up.UploadPath(ctx, path, mimeType)
+	if err != nil {
+		return content, err
+	}
+	var permaAttrs map[string]string
+	for k, v := range attrs {
+		if strings.HasPrefix(k, "camli") {
+			continue
+		}
+		if permaAttrs == nil {
+			permaAttrs = make(map[string]string, len(attrs))
+		}
+		permaAttrs[k] = v
+	}
+	var b [4]byte
+	_, _ = rand.Read(b[:])
+	now := time.Now()
+	e := spoolEntry{
+		ID:      fmt.Sprintf("%020d-%s", now.UnixNano(), hex.EncodeToString(b[:])),
+		Created: now, User: user,
+		FileName: filepath.Base(path), MIMEType: mimeType,
+		Content: content, Attrs: permaAttrs,
+	}
+	if err = sp.writeEntry(e); err != nil {
+		return content, err
+	}
+	zlog.SFromContext(ctx).Info("spooled", "id", e.ID, "content", content, "file", e.FileName)
+	return content, nil
+}
+
+func (sp *spool) entryPath(id string) string {
+	return filepath.Join(sp.dir, "queue", id+".json")
+}
+
+// writeEntry writes the entry durably: to a temp file, fsynced, then renamed.
+func (sp *spool) writeEntry(e spoolEntry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return writeFileSync(sp.entryPath(e.ID), b)
+}
+
+func writeFileSync(fn string, data []byte) error {
+	dir := filepath.Dir(fn)
+	fh, err := os.CreateTemp(dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(fh.Name())
+	if _, err = fh.Write(data); err == nil {
+		err = fh.Sync()
+	}
+	if closeErr := fh.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err = os.Rename(fh.Name(), fn); err != nil {
+		return err
+	}
+	if dh, err := os.Open(dir); err == nil {
+		_ = dh.Sync()
+		dh.Close()
+	}
+	return nil
+}
+
+// Entries returns the pending entries, oldest first.
+func (sp *spool) Entries() ([]spoolEntry, error) {
+	des, err := os.ReadDir(filepath.Join(sp.dir, "queue"))
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]spoolEntry, 0, len(des))
+	for _, de := range des {
+		if !strings.HasSuffix(de.Name(), ".json") || strings.HasPrefix(de.Name(), ".") {
+			continue
+		}
+		b, err := os.ReadFile(filepath.Join(sp.dir, "queue", de.Name()))
+		if err != nil {
+			return entries, err
+		}
+		var e spoolEntry
+		if err = json.Unmarshal(b, &e); err != nil {
+			logger.Error("unmarshal spool entry", "file", de.Name(), "error", err)
+			continue
+		}
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].ID < entries[j].ID })
+	return entries, nil
+}
+
+// Kick makes the forwarder try again now.
+func (sp *spool) Kick() {
+	select {
+	case sp.kick <- struct{}{}:
+	default:
+	}
+}
+
+// Run forwards the spool to the server in every interval, till ctx is done.
+func (sp *spool) Run(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		err := sp.Forward(ctx)
+		sp.mu.Lock()
+		sp.lastRun, sp.lastErr = time.Now(), ""
+		if err != nil {
+			sp.lastErr = err.Error()
+		}
+		sp.mu.Unlock()
+		if err != nil {
+			logger.Info("forward spool", "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		case <-sp.kick:
+		}
+	}
+}
+
+// Forward pushes the spooled blobs to the server, then creates the pending
+// permanodes. Forwarded blobs and entries are removed from the spool.
+func (sp *spool) Forward(ctx context.Context) error {
+	entries, err := sp.Entries()
+	if err != nil || len(entries) == 0 {
+		return err
+	}
+	if err = checkBackend(ctx); err != nil {
+		return fmt.Errorf("server is unavailable: %w", err)
+	}
+	c, err := camutil.NewClient(server)
+	if err != nil {
+		return err
+	}
+	var refs []blob.SizedRef
+	if err = blobserver.EnumerateAll(ctx, sp.blobs, func(sr blob.SizedRef) error {
+		refs = append(refs, sr)
+		return nil
+	}); err != nil {
+		return fmt.Errorf("enumerate spooled blobs: %w", err)
+	}
+	for _, sr := range refs {
+		rc, _, err := sp.blobs.Fetch(ctx, sr.Ref)
+		if err != nil {
+			return fmt.Errorf("fetch spooled %v: %w", sr.Ref, err)
+		}
+		_, err = c.ReceiveBlob(ctx, sr.Ref, rc)
+		rc.Close()
+		if err != nil {
+			return fmt.Errorf("upload spooled %v: %w", sr.Ref, err)
+		}
+		if err = sp.blobs.RemoveBlobs(ctx, []blob.Ref{sr.Ref}); err != nil {
+			logger.Error("remove forwarded blob", "ref", sr.Ref, "error", err)
+		}
+	}
+
+	u, err := getUploader()
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if len(e.Attrs) != 0 {
+			attrs := make(map[string]string, len(e.Attrs)+1)
+			for k, v := range e.Attrs {
+				attrs[k] = v
+			}
+			attrs["camliContent"] = e.Content.String()
+			perma, err := u.NewPermanode(ctx, attrs)
+			if err != nil {
+				e.Attempts++
+				e.LastError = err.Error()
+				if wErr := sp.writeEntry(e); wErr != nil {
+					logger.Error("update spool entry", "id", e.ID, "error", wErr)
+				}
+				return fmt.Errorf("permanode for %s: %w", e.ID, err)
+			}
+			logger.Info("forwarded", "id", e.ID, "content", e.Content, "permanode", perma)
+		} else {
+			logger.Info("forwarded", "id", e.ID, "content", e.Content)
+		}
+		if err = os.Remove(sp.entryPath(e.ID)); err != nil {
+			logger.Error("remove spool entry", "id", e.ID, "error", err)
+		}
+	}
+	return nil
+}
+
+// ServeHTTP shows the spool queue; POST makes the forwarder try now.
+func (sp *spool) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "POST" {
+		sp.Kick()
+	}
+	entries, err := sp.Entries()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var blobs int
+	var size int64
+	_ = blobserver.EnumerateAll(r.Context(), sp.blobs, func(sr blob.SizedRef) error {
+		blobs++
+		size += int64(sr.Size)
+		return nil
+	})
+	sp.mu.Lock()
+	lastRun, lastErr := sp.lastRun, sp.lastErr
+	sp.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(struct {
+		LastRun   time.Time    `json:"lastRun"`
+		LastError string       `json:"lastError,omitempty"`
+		Blobs     int          `json:"blobs"`
+		BlobBytes int64        `json:"blobBytes"`
+		Entries   []spoolEntry `json:"entries"`
+	}{lastRun, lastErr, blobs, size, entries})
+}
@@ -0,0 +1,226 @@
+// Copyright 2026 Tamás Gulácsi.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"perkeep.org/pkg/blob"
+	"perkeep.org/pkg/blobserver"
+
+	"github.com/tgulacsi/camproxy/camutil"
+)
+
+func TestWriteFileSync(t *testing.T) {
+	dir := t.TempDir()
+	fn := filepath.Join(dir, "a.json")
+	for _, s := range []string{"first", "second"} {
+		if err := writeFileSync(fn, []byte(s)); err != nil {
+			t.Fatal(err)
+		}
+		if b, err := os.ReadFile(fn); err != nil || string(b) != s {
+			t.Errorf("got %q (%v), wanted %q", b, err, s)
+		}
+	}
+	des, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(des) != 1 {
+		t.Errorf("temp files are left: %v", des)
+	}
+}
+
+func TestSpoolEntriesCrash(t *testing.T) {
+	camutil.SetLogger(logger)
+	sp, err := newSpool(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"2", "1"} {
+		if err = sp.writeEntry(spoolEntry{ID: id, FileName: id + ".txt"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a crash before the rename leaves just a temp file,
+	// a crash during a non-atomic write would leave a torn entry
+	queue := filepath.Join(sp.dir, "queue")
+	if err = os.WriteFile(filepath.Join(queue, ".tmp-123"), []byte(`{"id":"3"`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(filepath.Join(queue, "4.json"), []byte(`{"id":"4"`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := sp.Entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].ID != "1" || entries[1].ID != "2" {
+		t.Errorf("got %+v", entries)
+	}
+}
+
+func TestSpoolAddForward(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	camutil.SetLogger(logger)
+	dir := t.TempDir()
+	backend := filepath.Join(dir, "backend")
+	if err := os.MkdirAll(backend, 0700); err != nil {
+		t.Fatal(err)
+	}
+	defer func(old string) { server = old }(server)
+	server = "file://" + backend
+
+	sp, err := newSpool(filepath.Join(dir, "spool"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := filepath.Join(dir, "src")
+	if err = os.MkdirAll(src, 0700); err != nil {
+		t.Fatal(err)
+	}
+	for _, nm := range []string{"a.txt", "b.txt"} {
+		if err = os.WriteFile(filepath.Join(src, nm), []byte(strings.Repeat(nm, 100)), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	content, err := sp.Add(ctx, "alice", src, "", map[string]string{"title": "x", "camliContent": "y"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := sp.Entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Content != content || entries[0].FileName != "src" || entries[0].User != "alice" {
+		t.Errorf("got entries %+v", entries)
+	} else if len(entries[0].Attrs) != 1 || entries[0].Attrs["title"] != "x" {
+		t.Errorf("got attrs %v, wanted only title", entries[0].Attrs)
+	}
+	var refs []blob.Ref
+	if err = blobserver.EnumerateAll(ctx, sp.blobs, func(sr blob.SizedRef) error {
+		refs = append(refs, sr.Ref)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = sp.Forward(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if entries, err = sp.Entries(); err != nil || len(entries) != 0 {
+		t.Errorf("entries are left after forward: %+v (%v)", entries, err)
+	}
+	var left int
+	if err = blobserver.EnumerateAll(ctx, sp.blobs, func(blob.SizedRef) error { left++; return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if left != 0 {
+		t.Errorf("%d blobs are left in the spool", left)
+	}
+	c, err := camutil.NewClient(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := make(map[blob.Ref]bool)
+	if err = c.StatBlobs(ctx, refs, func(sr blob.SizedRef) error { found[sr.Ref] = true; return nil }); err != nil {
+		t.Fatal(err)
+	}
+	for _, br := range refs {
+		if !found[br] {
+			t.Errorf("%v is not forwarded", br)
+		}
+	}
+}
+
+func TestSpoolMultiFileResponse(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	backend := setupBackend(t)
+	defer func(old *spool) { uploadSpool = old }(uploadSpool)
+	spoolDir := filepath.Join(t.TempDir(), "spool")
+	var err error
+	if uploadSpool, err = newSpool(spoolDir); err != nil {
+		t.Fatal(err)
+	}
+
+	post := func(wantCode int) uploadResult {
+		t.Helper()
+		var buf bytes.Buffer
+		mw := multipart.NewWriter(&buf)
+		for _, nm := range []string{"a.txt", "b.txt"} {
+			pw, err := mw.CreateFormFile("file", nm)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, _ = pw.Write([]byte(strings.Repeat(nm, 100)))
+		}
+		mw.Close()
+		r := httptest.NewRequest("POST", "/?json=1&mtime=2026-01-02T03:04:05Z", &buf)
+		r.Header.Set("Content-Type", mw.FormDataContentType())
+		w := httptest.NewRecorder()
+		handle(w, r)
+		if w.Code != wantCode {
+			t.Fatalf("POST: got %d, wanted %d: %s", w.Code, wantCode, w.Body)
+		}
+		var res uploadResult
+		if err := json.NewDecoder(w.Body).Decode(&res); err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+	readDir := func(storage, content string) []camutil.DirEntry {
+		t.Helper()
+		down, err := camutil.NewDownloader("file://"+storage, camutil.WithNoCache(true))
+		if err != nil {
+			t.Fatal(err)
+		}
+		list, err := down.ReadDir(ctx, blob.MustParse(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return list
+	}
+
+	online := post(http.StatusCreated)
+	onlineList := readDir(backend, online.Content)
+
+	// a regular file can't be a directory: the server is unreachable
+	blocker := filepath.Join(t.TempDir(), "blocker")
+	if err = os.WriteFile(blocker, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	server = "file://" + filepath.Join(blocker, "backend")
+	spooled := post(http.StatusAccepted)
+	spooledList := readDir(filepath.Join(spoolDir, "blobs"), spooled.Content)
+
+	if !spooled.Spooled {
+		t.Error("the response is not marked as spooled")
+	}
+	// only the directory (its temp name and mtime) may differ
+	online.Content, spooled.Content = "", ""
+	online.Existed, online.Stats, spooled.Spooled = false, nil, false
+	if !reflect.DeepEqual(online, spooled) {
+		t.Errorf("online response %+v, spooled %+v", online, spooled)
+	}
+	if !reflect.DeepEqual(onlineList, spooledList) {
+		t.Errorf("online tree %+v, spooled %+v", onlineList, spooledList)
+	}
+	if entries, err := uploadSpool.Entries(); err != nil || len(entries) != 1 {
+		t.Errorf("got spool entries %+v (%v), wanted one", entries, err)
+	}
+}
@@ -0,0 +1,450 @@
+// Copyright 2026 Tamás Gulácsi.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/UNO-SOFT/zlog/v2"
+	"github.com/tgulacsi/camproxy/camutil"
+	"golang.org/x/crypto/ssh"
+	"perkeep.org/pkg/blob"
+)
+
+// sshReceiptName is the name of the receipt file of the SFTP sessions.
+const sshReceiptName = "receipt.txt"
+
+// sshServer is the SSH listener for the hosts with just OpenSSH:
+// it speaks SFTP (see sftpServer), and the sink mode of scp (scp -t).
+type sshServer struct {
+	config *ssh.ServerConfig
+	// limits and rl are the limits of the HTTP side (no limits if nil).
+	limits *requestLimits
+	rl     *rateLimiter
+}
+
+// newSSHServer returns the server with the host key at hostKeyPath (created
+// if does not exist), authenticating with the authorized_keys file, or the
+// password checker. Without both, it is an error: the uploads need a user.
+func newSSHServer(hostKeyPath, authorizedKeys string, check func(user, password string) bool) (*sshServer, error) {
+	if authorizedKeys == "" && check == nil {
+		return nil, errors.New("no authentication: set CAMLI_AUTH or -ssh-authorized-keys")
+	}
+	signer, err := loadHostKey(hostKeyPath)
+	if err != nil {
+		return nil, err
+	}
+	config := &ssh.ServerConfig{}
+	if check != nil {
+		config.PasswordCallback = func(c ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if check(c.User(), string(password)) {
+				return &ssh.Permissions{Extensions: map[string]string{sshUserExt: c.User()}}, nil
+			}
+			return nil, errors.New("bad password")
+		}
+	}
+	if authorizedKeys != "" {
+		config.PublicKeyCallback = func(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			// read on every try, so the changes need no restart
+			b, err := os.ReadFile(authorizedKeys)
+			if err != nil {
+				return nil, err
+			}
+			user, ok := authorizedKey(b, key)
+			if !ok {
+				return nil, errors.New("unknown key")
+			}
+			if user == "" {
+				return nil, errors.New("the key is not bound to a user")
+			}
+			if user != c.User() {
+				return nil, fmt.Errorf("the key is not of %q", c.User())
+			}
+			return &ssh.Permissions{Extensions: map[string]string{
+				"pubkey-fp": ssh.FingerprintSHA256(key),
+				sshUserExt:  user,
+			}}, nil
+		}
+	}
+	config.AddHostKey(signer)
+	return &sshServer{config: config}, nil
+}
+
+// sshUserExt is the permission extension of the authenticated user.
+const sshUserExt = "camproxy-user"
+
+// authorizedKey returns the user of key, if it is in the authorized_keys
+// file content b. The user is given by the environment="CAMPROXY_USER=name"
+// option of the key, or else the comment (the part before @, if any).
+func authorizedKey(b []byte, key ssh.PublicKey) (string, bool) {
+	want := key.Marshal()
+	for len(b) != 0 {
+		k, comment, options, rest, err := ssh.ParseAuthorizedKey(b)
+		if err != nil {
+			return "", false
+		}
+		if bytes.Equal(k.Marshal(), want) {
+			for _, o := range options {
+				if v, ok := strings.CutPrefix(o, `environment="CAMPROXY_USER=`); ok {
+					return strings.TrimSuffix(v, `"`), true
+				}
+			}
+			user, _, _ := strings.Cut(comment, "@")
+			return strings.TrimSpace(user), true
+		}
+		b = rest
+	}
+	return "", false
+}
+
+// loadHostKey loads the host key, or generates an ed25519 key there.
+func loadHostKey(path string) (ssh.Signer, error) {
+	b, err := os.ReadFile(path)
+	if err == nil {
+		return ssh.ParsePrivateKey(b)
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	block, err := ssh.MarshalPrivateKey(priv, "camproxy")
+	if err != nil {
+		return nil, err
+	}
+	// nosemgrep: go.lang.correctness.permissions.file_permission.incorrect-default-permission
+	if err = os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	if err = os.WriteFile(path, pem.EncodeToMemory(block), 0600); err != nil {
+		return nil, err
+	}
+	logger.Info("generated SSH host key", "path", path)
+	return ssh.NewSignerFromKey(priv)
+}
+
+// defaultSSHHostKeyPath returns the default path of the host key.
+func defaultSSHHostKeyPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "camproxy", "ssh_host_ed25519_key")
+}
+
+// Serve accepts the connections on l, until ctx is canceled.
+func (s *sshServer) Serve(ctx context.Context, l net.Listener) error {
+	go func() { <-ctx.Done(); l.Close() }()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		go s.serveConn(ctx, conn)
+	}
+}
+
+func (s *sshServer) serveConn(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+	lgr := logger.With("ssh", conn.RemoteAddr().String())
+	sconn, chans, reqs, err := ssh.NewServerConn(conn, s.config)
+	if err != nil {
+		lgr.Info("ssh handshake", "error", err)
+		return
+	}
+	defer sconn.Close()
+	lgr = lgr.With("user", sconn.User())
+	go ssh.DiscardRequests(reqs)
+	for nc := range chans {
+		if nc.ChannelType() != "session" {
+			_ = nc.Reject(ssh.UnknownChannelType, "only sessions are supported")
+			continue
+		}
+		ch, reqs, err := nc.Accept()
+		if err != nil {
+			lgr.Info("accept channel", "error", err)
+			continue
+		}
+		ss := &sshSession{ctx: zlog.NewSContext(ctx, lgr), logger: lgr, user: sshUser(sconn),
+			limits: s.limits, rl: s.rl}
+		go ss.serve(ch, reqs)
+	}
+}
+
+// sshUser returns the user bound by the authentication callbacks.
+func sshUser(sconn *ssh.ServerConn) string {
+	if sconn.Permissions == nil {
+		return ""
+	}
+	return sconn.Permissions.Extensions[sshUserExt]
+}
+
+// sshSession is an SSH session: the uploads and their receipt.
+type sshSession struct {
+	ctx    context.Context
+	logger *slog.Logger
+	user   string
+	limits *requestLimits
+	rl     *rateLimiter
+
+	mu       sync.Mutex
+	receipt  bytes.Buffer
+	uploaded map[string]sftpEntry
+}
+
+func (ss *sshSession) serve(ch ssh.Channel, reqs <-chan *ssh.Request) {
+	defer ch.Close()
+	for req := range reqs {
+		switch req.Type {
+		case "subsystem":
+			var payload struct{ Name string }
+			if err := ssh.Unmarshal(req.Payload, &payload); err != nil || payload.Name != "sftp" {
+				_ = req.Reply(false, nil)
+				continue
+			}
+			_ = req.Reply(true, nil)
+			err := newSFTPServer(ss, ch).serve()
+			if err != nil {
+				ss.logger.Info("sftp", "error", err)
+			}
+			ss.exit(ch, err)
+			return
+		case "exec":
+			var payload struct{ Command string }
+			if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+				_ = req.Reply(false, nil)
+				continue
+			}
+			args := strings.Fields(payload.Command)
+			if len(args) == 0 || filepath.Base(args[0]) != "scp" || !hasFlag(args[1:], 't') {
+				_ = req.Reply(true, nil)
+				fmt.Fprintf(ch.Stderr(), "camproxy: just sftp and scp uploads (scp -t) are supported, not %q\n", payload.Command)
+				ss.exit(ch, errors.New("unsupported command"))
+				return
+			}
+			_ = req.Reply(true, nil)
+			err := ss.scpSink(ch)
+			if err != nil {
+				ss.logger.Info("scp", "error", err)
+			}
+			ss.exit(ch, err)
+			return
+		case "env":
+			_ = req.Reply(true, nil)
+		default:
+			_ = req.Reply(false, nil)
+		}
+	}
+}
+
+func (ss *sshSession) exit(ch ssh.Channel, err error) {
+	var status struct{ Status uint32 }
+	if err != nil {
+		status.Status = 1
+	}
+	_, _ = ch.SendRequest("exit-status", false, ssh.Marshal(&status))
+}
+
+// hasFlag reports whether the flag c is among the args (as in "-t", "-rt").
+func hasFlag(args []string, c byte) bool {
+	for _, a := range args {
+		if len(a) > 1 && a[0] == '-' && a[1] != '-' && strings.IndexByte(a[1:], c) >= 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// startUpload applies the limits of the HTTP side to an upload of the session:
+// the returned quota must be released, the limiter shapes the transfer.
+func (ss *sshSession) startUpload() (*uploadQuota, *clientLimiter, error) {
+	cl, err := ss.rl.allow("user:" + ss.user)
+	if err != nil {
+		return nil, nil, err
+	}
+	q, err := ss.limits.startUpload(ss.user)
+	return q, cl, err
+}
+
+// upload uploads the file named name, and records it in the receipt.
+func (ss *sshSession) upload(name string, fh *os.File) (blob.Ref, error) {
+	fi, err := fh.Stat()
+	if err != nil {
+		return blob.Ref{}, err
+	}
+	if _, err = fh.Seek(0, io.SeekStart); err != nil {
+		return blob.Ref{}, err
+	}
+	u, err := getUploader()
+	if err != nil {
+		return blob.Ref{}, err
+	}
+	mimeType, r := camutil.MIMETypeFromReader(fh)
+	content, _, err := u.UploadReaderInfoLazyAttr(ss.ctx, namedFileInfo{FileInfo: fi, name: name}, mimeType, r, nil)
+	if err != nil {
+		return content, fmt.Errorf("upload %q: %w", name, err)
+	}
+	if mimeType != "" && mimeCache != nil {
+		mimeCache.Set(camutil.RefToBase64(content), mimeType)
+	}
+	now := time.Now()
+	uploads.remember(ss.user, recentUpload{Ref: content, Name: name, Size: fi.Size(), Time: now})
+	ss.logger.Info("uploaded", "name", name, "content", content, "size", fi.Size())
+
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	fmt.Fprintf(&ss.receipt, "%s\t%s\n", content, name)
+	if ss.uploaded == nil {
+		ss.uploaded = make(map[string]sftpEntry)
+	}
+	ss.uploaded[name] = sftpEntry{name: name, size: fi.Size(), mode: 0444, mtime: now, ref: content}
+	return content, nil
+}
+
+func (ss *sshSession) receiptBytes() []byte {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	return bytes.Clone(ss.receipt.Bytes())
+}
+
+func (ss *sshSession) uploadedEntry(name string) (sftpEntry, bool) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	e, ok := ss.uploaded[name]
+	return e, ok
+}
+
+func (ss *sshSession) uploadedEntries() []sftpEntry {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	entries := make([]sftpEntry, 0, len(ss.uploaded)+1)
+	for _, e := range ss.uploaded {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].name < entries[j].name })
+	return entries
+}
+
+// scpSink receives the files of "scp -t": each file is uploaded, and its ref
+// is written to stderr. The directories (scp -r) are flattened.
+func (ss *sshSession) scpSink(ch ssh.Channel) error {
+	r := bufio.NewReader(ch)
+	ack := func() error { _, err := ch.Write([]byte{0}); return err }
+	if err := ack(); err != nil {
+		return err
+	}
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			if errors.Is(err, io.EOF) && line == "" {
+				return nil
+			}
+			return err
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			return errors.New("empty scp command")
+		}
+		switch line[0] {
+		case 'C':
+			// C<mode> <size> <name>
+			fields := strings.SplitN(line[1:], " ", 3)
+			if len(fields) != 3 {
+				return fmt.Errorf("bad scp command %q", line)
+			}
+			size, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil || size < 0 {
+				return fmt.Errorf("bad size in %q", line)
+			}
+			name := safeBaseFn(fields[2])
+			// an error instead of the ack makes scp skip the file
+			q, cl, err := ss.startUpload()
+			if err == nil {
+				if err = q.grow(size); err != nil {
+					q.Release()
+				}
+			}
+			if err != nil {
+				ss.logger.Info("scp", "file", name, "size", size, "error", err)
+				fmt.Fprintf(ch, "\x01scp: %s: %v\n", name, err)
+				continue
+			}
+			if err = ack(); err != nil {
+				q.Release()
+				return err
+			}
+			ref, err := ss.scpReceive(r, name, size, cl)
+			q.Release()
+			if err != nil {
+				// a warning: the next file can come
+				fmt.Fprintf(ch, "\x01scp: %s: %v\n", name, err)
+				if errors.Is(err, io.ErrUnexpectedEOF) {
+					return err
+				}
+				continue
+			}
+			fmt.Fprintf(ch.Stderr(), "%s\t%s\n", ref, name)
+			if err = ack(); err != nil {
+				return err
+			}
+		case 'D', 'E', 'T':
+			if err = ack(); err != nil {
+				return err
+			}
+		case '\x01', '\x02':
+			ss.logger.Warn("scp", "message", line[1:])
+			if line[0] == '\x02' {
+				return errors.New(line[1:])
+			}
+		default:
+			return fmt.Errorf("unknown scp command %q", line)
+		}
+	}
+}
+
+// scpReceive receives the size bytes of the file (shaped by cl),
+// and the closing zero byte, and uploads it.
+func (ss *sshSession) scpReceive(r *bufio.Reader, name string, size int64, cl *clientLimiter) (blob.Ref, error) {
+	fh, err := os.CreateTemp("", "camproxy-scp-")
+	if err != nil {
+		_, _ = io.CopyN(io.Discard, r, size+1)
+		return blob.Ref{}, err
+	}
+	defer func() { fh.Close(); os.Remove(fh.Name()) }()
+	if _, err = io.CopyN(fh, cl.Reader(ss.ctx, r), size); err != nil {
+		return blob.Ref{}, fmt.Errorf("%w: %w", io.ErrUnexpectedEOF, err)
+	}
+	if b, err := r.ReadByte(); err != nil || b != 0 {
+		return blob.Ref{}, fmt.Errorf("%w: no closing zero byte", io.ErrUnexpectedEOF)
+	}
+	return ss.upload(name, fh)
+}
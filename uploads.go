@@ -0,0 +1,214 @@
+// Copyright 2026 Tamás Gulácsi.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tgulacsi/camproxy/camutil"
+	"perkeep.org/pkg/blob"
+)
+
+// uploads is the registry of the uploads in progress.
+var uploads = uploadRegistry{m: make(map[*uploadStatus]struct{})}
+
+// uploadRegistry holds the uploads in progress - not keyed by the request ID,
+// as that comes from the client, and two clients may send the same.
+type uploadRegistry struct {
+	mu     sync.Mutex
+	m      map[*uploadStatus]struct{}
+	recent map[string][]recentUpload // by user, the newest last
+}
+
+// maxRecentUploads is the number of finished uploads remembered per user.
+const maxRecentUploads = 100
+
+// recentUpload is a finished upload.
+type recentUpload struct {
+	Ref  blob.Ref
+	Name string
+	Size int64
+	Time time.Time
+}
+
+// uploadInfo is the state of one upload request.
+type uploadInfo struct {
+	ID      string    `json:"id"`
+	User    string    `json:"user,omitempty"`
+	Started time.Time `json:"started"`
+	Phase   string    `json:"phase"`
+	// Received is the number of request body bytes received so far,
+	// Expected is the request's Content-Length (if given).
+	Received int64            `json:"received"`
+	Expected int64            `json:"expected,omitempty"`
+	Progress camutil.Progress `json:"progress"`
+}
+
+type uploadStatus struct {
+	mu   sync.Mutex
+	info uploadInfo
+}
+
+// start registers the upload with the request ID, in the "receiving" phase.
+func (ur *uploadRegistry) start(id, user string) *uploadStatus {
+	us := &uploadStatus{info: uploadInfo{ID: id, User: user, Started: time.Now(), Phase: "receiving"}}
+	ur.mu.Lock()
+	ur.m[us] = struct{}{}
+	ur.mu.Unlock()
+	return us
+}
+
+// finish removes the upload from the registry.
+func (ur *uploadRegistry) finish(us *uploadStatus) {
+	ur.mu.Lock()
+	delete(ur.m, us)
+	ur.mu.Unlock()
+}
+
+// remember records the finished upload of the user.
+func (ur *uploadRegistry) remember(user string, ru recentUpload) {
+	ur.mu.Lock()
+	defer ur.mu.Unlock()
+	if ur.recent == nil {
+		ur.recent = make(map[string][]recentUpload)
+	}
+	list := append(ur.recent[user], ru)
+	if len(list) > maxRecentUploads {
+		list = append(list[:0], list[len(list)-maxRecentUploads:]...)
+	}
+	ur.recent[user] = list
+}
+
+// recentUploads returns the finished uploads of the user, the newest first.
+func (ur *uploadRegistry) recentUploads(user string) []recentUpload {
+	ur.mu.Lock()
+	defer ur.mu.Unlock()
+	list := ur.recent[user]
+	res := make([]recentUpload, len(list))
+	for i, ru := range list {
+		res[len(list)-1-i] = ru
+	}
+	return res
+}
+
+func (us *uploadStatus) setPhase(phase string) {
+	us.mu.Lock()
+	us.info.Phase = phase
+	us.mu.Unlock()
+}
+
+// setProgress is the camutil.ProgressFunc of the upload.
+func (us *uploadStatus) setProgress(p camutil.Progress) {
+	us.mu.Lock()
+	us.info.Phase, us.info.Progress = "uploading", p
+	us.mu.Unlock()
+}
+
+// countBody returns body, counting the bytes read from it as received;
+// expected is the Content-Length of the request (-1 if unknown).
+func (us *uploadStatus) countBody(body io.ReadCloser, expected int64) io.ReadCloser {
+	if expected > 0 {
+		us.mu.Lock()
+		us.info.Expected = expected
+		us.mu.Unlock()
+	}
+	return countingBody{ReadCloser: body, us: us}
+}
+
+type countingBody struct {
+	io.ReadCloser
+	us *uploadStatus
+}
+
+func (cb countingBody) Read(p []byte) (int, error) {
+	n, err := cb.ReadCloser.Read(p)
+	if n > 0 {
+		cb.us.mu.Lock()
+		cb.us.info.Received += int64(n)
+		cb.us.mu.Unlock()
+	}
+	return n, err
+}
+
+func (us *uploadStatus) snapshot() uploadInfo {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	return us.info
+}
+
+// ServeHTTP lists the uploads in progress, or just the one with the
+// request ID given as /_uploads/<id> - of the requesting user, if the same
+// ID is used by more.
+func (ur *uploadRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/_uploads"), "/")
+	user := authUser(r.Context())
+	ur.mu.Lock()
+	list := make([]uploadInfo, 0, len(ur.m))
+	for us := range ur.m {
+		if info := us.snapshot(); id == "" || info.ID == id {
+			list = append(list, info)
+		}
+	}
+	ur.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Started.Before(list[j].Started) })
+	w.Header().Set("Content-Type", "application/json")
+	if id != "" {
+		if len(list) == 0 {
+			http.Error(w, "no upload in progress with ID "+id, http.StatusNotFound)
+			return
+		}
+		info := list[0]
+		for _, elt := range list {
+			if elt.User == user {
+				info = elt
+				break
+			}
+		}
+		_ = json.NewEncoder(w).Encode(info)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(list)
+}
+
+var (
+	uploadTotalBytes = expvar.NewInt("uploadTotalBytes")
+	uploadNewBytes   = expvar.NewInt("uploadNewBytes")
+	uploadsExisted   = expvar.NewInt("uploadsExisted")
+)
+
+// uploadResult is the JSON response of an upload.
+type uploadResult struct {
+	Content   string               `json:"content"`
+	Permanode string               `json:"permanode,omitempty"`
+	Spooled   bool                 `json:"spooled,omitempty"`
+	Existed   bool                 `json:"existed"`
+	Stats     *camutil.UploadStats `json:"stats,omitempty"`
+}
+
+// countUploadStats adds the stats to the expvar counters, for the dedup ratio.
+func countUploadStats(stats camutil.UploadStats) {
+	uploadTotalBytes.Add(stats.TotalBytes)
+	uploadNewBytes.Add(stats.NewBytes)
+	if stats.Existed() {
+		uploadsExisted.Add(1)
+	}
+}
+
+// setUploadStatsHeaders sets the X-Camproxy-* headers of the upload stats.
+func setUploadStatsHeaders(h http.Header, stats camutil.UploadStats) {
+	h.Set("X-Camproxy-Existed", strconv.FormatBool(stats.Existed()))
+	h.Set("X-Camproxy-Total-Bytes", strconv.FormatInt(stats.TotalBytes, 10))
+	h.Set("X-Camproxy-New-Bytes", strconv.FormatInt(stats.NewBytes, 10))
+	h.Set("X-Camproxy-Chunks", strconv.Itoa(stats.Chunks))
+	h.Set("X-Camproxy-Reused-Chunks", strconv.Itoa(stats.ReusedChunks))
+}
@@ -0,0 +1,66 @@
+// Copyright 2026 Tamás Gulácsi.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestUploadRegistrySameID(t *testing.T) {
+	ur := uploadRegistry{m: make(map[*uploadStatus]struct{})}
+	a := ur.start("same", "alice")
+	b := ur.start("same", "bob")
+	b.setPhase("uploading")
+
+	get := func(user string) (info uploadInfo, code int) {
+		r := httptest.NewRequest("GET", "/_uploads/same", nil)
+		r = r.WithContext(context.WithValue(r.Context(), ctxKeyAuthUser{}, user))
+		w := httptest.NewRecorder()
+		ur.ServeHTTP(w, r)
+		if w.Code == 200 {
+			if err := json.NewDecoder(w.Body).Decode(&info); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return info, w.Code
+	}
+	if info, _ := get("bob"); info.User != "bob" || info.Phase != "uploading" {
+		t.Errorf("bob: got %+v", info)
+	}
+	ur.finish(a)
+	if info, code := get("alice"); code != 200 || info.User != "bob" {
+		t.Errorf("finishing alice's upload removed bob's: got %d %+v", code, info)
+	}
+	ur.finish(b)
+	if _, code := get("bob"); code != 404 {
+		t.Errorf("finished: got %d", code)
+	}
+}
+
+func TestUploadStatusReceived(t *testing.T) {
+	ur := uploadRegistry{m: make(map[*uploadStatus]struct{})}
+	us := ur.start("id", "alice")
+	defer ur.finish(us)
+	body := us.countBody(io.NopCloser(strings.NewReader("0123456789")), 10)
+	for i, elt := range []struct {
+		read, want int64
+	}{
+		{4, 4},
+		{0, 4},
+		{100, 10},
+	} {
+		if _, err := io.CopyN(io.Discard, body, elt.read); err != nil && err != io.EOF {
+			t.Fatal(err)
+		}
+		if info := us.snapshot(); info.Received != elt.want || info.Expected != 10 || info.Phase != "receiving" {
+			t.Errorf("%d. got %+v, wanted %d received", i, info, elt.want)
+		}
+	}
+}